@@ -0,0 +1,223 @@
+package admin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+type AdminCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewAdmin(c *config.Config) (a *AdminCmd) {
+	a = new(AdminCmd)
+	a.Config = c
+
+	return a
+}
+
+func (a *AdminCmd) Help(cmd *cobra.Command, argz []string) {
+	a.CmdOutput.WasSuccess = true
+	fmt.Fprintln(a.Config.Stdout, help.AdminHelp(a.Config))
+}
+
+func (a *AdminCmd) Owner(cmd *cobra.Command, argz []string) {
+	a.get(argz, 1, func(_ []string) (*meshtastic.AdminMessage, error) {
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetOwnerRequest{GetOwnerRequest: true},
+		}, nil
+	}, func(r *meshtastic.AdminMessage) proto.Message { return r.GetGetOwnerResponse() })
+}
+
+func (a *AdminCmd) Metadata(cmd *cobra.Command, argz []string) {
+	a.get(argz, 1, func(_ []string) (*meshtastic.AdminMessage, error) {
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetDeviceMetadataRequest{GetDeviceMetadataRequest: true},
+		}, nil
+	}, func(r *meshtastic.AdminMessage) proto.Message { return r.GetGetDeviceMetadataResponse() })
+}
+
+// Config gets one section of the node's config, eg. 'lora' or 'LORA_CONFIG'
+func (a *AdminCmd) ConfigGet(cmd *cobra.Command, argz []string) {
+	a.get(argz, 2, func(args []string) (*meshtastic.AdminMessage, error) {
+		configType, ok := meshtastic.AdminMessage_ConfigType_value[configName(args[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown config type '%s'", args[1])
+		}
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetConfigRequest{GetConfigRequest: meshtastic.AdminMessage_ConfigType(configType)},
+		}, nil
+	}, func(r *meshtastic.AdminMessage) proto.Message { return r.GetGetConfigResponse() })
+}
+
+// Module gets one module config, eg. 'mqtt' or 'MQTT_CONFIG'
+func (a *AdminCmd) Module(cmd *cobra.Command, argz []string) {
+	a.get(argz, 2, func(args []string) (*meshtastic.AdminMessage, error) {
+		moduleType, ok := meshtastic.AdminMessage_ModuleConfigType_value[configName(args[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown module config type '%s'", args[1])
+		}
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetModuleConfigRequest{GetModuleConfigRequest: meshtastic.AdminMessage_ModuleConfigType(moduleType)},
+		}, nil
+	}, func(r *meshtastic.AdminMessage) proto.Message { return r.GetGetModuleConfigResponse() })
+}
+
+// Channel gets a channel by its index (0 is primary)
+func (a *AdminCmd) Channel(cmd *cobra.Command, argz []string) {
+	a.get(argz, 2, func(args []string) (*meshtastic.AdminMessage, error) {
+		index, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel index '%s': %v", args[1], err)
+		}
+		// The firmware expects index+1 so that channel 0 isn't sent as 'not present'
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetChannelRequest{GetChannelRequest: uint32(index) + 1},
+		}, nil
+	}, func(r *meshtastic.AdminMessage) proto.Message { return r.GetGetChannelResponse() })
+}
+
+func (a *AdminCmd) SetOwner(cmd *cobra.Command, argz []string) {
+	a.set(argz, 3, func(args []string) (*meshtastic.AdminMessage, error) {
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_SetOwner{SetOwner: &meshtastic.User{
+				LongName:  args[1],
+				ShortName: args[2],
+			}},
+		}, nil
+	})
+}
+
+// SetPosition sets a fixed position from decimal degrees, eg. 43.6532 -79.3832 [altitude]
+func (a *AdminCmd) SetPosition(cmd *cobra.Command, argz []string) {
+	a.set(argz, 3, func(args []string) (*meshtastic.AdminMessage, error) {
+		lat, errLat := strconv.ParseFloat(args[1], 64)
+		lng, errLng := strconv.ParseFloat(args[2], 64)
+		if errLat != nil || errLng != nil {
+			return nil, fmt.Errorf("latitude/longitude must be decimal degrees")
+		}
+		latI := int32(lat * 1e7)
+		lngI := int32(lng * 1e7)
+		position := &meshtastic.Position{LatitudeI: &latI, LongitudeI: &lngI}
+		if len(args) > 3 {
+			alt, err := strconv.ParseInt(args[3], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid altitude '%s': %v", args[3], err)
+			}
+			alt32 := int32(alt)
+			position.Altitude = &alt32
+		}
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_SetFixedPosition{SetFixedPosition: position},
+		}, nil
+	})
+}
+
+// Reboot asks the node to reboot after a delay (default 5 seconds)
+func (a *AdminCmd) Reboot(cmd *cobra.Command, argz []string) {
+	a.set(argz, 1, func(args []string) (*meshtastic.AdminMessage, error) {
+		seconds := int64(5)
+		if len(args) > 1 {
+			var err error
+			seconds, err = strconv.ParseInt(args[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seconds '%s': %v", args[1], err)
+			}
+		}
+		return &meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_RebootSeconds{RebootSeconds: int32(seconds)},
+		}, nil
+	})
+}
+
+func (a *AdminCmd) get(argz []string, minArgs int, build func([]string) (*meshtastic.AdminMessage, error), pick func(*meshtastic.AdminMessage) proto.Message) {
+	session, ni, msg := a.start(argz, minArgs, build)
+	if session == nil {
+		return
+	}
+	defer ni.Close()
+
+	response, err := session.Get(msg)
+	if err != nil {
+		a.Config.Log.Errorf("admin request to !%08x failed: %v", session.Node, err)
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(a.Config.Stdout, "📡 !%08x responded:\n", session.Node)
+	fmt.Fprintln(a.Config.Stdout, prototext.MarshalOptions{Multiline: true, Indent: "  "}.Format(pick(response)))
+	a.CmdOutput.WasSuccess = true
+}
+
+func (a *AdminCmd) set(argz []string, minArgs int, build func([]string) (*meshtastic.AdminMessage, error)) {
+	session, ni, msg := a.start(argz, minArgs, build)
+	if session == nil {
+		return
+	}
+	defer ni.Close()
+
+	if err := session.Set(msg); err != nil {
+		a.Config.Log.Errorf("admin request to !%08x failed: %v", session.Node, err)
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(a.Config.Stdout, "✅ !%08x accepted the request\n", session.Node)
+	a.CmdOutput.WasSuccess = true
+}
+
+// start parses the target node, connects the virtual node and opens an admin session
+func (a *AdminCmd) start(argz []string, minArgs int, build func([]string) (*meshtastic.AdminMessage, error)) (*internal.AdminSession, *nodeinfo.NodeInfoCmd, *meshtastic.AdminMessage) {
+	a.Config.Log.Tracef("AdminCmd %v", argz)
+
+	if len(argz) < minArgs {
+		fmt.Fprintln(a.Config.Stdout, help.AdminHelp(a.Config))
+		return nil, nil, nil
+	}
+	node, err := internal.ParseNodeId(argz[0])
+	if err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return nil, nil, nil
+	}
+	msg, err := build(argz)
+	if err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return nil, nil, nil
+	}
+
+	ni := nodeinfo.NewNodeInfo(a.Config)
+	if err := ni.Listen(); err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return nil, nil, nil
+	}
+
+	timeout := time.Duration(a.Config.Admin.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	topic := ni.MqttClient.GatewayTopic(internal.PKIChannelId)
+	return ni.MqttClient.NewAdminSession(node, topic, timeout), ni, msg
+}
+
+// configName turns 'lora' into 'LORA_CONFIG'
+func configName(s string) string {
+	s = strings.ToUpper(s)
+	if !strings.HasSuffix(s, "_CONFIG") {
+		s += "_CONFIG"
+	}
+	return s
+}
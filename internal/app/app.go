@@ -75,6 +75,8 @@ func (a *App) MapEnvVars() {
 }
 
 func (a *App) ParseFlags() {
+	// Subcommand flags (eg. 'text send --to') are parsed again by Execute
+	a.RootCmd.FParseErrWhitelist.UnknownFlags = true
 	a.RootCmd.ParseFlags(os.Args)
 }
 
@@ -0,0 +1,190 @@
+package atak
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+// maxDatagram is the largest CoT event read off the network
+const maxDatagram = 65535
+
+// Bridge sends ATAK plugin packets heard on the mesh as CoT events, and publishes CoT chat and PLIs to the mesh
+type Bridge struct {
+	Config *config.Config
+	Node   *nodeinfo.NodeInfoCmd
+
+	send   *net.UDPConn
+	listen *net.UDPConn
+
+	mutex   sync.Mutex
+	relayed map[string]time.Time // uids we've sent as CoT, so they aren't sent back to the mesh
+	lastPli map[string]time.Time // when each ATAK user's PLI was last published
+}
+
+func NewBridge(c *config.Config, ni *nodeinfo.NodeInfoCmd) (*Bridge, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.Atak.SendAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SendAddress '%s': %v", c.Atak.SendAddress, err)
+	}
+	send, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", c.Atak.SendAddress, err)
+	}
+	return &Bridge{
+		Config:  c,
+		Node:    ni,
+		send:    send,
+		relayed: make(map[string]time.Time),
+		lastPli: make(map[string]time.Time),
+	}, nil
+}
+
+func (b *Bridge) stale() time.Duration {
+	if b.Config.Atak.StaleSec <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(b.Config.Atak.StaleSec) * time.Second
+}
+
+// PacketHandler sends PLIs and GeoChat from ATAK users on the mesh as CoT events
+func (b *Bridge) PacketHandler(p *internal.Packet) {
+	if p.PortNum != meshtastic.PortNum_ATAK_PLUGIN || p.From == b.Node.MqttClient.NodeNum() {
+		return
+	}
+	tak, err := internal.DecodeTAKPacket(p.Payload)
+	if err != nil {
+		b.Config.Log.Warnf("failed to decode TAKPacket from !%08x: %v", p.From, err)
+		return
+	}
+
+	var event *Event
+	switch {
+	case tak.GetPli() != nil:
+		event = PliEvent(p.From, tak, b.stale())
+	case tak.GetChat() != nil:
+		var latitude, longitude int32
+		b.Node.NodesMutex.Lock()
+		if n := b.Node.Nodes[p.From]; n != nil {
+			latitude, longitude = n.Latitude, n.Longitude
+		}
+		b.Node.NodesMutex.Unlock()
+		event = ChatEvent(p.From, tak, latitude, longitude, b.stale())
+	default:
+		return
+	}
+
+	b.mutex.Lock()
+	b.relayed[Uid(p.From, tak)] = time.Now()
+	b.mutex.Unlock()
+
+	if err := b.Send(event); err != nil {
+		b.Config.Log.Warnf("failed to send CoT for !%08x: %v", p.From, err)
+		return
+	}
+	b.Config.Log.Debugf("{'atak': 'cot', 'from': '!%08x', 'uid': '%s', 'type': '%s'}", p.From, event.Uid, event.Type)
+}
+
+func (b *Bridge) Send(e *Event) error {
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = b.send.Write(payload)
+	return err
+}
+
+// Listen reads CoT events from ListenAddress until Close, joining the group when it's multicast
+func (b *Bridge) Listen() error {
+	if b.Config.Atak.ListenAddress == "" {
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", b.Config.Atak.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("invalid ListenAddress '%s': %v", b.Config.Atak.ListenAddress, err)
+	}
+	if addr.IP.IsMulticast() {
+		b.listen, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		b.listen, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", b.Config.Atak.ListenAddress, err)
+	}
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := b.listen.ReadFromUDP(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				b.Config.Log.Warnf("failed to read CoT: %v", err)
+				continue
+			}
+			b.handleEvent(from, buf[:n])
+		}
+	}()
+	return nil
+}
+
+// handleEvent publishes a CoT chat or PLI from ATAK to the mesh
+func (b *Bridge) handleEvent(from *net.UDPAddr, datagram []byte) {
+	event, err := ParseEvent(datagram)
+	if err != nil {
+		b.Config.Log.Debugf("{'atak': 'ignored', 'from': '%s', 'error': '%v'}", from, err)
+		return
+	}
+	tak, err := event.TAKPacket()
+	if err != nil {
+		b.Config.Log.Tracef("{'atak': 'ignored', 'from': '%s', 'uid': '%s', 'error': '%v'}", from, event.Uid, err)
+		return
+	}
+
+	sender := event.Sender()
+	b.mutex.Lock()
+	now := time.Now()
+	for uid, at := range b.relayed {
+		if now.Sub(at) > b.stale() {
+			delete(b.relayed, uid)
+		}
+	}
+	if _, ok := b.relayed[sender]; ok {
+		// a mesh user we sent as CoT coming back around
+		b.mutex.Unlock()
+		return
+	}
+	if tak.GetPli() != nil {
+		interval := time.Duration(b.Config.Atak.PliIntervalSec) * time.Second
+		if last, ok := b.lastPli[sender]; ok && now.Sub(last) < interval {
+			b.mutex.Unlock()
+			return
+		}
+		b.lastPli[sender] = now
+	}
+	b.mutex.Unlock()
+
+	if err := b.Node.MqttClient.PublishTAKPacket(b.Config.Atak.ChannelSlot, tak); err != nil {
+		b.Config.Log.Warnf("failed to publish TAKPacket for '%s': %v", sender, err)
+		return
+	}
+	b.Config.Log.Debugf("{'atak': 'mesh', 'from': '%s', 'uid': '%s', 'type': '%s'}", from, sender, event.Type)
+	if chat := tak.GetChat(); chat != nil {
+		fmt.Fprintf(b.Config.Stdout, "💬 %s → mesh: %s\n", tak.GetContact().GetCallsign(), chat.GetMessage())
+	}
+}
+
+func (b *Bridge) Close() {
+	if b.listen != nil {
+		b.listen.Close()
+	}
+	b.send.Close()
+}
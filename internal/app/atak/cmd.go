@@ -0,0 +1,63 @@
+package atak
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type AtakCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewAtak(c *config.Config) (a *AtakCmd) {
+	a = new(AtakCmd)
+	a.Config = c
+
+	return a
+}
+
+func (a *AtakCmd) Help(cmd *cobra.Command, argz []string) {
+	a.CmdOutput.WasSuccess = true
+	fmt.Fprintln(a.Config.Stdout, help.AtakHelp(a.Config))
+}
+
+// Run connects the virtual node and bridges ATAK users between the mesh and CoT over UDP until killed
+func (a *AtakCmd) Run(cmd *cobra.Command, argz []string) {
+	s := help.Render("GlobalHeader", a.Config)
+	a.Config.Stdout.Write([]byte(s + "\n"))
+	a.Config.Log.Trace("AtakCmd.Run")
+
+	ni := nodeinfo.NewNodeInfo(a.Config)
+	bridge, err := NewBridge(a.Config, ni)
+	if err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	defer bridge.Close()
+	if err := bridge.Listen(); err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	if err := ni.Listen(bridge.PacketHandler); err != nil {
+		fmt.Fprintf(a.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	listening := a.Config.Atak.ListenAddress
+	if listening == "" {
+		listening = "nothing"
+	}
+	fmt.Fprintf(a.Config.Stdout, "🎯 Bridging ATAK users, sending CoT to %s and listening on %s ...\n", a.Config.Atak.SendAddress, listening)
+
+	ni.MqttClient.WaitUntilKill()
+	ni.Close()
+	a.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	a.CmdOutput.WasSuccess = true
+}
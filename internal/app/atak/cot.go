@@ -0,0 +1,297 @@
+package atak
+
+/* Cursor-on-Target (CoT) events are the XML ATAK sends and receives on the network:
+      https://www.mitre.org/sites/default/files/pdf/09_4937.pdf
+
+	A position report (PLI) is an 'a-f-G-U-C' atom (friendly ground unit) with the callsign, team and
+	battery in its detail. GeoChat is a 'b-t-f' event with the text in remarks, addressed to the
+	'All Chat Rooms' chatroom or to one contact's uid.
+*/
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+const (
+	TypePli      = "a-f-G-U-C"
+	TypeChat     = "b-t-f"
+	AllChatRooms = "All Chat Rooms"
+	unknownPoint = "9999999.0" // CoT's value for an unknown altitude or error
+	timeFormat   = "2006-01-02T15:04:05.000Z"
+)
+
+var ErrUnsupported = errors.New("unsupported CoT event")
+
+type Event struct {
+	XMLName xml.Name `xml:"event"`
+	Version string   `xml:"version,attr"`
+	Uid     string   `xml:"uid,attr"`
+	Type    string   `xml:"type,attr"`
+	How     string   `xml:"how,attr"`
+	Time    string   `xml:"time,attr"`
+	Start   string   `xml:"start,attr"`
+	Stale   string   `xml:"stale,attr"`
+	Point   Point    `xml:"point"`
+	Detail  Detail   `xml:"detail"`
+}
+
+// Point keeps its numbers as strings so they're written as decimals, not exponents
+type Point struct {
+	Lat string `xml:"lat,attr"`
+	Lon string `xml:"lon,attr"`
+	Hae string `xml:"hae,attr"`
+	Ce  string `xml:"ce,attr"`
+	Le  string `xml:"le,attr"`
+}
+
+type Detail struct {
+	Contact *Contact `xml:"contact,omitempty"`
+	Group   *Group   `xml:"__group,omitempty"`
+	Status  *Status  `xml:"status,omitempty"`
+	Track   *Track   `xml:"track,omitempty"`
+	Chat    *Chat    `xml:"__chat,omitempty"`
+	Link    *Link    `xml:"link,omitempty"`
+	Remarks *Remarks `xml:"remarks,omitempty"`
+}
+
+type Contact struct {
+	Callsign string `xml:"callsign,attr"`
+	Endpoint string `xml:"endpoint,attr,omitempty"`
+}
+
+type Group struct {
+	Name string `xml:"name,attr"`
+	Role string `xml:"role,attr"`
+}
+
+type Status struct {
+	Battery uint32 `xml:"battery,attr"`
+}
+
+type Track struct {
+	Speed  string `xml:"speed,attr"`
+	Course string `xml:"course,attr"`
+}
+
+type Chat struct {
+	Parent         string  `xml:"parent,attr,omitempty"`
+	GroupOwner     string  `xml:"groupOwner,attr,omitempty"`
+	MessageId      string  `xml:"messageId,attr,omitempty"`
+	Chatroom       string  `xml:"chatroom,attr"`
+	Id             string  `xml:"id,attr"`
+	SenderCallsign string  `xml:"senderCallsign,attr"`
+	ChatGrp        ChatGrp `xml:"chatgrp"`
+}
+
+type ChatGrp struct {
+	Uid0 string `xml:"uid0,attr"`
+	Uid1 string `xml:"uid1,attr"`
+	Id   string `xml:"id,attr"`
+}
+
+type Link struct {
+	Uid      string `xml:"uid,attr"`
+	Type     string `xml:"type,attr"`
+	Relation string `xml:"relation,attr"`
+}
+
+type Remarks struct {
+	Source string `xml:"source,attr,omitempty"`
+	To     string `xml:"to,attr,omitempty"`
+	Time   string `xml:"time,attr,omitempty"`
+	Text   string `xml:",chardata"`
+}
+
+func ParseEvent(b []byte) (*Event, error) {
+	e := new(Event)
+	if err := xml.Unmarshal(b, e); err != nil {
+		return nil, fmt.Errorf("failed to parse CoT event: %v", err)
+	}
+	return e, nil
+}
+
+func (e *Event) Marshal() ([]byte, error) {
+	b, err := xml.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// newEvent is an event heard now and stale after 'stale'
+func newEvent(uid, eventType string, stale time.Duration) *Event {
+	now := time.Now().UTC()
+	return &Event{
+		Version: "2.0",
+		Uid:     uid,
+		Type:    eventType,
+		How:     "m-g",
+		Time:    now.Format(timeFormat),
+		Start:   now.Format(timeFormat),
+		Stale:   now.Add(stale).Format(timeFormat),
+		Point:   Point{Lat: "0.0", Lon: "0.0", Hae: unknownPoint, Ce: unknownPoint, Le: unknownPoint},
+	}
+}
+
+func (e *Event) setPoint(latitudeI, longitudeI, altitude int32) {
+	e.Point.Lat = strconv.FormatFloat(float64(latitudeI)/1e7, 'f', 7, 64)
+	e.Point.Lon = strconv.FormatFloat(float64(longitudeI)/1e7, 'f', 7, 64)
+	if altitude != 0 {
+		e.Point.Hae = strconv.Itoa(int(altitude))
+	}
+}
+
+// Uid is the sender's ATAK device uid, or one made from the node number for senders without one
+func Uid(from uint32, tak *meshtastic.TAKPacket) string {
+	if uid := tak.GetContact().GetDeviceCallsign(); uid != "" {
+		return uid
+	}
+	return fmt.Sprintf("meshtastic-!%08x", from)
+}
+
+// PliEvent is a position report for a TAKPacket with a PLI
+func PliEvent(from uint32, tak *meshtastic.TAKPacket, stale time.Duration) *Event {
+	e := newEvent(Uid(from, tak), TypePli, stale)
+	pli := tak.GetPli()
+	e.setPoint(pli.GetLatitudeI(), pli.GetLongitudeI(), pli.GetAltitude())
+	e.Detail.Contact = &Contact{Callsign: tak.GetContact().GetCallsign(), Endpoint: "0.0.0.0:4242:tcp"}
+	if group := tak.GetGroup(); group != nil {
+		e.Detail.Group = &Group{Name: teamName(group.GetTeam()), Role: roleName(group.GetRole())}
+	}
+	if status := tak.GetStatus(); status != nil {
+		e.Detail.Status = &Status{Battery: status.GetBattery()}
+	}
+	e.Detail.Track = &Track{Speed: strconv.Itoa(int(pli.GetSpeed())), Course: strconv.Itoa(int(pli.GetCourse()))}
+	return e
+}
+
+// ChatEvent is a GeoChat message for a TAKPacket with a chat, placed at the sender's last position
+func ChatEvent(from uint32, tak *meshtastic.TAKPacket, latitudeI, longitudeI int32, stale time.Duration) *Event {
+	sender := Uid(from, tak)
+	callsign := tak.GetContact().GetCallsign()
+	chat := tak.GetChat()
+	chatroom, id := AllChatRooms, AllChatRooms
+	if to := chat.GetTo(); to != "" && to != AllChatRooms {
+		chatroom, id = chat.GetToCallsign(), to
+		if chatroom == "" {
+			chatroom = to
+		}
+	}
+	messageId := fmt.Sprintf("%x", time.Now().UnixNano())
+
+	e := newEvent(fmt.Sprintf("GeoChat.%s.%s.%s", sender, id, messageId), TypeChat, stale)
+	e.How = "h-g-i-g-o"
+	e.setPoint(latitudeI, longitudeI, 0)
+	e.Detail.Chat = &Chat{
+		Parent:         "RootContactGroup",
+		GroupOwner:     "false",
+		MessageId:      messageId,
+		Chatroom:       chatroom,
+		Id:             id,
+		SenderCallsign: callsign,
+		ChatGrp:        ChatGrp{Uid0: sender, Uid1: id, Id: id},
+	}
+	e.Detail.Link = &Link{Uid: sender, Type: TypePli, Relation: "p-p"}
+	e.Detail.Remarks = &Remarks{Source: "BAO.F.ATAK." + sender, To: id, Time: e.Time, Text: chat.GetMessage()}
+	return e
+}
+
+// Sender is the uid of the ATAK user behind the event, for chat that's the author not the message
+func (e *Event) Sender() string {
+	if e.Type == TypeChat {
+		if e.Detail.Link != nil && e.Detail.Link.Uid != "" {
+			return e.Detail.Link.Uid
+		}
+		if e.Detail.Chat != nil {
+			return e.Detail.Chat.ChatGrp.Uid0
+		}
+	}
+	return e.Uid
+}
+
+// IsPli is a position report from an ATAK user, any atom with a callsign
+func (e *Event) IsPli() bool {
+	return strings.HasPrefix(e.Type, "a-") && e.Detail.Contact != nil && e.Detail.Contact.Callsign != ""
+}
+
+// TAKPacket turns a PLI or GeoChat event into the packet the ATAK plugin would send
+func (e *Event) TAKPacket() (*meshtastic.TAKPacket, error) {
+	tak := &meshtastic.TAKPacket{Contact: &meshtastic.Contact{DeviceCallsign: e.Sender()}}
+	if e.Detail.Contact != nil {
+		tak.Contact.Callsign = e.Detail.Contact.Callsign
+	}
+	if group := e.Detail.Group; group != nil {
+		tak.Group = &meshtastic.Group{Team: teamValue(group.Name), Role: roleValue(group.Role)}
+	}
+	if status := e.Detail.Status; status != nil {
+		tak.Status = &meshtastic.Status{Battery: status.Battery}
+	}
+
+	switch {
+	case e.Type == TypeChat && e.Detail.Remarks != nil:
+		chat := &meshtastic.GeoChat{Message: strings.TrimSpace(e.Detail.Remarks.Text)}
+		if e.Detail.Chat != nil {
+			tak.Contact.Callsign = e.Detail.Chat.SenderCallsign
+			if to := e.Detail.Chat.Id; to != "" && to != AllChatRooms {
+				toCallsign := e.Detail.Chat.Chatroom
+				chat.To, chat.ToCallsign = &to, &toCallsign
+			}
+		}
+		tak.PayloadVariant = &meshtastic.TAKPacket_Chat{Chat: chat}
+	case e.IsPli():
+		latitude, errLat := strconv.ParseFloat(e.Point.Lat, 64)
+		longitude, errLng := strconv.ParseFloat(e.Point.Lon, 64)
+		if errLat != nil || errLng != nil {
+			return nil, fmt.Errorf("%w: invalid point %s,%s", ErrUnsupported, e.Point.Lat, e.Point.Lon)
+		}
+		pli := &meshtastic.PLI{LatitudeI: int32(latitude * 1e7), LongitudeI: int32(longitude * 1e7)}
+		if hae, err := strconv.ParseFloat(e.Point.Hae, 64); err == nil && e.Point.Hae != unknownPoint {
+			pli.Altitude = int32(hae)
+		}
+		if track := e.Detail.Track; track != nil {
+			speed, _ := strconv.ParseFloat(track.Speed, 64)
+			course, _ := strconv.ParseFloat(track.Course, 64)
+			pli.Speed, pli.Course = uint32(max(speed, 0)), uint32(max(course, 0))
+		}
+		tak.PayloadVariant = &meshtastic.TAKPacket_Pli{Pli: pli}
+	default:
+		return nil, fmt.Errorf("%w: type '%s'", ErrUnsupported, e.Type)
+	}
+	return tak, nil
+}
+
+// teamName is the ATAK team colour, eg. Team_Dark_Blue is 'Dark Blue'
+func teamName(team meshtastic.Team) string {
+	if team == meshtastic.Team_Unspecifed_Color {
+		return "Cyan"
+	}
+	return strings.ReplaceAll(team.String(), "_", " ")
+}
+
+func teamValue(name string) meshtastic.Team {
+	return meshtastic.Team(meshtastic.Team_value[strings.ReplaceAll(name, " ", "_")])
+}
+
+// roleName is the ATAK role, eg. MemberRole_TeamMember is 'Team Member'
+func roleName(role meshtastic.MemberRole) string {
+	switch role {
+	case meshtastic.MemberRole_Unspecifed, meshtastic.MemberRole_TeamMember:
+		return "Team Member"
+	case meshtastic.MemberRole_TeamLead:
+		return "Team Lead"
+	case meshtastic.MemberRole_ForwardObserver:
+		return "Forward Observer"
+	}
+	return role.String()
+}
+
+func roleValue(name string) meshtastic.MemberRole {
+	return meshtastic.MemberRole(meshtastic.MemberRole_value[strings.ReplaceAll(name, " ", "")])
+}
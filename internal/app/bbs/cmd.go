@@ -0,0 +1,55 @@
+package bbs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type BbsCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewBbsCmd(c *config.Config) (b *BbsCmd) {
+	b = new(BbsCmd)
+	b.Config = c
+
+	return b
+}
+
+func (b *BbsCmd) Help(cmd *cobra.Command, argz []string) {
+	b.CmdOutput.WasSuccess = true
+	fmt.Fprintln(b.Config.Stdout, help.BbsHelp(b.Config))
+}
+
+// Run connects the virtual node and answers direct messages with the BBS menus until killed
+func (b *BbsCmd) Run(cmd *cobra.Command, argz []string) {
+	s := help.Render("GlobalHeader", b.Config)
+	b.Config.Stdout.Write([]byte(s + "\n"))
+	b.Config.Log.Trace("BbsCmd.Run")
+
+	ni := nodeinfo.NewNodeInfo(b.Config)
+	board := NewBbs(b.Config, ni)
+	if err := board.Store.LoadFile(b.Config.Bbs.DbPath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(b.Config.Stdout, "❌ failed to read %s: %v\n", b.Config.Bbs.DbPath, err)
+		return
+	}
+
+	if err := ni.Listen(board.PacketHandler); err != nil {
+		fmt.Fprintf(b.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	fmt.Fprintf(b.Config.Stdout, "📟 %s is open with %d mail and %d bulletins, DM !%08x to use it ...\n", b.Config.Bbs.Name, len(board.Store.Mail), len(board.Store.Bulletins), ni.MqttClient.NodeNum())
+
+	ni.MqttClient.WaitUntilKill()
+	ni.Close()
+	b.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	b.CmdOutput.WasSuccess = true
+}
@@ -0,0 +1,503 @@
+package bbs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+// listLimit keeps menus to a few LoRa frames
+const listLimit = 10
+
+// state is where a node is in the menus, it decides what their next message means
+type state int
+
+const (
+	stateMain state = iota
+	stateMail
+	stateMailRead
+	stateMailTo
+	stateMailSubject
+	stateMailBody
+	stateMailDelete
+	stateBoards
+	stateBoard
+	stateBoardRead
+	statePostSubject
+	statePostBody
+	stateDirectory
+)
+
+// typing is true when the next message is text to keep rather than a menu choice
+func (st state) typing() bool {
+	switch st {
+	case stateMailTo, stateMailSubject, stateMailBody, statePostSubject, statePostBody, stateDirectory:
+		return true
+	}
+	return false
+}
+
+// session is one node's trip through the menus, with the mail or bulletin being written
+type session struct {
+	state   state
+	board   string
+	to      uint32
+	subject string
+	updated time.Time
+}
+
+// Bbs answers direct messages with menus for mail, bulletins and the node directory
+type Bbs struct {
+	Config *config.Config
+	Node   *nodeinfo.NodeInfoCmd
+	Store  *Store
+
+	mutex    sync.Mutex // sessions and Store
+	sessions map[uint32]*session
+}
+
+func NewBbs(c *config.Config, ni *nodeinfo.NodeInfoCmd) *Bbs {
+	return &Bbs{
+		Config:   c,
+		Node:     ni,
+		Store:    new(Store),
+		sessions: make(map[uint32]*session),
+	}
+}
+
+// PacketHandler delivers held mail when a recipient is heard and answers direct messages
+func (b *Bbs) PacketHandler(p *internal.Packet) {
+	b.DeliverMail(p.From)
+	if p.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP || p.To != b.Node.MqttClient.NodeNum() || p.Emoji != 0 {
+		return
+	}
+	reply := b.Input(p.From, string(p.Payload))
+	slot := b.Config.Bbs.ChannelSlot
+	if p.Channel != nil {
+		slot = p.Channel.Slot
+	}
+	b.send(p.From, slot, reply)
+}
+
+// Input moves a node through the menus with the text they sent, returning the reply
+func (b *Bbs) Input(node uint32, text string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	text = strings.TrimSpace(text)
+	s := b.sessions[node]
+	if s == nil || time.Since(s.updated) > time.Duration(b.Config.Bbs.SessionMin)*time.Minute {
+		s = &session{state: stateMain}
+		b.sessions[node] = s
+	}
+	s.updated = time.Now()
+
+	key := strings.ToUpper(text)
+	if (key == "H" || key == "?") && !s.state.typing() {
+		return b.menu(node, s)
+	}
+	switch s.state {
+	case stateMain:
+		switch key {
+		case "M":
+			s.state = stateMail
+		case "B":
+			s.state = stateBoards
+		case "D":
+			s.state = stateDirectory
+			return b.directory("")
+		case "X":
+			delete(b.sessions, node)
+			return "👋 73! Message me again to come back"
+		}
+		return b.menu(node, s)
+
+	case stateMail:
+		switch key {
+		case "R":
+			if len(b.Store.Mailbox(node)) == 0 {
+				return "📭 No mail\n" + b.menu(node, s)
+			}
+			s.state = stateMailRead
+		case "S":
+			s.state = stateMailTo
+		case "D":
+			s.state = stateMailDelete
+		case "X":
+			s.state = stateMain
+		}
+		return b.menu(node, s)
+
+	case stateMailRead:
+		if key == "X" {
+			s.state = stateMail
+			return b.menu(node, s)
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(text, "#"))
+		for _, m := range b.Store.Mailbox(node) {
+			if m.Id == id {
+				if b.Node.MqttClient.CanPKI(node) != nil {
+					return "🔑 Mail is only sent encrypted, we don't have your public key yet. Send your node info and try again\n\nMail # or [X]back"
+				}
+				m.Read = true
+				b.save()
+				return fmt.Sprintf("✉️ #%d from %s %s ago\n%s\n%s\n\nMail # or [X]back", m.Id, b.name(m.From), ago(m.Sent), m.Subject, m.Body)
+			}
+		}
+		return b.menu(node, s)
+
+	case stateMailTo:
+		if key == "X" {
+			s.state = stateMail
+			return b.menu(node, s)
+		}
+		to, err := b.resolve(text)
+		if err != nil {
+			return fmt.Sprintf("❓ %v\nTo? !nodeid or name, [X]back", err)
+		}
+		s.to, s.state = to, stateMailSubject
+		return fmt.Sprintf("To %s. Subject? [X]back", b.name(to))
+
+	case stateMailSubject:
+		if key == "X" {
+			s.state = stateMail
+			return b.menu(node, s)
+		}
+		s.subject, s.state = text, stateMailBody
+		return "Message?"
+
+	case stateMailBody:
+		m := b.Store.SendMail(node, s.to, s.subject, text)
+		b.save()
+		s.state = stateMail
+		return fmt.Sprintf("✅ Mail #%d for %s is held until they're heard, and only sent encrypted\n%s", m.Id, b.name(m.To), b.menu(node, s))
+
+	case stateMailDelete:
+		if key != "X" {
+			id, _ := strconv.Atoi(strings.TrimPrefix(text, "#"))
+			if !b.Store.DeleteMail(node, id) {
+				return fmt.Sprintf("❓ No mail #%s\nMail # to delete, [X]back", strings.TrimPrefix(text, "#"))
+			}
+			b.save()
+			s.state = stateMail
+			return fmt.Sprintf("🗑️ Deleted #%d\n%s", id, b.menu(node, s))
+		}
+		s.state = stateMail
+		return b.menu(node, s)
+
+	case stateBoards:
+		if key == "X" {
+			s.state = stateMain
+			return b.menu(node, s)
+		}
+		i, err := strconv.Atoi(text)
+		if err != nil || i < 1 || i > len(b.Config.Bbs.Boards) {
+			return b.menu(node, s)
+		}
+		s.board, s.state = b.Config.Bbs.Boards[i-1], stateBoard
+		return b.menu(node, s)
+
+	case stateBoard:
+		switch key {
+		case "R":
+			if len(b.Store.Board(s.board)) == 0 {
+				return fmt.Sprintf("📭 Nothing on %s yet\n%s", s.board, b.menu(node, s))
+			}
+			s.state = stateBoardRead
+		case "P":
+			s.state = statePostSubject
+		case "X":
+			s.state = stateBoards
+		}
+		return b.menu(node, s)
+
+	case stateBoardRead:
+		if key == "X" {
+			s.state = stateBoard
+			return b.menu(node, s)
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(text, "#"))
+		for _, post := range b.Store.Board(s.board) {
+			if post.Id == id {
+				return fmt.Sprintf("📌 #%d from %s %s ago\n%s\n%s\n\nBulletin # or [X]back", post.Id, b.name(post.From), ago(post.Posted), post.Subject, post.Body)
+			}
+		}
+		return b.menu(node, s)
+
+	case statePostSubject:
+		if key == "X" {
+			s.state = stateBoard
+			return b.menu(node, s)
+		}
+		s.subject, s.state = text, statePostBody
+		return "Message?"
+
+	case statePostBody:
+		post := b.Store.Post(s.board, node, s.subject, text, b.Config.Bbs.BoardLimit)
+		b.save()
+		s.state = stateBoard
+		return fmt.Sprintf("✅ Posted #%d to %s\n%s", post.Id, s.board, b.menu(node, s))
+
+	case stateDirectory:
+		if key == "X" {
+			s.state = stateMain
+			return b.menu(node, s)
+		}
+		return b.directory(text)
+	}
+	return b.mainMenu(node)
+}
+
+// menu is the prompt for where the session is
+func (b *Bbs) menu(node uint32, s *session) string {
+	switch s.state {
+	case stateMail:
+		mailbox := b.Store.Mailbox(node)
+		return fmt.Sprintf("✉️ Mail: %d (%d new)\n[R]ead [S]end [D]elete [X]back", len(mailbox), unread(mailbox))
+	case stateMailRead:
+		var lines []string
+		for i, m := range b.Store.Mailbox(node) {
+			if i == listLimit {
+				break
+			}
+			flag := ""
+			if !m.Read {
+				flag = "*"
+			}
+			lines = append(lines, fmt.Sprintf("#%d%s %s %s %s", m.Id, flag, b.name(m.From), ago(m.Sent), m.Subject))
+		}
+		return strings.Join(lines, "\n") + "\nMail # to read, [X]back"
+	case stateMailTo:
+		return "To? !nodeid or name, [X]back"
+	case stateMailSubject:
+		return "Subject? [X]back"
+	case stateMailBody, statePostBody:
+		return "Message?"
+	case stateMailDelete:
+		return "Mail # to delete, [X]back"
+	case stateBoards:
+		lines := []string{"📋 Boards"}
+		for i, board := range b.Config.Bbs.Boards {
+			lines = append(lines, fmt.Sprintf("%d %s (%d)", i+1, board, len(b.Store.Board(board))))
+		}
+		return strings.Join(lines, "\n") + "\nBoard # or [X]back"
+	case stateBoard:
+		return fmt.Sprintf("📋 %s: %d\n[R]ead [P]ost [X]back", s.board, len(b.Store.Board(s.board)))
+	case stateBoardRead:
+		var lines []string
+		for i, post := range b.Store.Board(s.board) {
+			if i == listLimit {
+				break
+			}
+			lines = append(lines, fmt.Sprintf("#%d %s %s %s", post.Id, b.name(post.From), ago(post.Posted), post.Subject))
+		}
+		return strings.Join(lines, "\n") + "\nBulletin # to read, [X]back"
+	case statePostSubject:
+		return fmt.Sprintf("Posting to %s. Subject? [X]back", s.board)
+	case stateDirectory:
+		return "Name to search, [X]back"
+	}
+	return b.mainMenu(node)
+}
+
+func (b *Bbs) mainMenu(node uint32) string {
+	mail := ""
+	if n := unread(b.Store.Mailbox(node)); n > 0 {
+		mail = fmt.Sprintf(" (%d new)", n)
+	}
+	return fmt.Sprintf("🏠 %s\n[M]ail%s\n[B]ulletins\n[D]irectory\ne[X]it", b.Config.Bbs.Name, mail)
+}
+
+func unread(mailbox []*Mail) int {
+	n := 0
+	for _, m := range mailbox {
+		if !m.Read {
+			n++
+		}
+	}
+	return n
+}
+
+// directory lists nodes heard within Bbs.DirectoryHours, latest first, optionally matching a search
+func (b *Bbs) directory(search string) string {
+	since := time.Now().Add(-time.Duration(b.Config.Bbs.DirectoryHours) * time.Hour).Unix()
+	search = strings.ToLower(search)
+
+	type entry struct {
+		num  uint32
+		node *internal.Node
+		seen int64
+	}
+	var entries []entry
+	b.Node.NodesMutex.Lock()
+	for num, node := range b.Node.Nodes {
+		seen := lastSeen(node)
+		if seen < since {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(fmt.Sprintf("!%08x %s %s", num, node.ShortName, node.LongName)), search) {
+			continue
+		}
+		entries = append(entries, entry{num, node, seen})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seen > entries[j].seen })
+	lines := []string{fmt.Sprintf("📇 %d nodes in %dh", len(entries), b.Config.Bbs.DirectoryHours)}
+	if search != "" {
+		lines[0] = fmt.Sprintf("📇 %d matching '%s'", len(entries), search)
+	}
+	for i, e := range entries {
+		if i == listLimit {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s !%08x %s %s", e.node.ShortName, e.num, ago(e.seen), e.node.LongName))
+	}
+	b.Node.NodesMutex.Unlock()
+	return strings.Join(lines, "\n") + "\nName to search, [X]back"
+}
+
+// resolve finds a mail recipient from a node id, or a short or long name in the NodeDB
+func (b *Bbs) resolve(text string) (uint32, error) {
+	if strings.HasPrefix(text, "!") || strings.HasPrefix(text, "0x") {
+		return internal.ParseNodeId(text)
+	}
+	b.Node.NodesMutex.Lock()
+	defer b.Node.NodesMutex.Unlock()
+	var matches []uint32
+	for num, node := range b.Node.Nodes {
+		if strings.EqualFold(node.ShortName, text) || strings.EqualFold(node.LongName, text) {
+			matches = append(matches, num)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no node named '%s'", text)
+	case 1:
+		return matches[0], nil
+	}
+	return 0, fmt.Errorf("%d nodes named '%s', use the !nodeid", len(matches), text)
+}
+
+// waitingForKey is the status of mail held because the recipient can't be sent PKI yet
+const waitingForKey = "waiting for key"
+
+// DeliverMail sends a node the mail held for it, at most every Bbs.MailRetryMin. Mail only goes
+// PKI encrypted, until we have the node's public key it stays held as 'waiting for key'.
+func (b *Bbs) DeliverMail(node uint32) {
+	b.mutex.Lock()
+	held := b.Store.Undelivered(node, time.Duration(b.Config.Bbs.MailRetryMin)*time.Minute)
+	if len(held) > 0 {
+		if err := b.Node.MqttClient.CanPKI(node); err != nil {
+			for _, m := range held {
+				if m.Waiting != waitingForKey {
+					m.Waiting = waitingForKey
+					fmt.Fprintf(b.Config.Stdout, "🔑 Mail #%d for %s is waiting for their public key\n", m.Id, b.name(m.To))
+				}
+			}
+			b.save()
+			b.mutex.Unlock()
+			b.Config.Log.Debugf(`{'bbs': 'held', 'to': '!%08x', 'mail': %d, 'reason': '%v'}`, node, len(held), err)
+			return
+		}
+	}
+	for _, m := range held {
+		m.Attempted = time.Now().Unix()
+		m.Waiting = ""
+	}
+	if len(held) > 0 {
+		b.save()
+	}
+	b.mutex.Unlock()
+	if len(held) == 0 {
+		return
+	}
+
+	go func() {
+		for _, m := range held {
+			text := fmt.Sprintf("✉️ Mail #%d from %s\n%s\n%s", m.Id, b.name(m.From), m.Subject, m.Body)
+			if !b.sendPrivate(m.To, text) {
+				continue
+			}
+			b.mutex.Lock()
+			m.Delivered = time.Now().Unix()
+			m.Read = true
+			b.save()
+			b.mutex.Unlock()
+			fmt.Fprintf(b.Config.Stdout, "📬 Delivered mail #%d to %s\n", m.Id, b.name(m.To))
+		}
+	}()
+}
+
+// send direct messages a node, returning true when every part was acknowledged
+func (b *Bbs) send(to uint32, slot string, text string) bool {
+	topic := b.Config.NodeInfo.Topic
+	deliveries, err := b.Node.MqttClient.SendText(topic, slot, to, text)
+	return b.delivered(to, topic, deliveries, err)
+}
+
+// sendPrivate is send for mail, only ever PKI encrypted
+func (b *Bbs) sendPrivate(to uint32, text string) bool {
+	topic := b.Config.NodeInfo.Topic
+	deliveries, err := b.Node.MqttClient.SendTextPKI(topic, to, text)
+	return b.delivered(to, topic, deliveries, err)
+}
+
+func (b *Bbs) delivered(to uint32, topic string, deliveries []*internal.Delivery, err error) bool {
+	delivered := err == nil
+	for _, delivery := range deliveries {
+		b.Node.AddSentLedger(delivery, topic)
+		if delivery.State != internal.DeliveryDelivered {
+			delivered = false
+			b.Config.Log.Warnf(`{'bbs': 'send', 'to': '!%08x', 'packetId': %d, 'delivery': '%s', 'attempts': %d}`, to, delivery.PacketId, delivery, delivery.Attempts)
+		}
+	}
+	if err != nil {
+		b.Config.Log.Errorf("failed to message !%08x: %v", to, err)
+	}
+	return delivered
+}
+
+// save writes the store, the caller holds the mutex
+func (b *Bbs) save() {
+	if err := b.Store.WriteFile(b.Config.Bbs.DbPath); err != nil {
+		b.Config.Log.Errorf("failed to write the BBS store: %v", err)
+	}
+}
+
+func (b *Bbs) name(num uint32) string {
+	b.Node.NodesMutex.Lock()
+	defer b.Node.NodesMutex.Unlock()
+	if node := b.Node.Nodes[num]; node != nil && node.ShortName != "" {
+		return node.ShortName
+	}
+	return fmt.Sprintf("!%08x", num)
+}
+
+func lastSeen(node *internal.Node) int64 {
+	var last int64
+	for _, at := range node.SeenBy {
+		last = max(last, at)
+	}
+	return last
+}
+
+// ago is a short age like '12m' or '3h' for a unix time
+func ago(unix int64) string {
+	age := time.Since(time.Unix(unix, 0))
+	switch {
+	case age < time.Minute:
+		return "<1m"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
@@ -0,0 +1,93 @@
+package bbs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+)
+
+const testRecipient = 0x12345678
+
+func newTestBbs(t *testing.T) (*Bbs, *mqtttest.Recorder) {
+	t.Chdir(t.TempDir()) // the ledger is written to the working directory
+
+	c := mqtttest.Config()
+	c.NodeInfo.PKI.PrivateKey = "0xa00330633e63522f8a4d81ec6d9d1e6617f6c8ffd3a4c698229537d44e522277"
+	c.Bbs.ChannelSlot = "primary"
+	c.Bbs.SessionMin = 15
+	c.Bbs.DbPath = filepath.Join(t.TempDir(), "bbs.json")
+
+	ni := nodeinfo.NewNodeInfo(c)
+	ni.Nodes[testRecipient] = internal.NewNode("msh/US/2/e/LongFast/!87654321")
+	ni.MqttClient = internal.NewMqttClient(c, &ni.Nodes)
+	rec := new(mqtttest.Recorder)
+	ni.MqttClient.SetClient(rec)
+
+	b := NewBbs(c, ni)
+	b.Store.SendMail(mqtttest.Node, testRecipient, "gate code", "4321")
+	return b, rec
+}
+
+func TestMailWaitsForKey(t *testing.T) {
+	b, rec := newTestBbs(t)
+
+	b.DeliverMail(testRecipient)
+
+	if rec.Count() != 0 {
+		t.Fatalf("published %d packets for a node without a public key, want the mail held", rec.Count())
+	}
+	if m := b.Store.Mail[0]; m.Waiting != waitingForKey || m.Attempted != 0 {
+		t.Errorf("mail waiting %q attempted %d, want '%s' and not attempted", m.Waiting, m.Attempted, waitingForKey)
+	}
+	if reply := b.Input(testRecipient, "M"); reply == "" {
+		t.Fatal("no mail menu")
+	}
+	b.Input(testRecipient, "R")
+	if reply := b.Input(testRecipient, "1"); !strings.HasPrefix(reply, "🔑") {
+		t.Errorf("mail read without a public key: %q", reply)
+	}
+}
+
+func TestMailIsOnlySentPKI(t *testing.T) {
+	b, rec := newTestBbs(t)
+	recipientKey, _ := internal.ParseKey("0xdb18fc50eea47f00251cb784819a3cf5fc361882597f589f0d7ff820e8064457")
+	b.Node.Nodes[testRecipient].PubKey = internal.FormatKey(recipientKey)
+
+	b.DeliverMail(testRecipient)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.Count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	envelopes := rec.Envelopes()
+	if len(envelopes) == 0 {
+		t.Fatal("mail not sent")
+	}
+	for _, envelope := range envelopes {
+		if envelope.GetChannelId() != internal.PKIChannelId || envelope.GetPacket().GetTo() != testRecipient {
+			t.Errorf("mail sent on %s to !%08x, want PKI to the recipient", envelope.GetChannelId(), envelope.GetPacket().GetTo())
+		}
+	}
+}
+
+func TestStoreIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bbs.json")
+	store := new(Store)
+	store.SendMail(1, 2, "subject", "body")
+	if err := store.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("store written %v, want 0600", mode)
+	}
+}
@@ -0,0 +1,146 @@
+package bbs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Mail is a private message, held until the recipient is next heard
+type Mail struct {
+	Id        int    `json:"id"`
+	From      uint32 `json:"from"`
+	To        uint32 `json:"to"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	Sent      int64  `json:"sent"`
+	Delivered int64  `json:"delivered,omitempty"`
+	Attempted int64  `json:"attempted,omitempty"` // last time we tried to deliver it
+	Waiting   string `json:"waiting,omitempty"`   // why it's still held, eg. 'waiting for key'
+	Read      bool   `json:"read,omitempty"`
+}
+
+// Bulletin is a public post on a board
+type Bulletin struct {
+	Id      int    `json:"id"`
+	Board   string `json:"board"`
+	From    uint32 `json:"from"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Posted  int64  `json:"posted"`
+}
+
+// Store is everything the BBS keeps between runs
+type Store struct {
+	NextId    int         `json:"nextId"`
+	Mail      []*Mail     `json:"mail"`
+	Bulletins []*Bulletin `json:"bulletins"`
+}
+
+func (s *Store) id() int {
+	s.NextId++
+	return s.NextId
+}
+
+// SendMail holds a new mail for 'to'
+func (s *Store) SendMail(from, to uint32, subject, body string) *Mail {
+	m := &Mail{Id: s.id(), From: from, To: to, Subject: subject, Body: body, Sent: time.Now().Unix()}
+	s.Mail = append(s.Mail, m)
+	return m
+}
+
+// Mailbox is the mail sent to a node, newest first
+func (s *Store) Mailbox(node uint32) []*Mail {
+	var mailbox []*Mail
+	for _, m := range s.Mail {
+		if m.To == node {
+			mailbox = append(mailbox, m)
+		}
+	}
+	slices.Reverse(mailbox)
+	return mailbox
+}
+
+// Undelivered is the mail held for a node that hasn't been tried since 'retry' ago
+func (s *Store) Undelivered(node uint32, retry time.Duration) []*Mail {
+	var held []*Mail
+	for _, m := range s.Mail {
+		if m.To == node && m.Delivered == 0 && time.Since(time.Unix(m.Attempted, 0)) >= retry {
+			held = append(held, m)
+		}
+	}
+	return held
+}
+
+// DeleteMail removes a mail from the node's mailbox
+func (s *Store) DeleteMail(node uint32, id int) bool {
+	for i, m := range s.Mail {
+		if m.Id == id && m.To == node {
+			s.Mail = slices.Delete(s.Mail, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// Post adds a bulletin to a board, dropping the board's oldest beyond 'limit'
+func (s *Store) Post(board string, from uint32, subject, body string, limit int) *Bulletin {
+	b := &Bulletin{Id: s.id(), Board: board, From: from, Subject: subject, Body: body, Posted: time.Now().Unix()}
+	s.Bulletins = append(s.Bulletins, b)
+	if posts := s.Board(board); limit > 0 && len(posts) > limit {
+		for _, old := range posts[limit:] {
+			s.Bulletins = slices.DeleteFunc(s.Bulletins, func(b *Bulletin) bool { return b == old })
+		}
+	}
+	return b
+}
+
+// Board is a board's bulletins, newest first
+func (s *Store) Board(board string) []*Bulletin {
+	var posts []*Bulletin
+	for _, b := range s.Bulletins {
+		if strings.EqualFold(b.Board, board) {
+			posts = append(posts, b)
+		}
+	}
+	slices.Reverse(posts)
+	return posts
+}
+
+func (s *Store) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(s)
+}
+
+// WriteFile replaces the file through a temporary file, like NodeDB, so a crash can't leave half a store.
+// It holds private mail, so only we can read it.
+func (s *Store) WriteFile(path string) error {
+	dir, file := filepath.Split(path)
+	f, err := os.CreateTemp(dir, file)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(s)
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600) // private mail
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
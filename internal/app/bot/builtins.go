@@ -0,0 +1,216 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+)
+
+// NodesWindow is how recently a node must be heard to count as active for 'nodes'
+const NodesWindow = time.Hour
+
+// RegisterBuiltins adds the ping, help, whoami, nodes and weather commands
+func (r *Router) RegisterBuiltins() {
+	r.Register(Command{Name: "ping", Public: true, Help: "replies pong with the hops your message took", Handler: r.ping})
+	r.Register(Command{Name: "help", Usage: "[command]", Public: true, Help: "lists commands, or shows help for one", Handler: r.help})
+	r.Register(Command{Name: "whoami", Public: true, Help: "shows what the mesh knows about your node", Handler: r.whoami})
+	r.Register(Command{Name: "nodes", Public: true, Help: "counts nodes heard in the last hour", Handler: r.nodes})
+	r.Register(Command{Name: "weather", Usage: "[!nodeid|name]", Public: true, Help: "latest environment telemetry from a node, yours or the freshest", Handler: r.weather})
+}
+
+func (r *Router) ping(req *Request) string {
+	if hops, ok := hopsAway(req.Packet); ok {
+		return fmt.Sprintf("🏓 pong (%d %s via %s)", hops, plural(hops, "hop"), req.Packet.GatewayId)
+	}
+	return "🏓 pong"
+}
+
+func (r *Router) help(req *Request) string {
+	prefix := r.Config.Bot.Prefix
+	if len(req.Args) > 0 {
+		command := r.command(strings.TrimPrefix(req.Args[0], prefix))
+		if command == nil {
+			return fmt.Sprintf("❓ no command '%s', try %shelp", req.Args[0], prefix)
+		}
+		usage := strings.TrimSpace(fmt.Sprintf("%s%s %s", prefix, command.Name, command.Usage))
+		if command.Scope != ScopeAny {
+			return fmt.Sprintf("%s - %s (%s only)", usage, command.Help, command.Scope)
+		}
+		return fmt.Sprintf("%s - %s", usage, command.Help)
+	}
+
+	var names []string
+	for _, command := range r.Commands(req.DM) {
+		names = append(names, prefix+command.Name)
+	}
+	return fmt.Sprintf("🤖 %s | %shelp <command> for more", strings.Join(names, " "), prefix)
+}
+
+func (r *Router) whoami(req *Request) string {
+	p := req.Packet
+	details := []string{fmt.Sprintf("!%08x", p.From)}
+
+	r.NodeInfo.NodesMutex.Lock()
+	if node := r.NodeInfo.Nodes[p.From]; node != nil {
+		if node.LongName != "" {
+			details = append(details, fmt.Sprintf("%s (%s)", node.LongName, node.ShortName))
+		}
+		if node.HwModel != "" {
+			details = append(details, node.HwModel)
+		}
+		if node.PubKey != "" {
+			details = append(details, "🔐 PKI")
+		}
+	}
+	r.NodeInfo.NodesMutex.Unlock()
+
+	if hops, ok := hopsAway(p); ok {
+		details = append(details, fmt.Sprintf("%d %s", hops, plural(hops, "hop")))
+	}
+	if p.GatewayId != "" {
+		details = append(details, "via "+p.GatewayId)
+	}
+	return "👤 " + strings.Join(details, " · ")
+}
+
+func (r *Router) nodes(req *Request) string {
+	since := time.Now().Add(-NodesWindow).Unix()
+
+	type heard struct {
+		name string
+		at   int64
+	}
+	var active []heard
+	r.NodeInfo.NodesMutex.Lock()
+	total := len(r.NodeInfo.Nodes)
+	for num, node := range r.NodeInfo.Nodes {
+		if at := lastSeen(node); at >= since {
+			active = append(active, heard{nodeName(num, node), at})
+		}
+	}
+	r.NodeInfo.NodesMutex.Unlock()
+
+	sort.Slice(active, func(i, j int) bool { return active[i].at > active[j].at })
+	reply := fmt.Sprintf("📡 %d %s heard in the last hour, %d known", len(active), plural(len(active), "node"), total)
+	if len(active) > 0 {
+		var names []string
+		for _, h := range active[:min(5, len(active))] {
+			names = append(names, h.name)
+		}
+		reply += ". Recent: " + strings.Join(names, ", ")
+	}
+	return reply
+}
+
+// weather reports a node's EnvironmentMetrics: the named node, otherwise the sender's, otherwise the freshest
+func (r *Router) weather(req *Request) string {
+	r.NodeInfo.NodesMutex.Lock()
+	defer r.NodeInfo.NodesMutex.Unlock()
+
+	var num uint32
+	var node *internal.Node
+	switch {
+	case len(req.Args) > 0:
+		num, node = r.findNode(strings.Join(req.Args, " "))
+		if node == nil {
+			return fmt.Sprintf("❓ no node '%s'", strings.Join(req.Args, " "))
+		}
+		if node.LastEnvironmentMetrics == 0 {
+			return fmt.Sprintf("🌡️ no environment telemetry from %s", nodeName(num, node))
+		}
+	case r.NodeInfo.Nodes[req.Packet.From] != nil && r.NodeInfo.Nodes[req.Packet.From].LastEnvironmentMetrics > 0:
+		num, node = req.Packet.From, r.NodeInfo.Nodes[req.Packet.From]
+	default:
+		for n, candidate := range r.NodeInfo.Nodes {
+			if candidate.LastEnvironmentMetrics > 0 && (node == nil || candidate.LastEnvironmentMetrics > node.LastEnvironmentMetrics) {
+				num, node = n, candidate
+			}
+		}
+		if node == nil {
+			return "🌡️ no environment telemetry heard yet"
+		}
+	}
+
+	var readings []string
+	if node.Temperature != 0 {
+		readings = append(readings, fmt.Sprintf("🌡️ %.1f°C", node.Temperature))
+	}
+	if node.RelativeHumidity != 0 {
+		readings = append(readings, fmt.Sprintf("💧 %.0f%%", node.RelativeHumidity))
+	}
+	if node.BarometricPressure != 0 {
+		readings = append(readings, fmt.Sprintf("⏲️ %.0fhPa", node.BarometricPressure))
+	}
+	if node.WindSpeed != 0 || node.WindGust != 0 {
+		readings = append(readings, fmt.Sprintf("💨 %.1fm/s %d° gust %.1fm/s", node.WindSpeed, node.WindDirection, node.WindGust))
+	}
+	if node.Rainfall1 != 0 || node.Rainfall24 != 0 {
+		readings = append(readings, fmt.Sprintf("🌧️ %.1fmm/1h %.1fmm/24h", node.Rainfall1, node.Rainfall24))
+	}
+	if node.Lux != 0 {
+		readings = append(readings, fmt.Sprintf("☀️ %.0flx", node.Lux))
+	}
+	if len(readings) == 0 {
+		readings = append(readings, "🌡️ no readings")
+	}
+	return fmt.Sprintf("%s from %s (%s ago)", strings.Join(readings, " "), nodeName(num, node), ago(node.LastEnvironmentMetrics))
+}
+
+// findNode matches a node id, or a long or short name case-insensitively. NodesMutex must be held.
+func (r *Router) findNode(s string) (uint32, *internal.Node) {
+	if num, err := internal.ParseNodeId(s); err == nil {
+		return num, r.NodeInfo.Nodes[num]
+	}
+	for num, node := range r.NodeInfo.Nodes {
+		if strings.EqualFold(node.LongName, s) || strings.EqualFold(node.ShortName, s) {
+			return num, node
+		}
+	}
+	return 0, nil
+}
+
+func hopsAway(p *internal.Packet) (int, bool) {
+	if p.HopStart == 0 || p.HopStart < p.HopLimit {
+		return 0, false
+	}
+	return int(p.HopStart - p.HopLimit), true
+}
+
+func lastSeen(node *internal.Node) int64 {
+	var last int64
+	for _, at := range node.SeenBy {
+		last = max(last, at)
+	}
+	return last
+}
+
+func nodeName(num uint32, node *internal.Node) string {
+	if node != nil && node.ShortName != "" {
+		return node.ShortName
+	}
+	return fmt.Sprintf("!%08x", num)
+}
+
+// ago is a short age like '12m' or '3h' for a unix time
+func ago(unix int64) string {
+	age := time.Since(time.Unix(unix, 0))
+	switch {
+	case age < time.Minute:
+		return "<1m"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
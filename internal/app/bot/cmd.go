@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/internal/app/storeforward"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/otp"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type BotCmd struct {
+	Config    *config.Config
+	commands  []Command
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewBot(c *config.Config) (b *BotCmd) {
+	b = new(BotCmd)
+	b.Config = c
+
+	return b
+}
+
+// Register adds a Go command handler to the router Run starts, replacing a builtin of the same name
+func (b *BotCmd) Register(c Command) {
+	b.commands = append(b.commands, c)
+}
+
+func (b *BotCmd) Help(cmd *cobra.Command, argz []string) {
+	b.CmdOutput.WasSuccess = true
+	fmt.Fprintln(b.Config.Stdout, help.BotHelp(b.Config))
+}
+
+// Run connects the virtual node and answers commands until killed
+func (b *BotCmd) Run(cmd *cobra.Command, argz []string) {
+	s := help.Render("GlobalHeader", b.Config)
+	b.Config.Stdout.Write([]byte(s + "\n"))
+	b.Config.Log.Trace("BotCmd.Run")
+
+	ni := nodeinfo.NewNodeInfo(b.Config)
+	router := NewRouter(b.Config, ni)
+	router.RegisterBuiltins()
+	for _, c := range b.commands {
+		router.Register(c)
+	}
+	hooks := NewHooks(b.Config, router)
+	hooks.Register()
+
+	handler := router.PacketHandler
+	if b.Config.TextMessage.Reassemble {
+		handler = internal.NewReassembler(time.Duration(b.Config.TextMessage.ReassembleTimeoutSec)*time.Second, handler).Handle
+	}
+	backfill, startBackfill := storeforward.Backfill(b.Config, ni, nil)
+	if err := ni.Listen(handler, hooks.PacketHandler, backfill); err != nil {
+		fmt.Fprintf(b.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	startBackfill()
+	fmt.Fprintf(b.Config.Stdout, "🤖 Listening for '%s' commands ...\n", b.Config.Bot.Prefix)
+
+	ni.MqttClient.WaitUntilKill()
+	ni.Close()
+	b.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	b.CmdOutput.WasSuccess = true
+}
+
+// Secret creates a new base32 TOTP secret for an operator or command
+func (b *BotCmd) Secret(cmd *cobra.Command, argz []string) {
+	secret, err := otp.NewSecret()
+	if err != nil {
+		b.Config.Log.Errorf("failed to create secret: %v", err)
+		return
+	}
+	fmt.Fprintf(b.Config.Stdout, "Secret: \"%s\"\n", secret)
+	fmt.Fprintf(b.Config.Stdout, "# authenticator app: otpauth://totp/meshtk?secret=%s&period=%d\n", secret, b.Config.Bot.OTPStepSec)
+	b.CmdOutput.WasSuccess = true
+}
+
+// Code prints the current one-time password for a secret
+func (b *BotCmd) Code(cmd *cobra.Command, argz []string) {
+	if len(argz) == 0 {
+		fmt.Fprintln(b.Config.Stdout, "❌ secret required, eg. meshtk bot code JBSWY3DPEHPK3PXP")
+		return
+	}
+	key, err := otp.DecodeSecret(argz[0])
+	if err != nil {
+		fmt.Fprintf(b.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	step := time.Duration(b.Config.Bot.OTPStepSec) * time.Second
+	if step <= 0 {
+		step = otp.DefaultStep
+	}
+	fmt.Fprintln(b.Config.Stdout, otp.Code(key, time.Now(), step, otp.DefaultDigits))
+	b.CmdOutput.WasSuccess = true
+}
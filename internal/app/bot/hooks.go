@@ -0,0 +1,347 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// HookInput is written as JSON to a hook's stdin
+type HookInput struct {
+	Command string         `json:"command,omitempty"`
+	Args    []string       `json:"args,omitempty"`
+	Packet  HookPacket     `json:"packet"`
+	Node    *internal.Node `json:"node,omitempty"` // the sender's NodeDB record
+}
+
+type HookPacket struct {
+	Id           uint32          `json:"id"`
+	From         string          `json:"from"`
+	To           string          `json:"to"`
+	Topic        string          `json:"topic"`
+	ChannelId    string          `json:"channelId"`
+	Channel      string          `json:"channel,omitempty"` // slot of the channel that decrypted it
+	GatewayId    string          `json:"gatewayId"`
+	PortNum      string          `json:"portNum"`
+	Payload      []byte          `json:"payload"`
+	Text         string          `json:"text,omitempty"`
+	Decoded      json.RawMessage `json:"decoded,omitempty"` // the payload's protobuf as JSON, for known ports
+	ReplyId      uint32          `json:"replyId,omitempty"`
+	Emoji        uint32          `json:"emoji,omitempty"`
+	DM           bool            `json:"dm"`
+	PkiEncrypted bool            `json:"pkiEncrypted"`
+	HopStart     uint32          `json:"hopStart"`
+	HopLimit     uint32          `json:"hopLimit"`
+	RxTime       uint32          `json:"rxTime"`
+}
+
+// HookResponse is read from a hook's stdout, as one object or an array of them. Without To
+// the packet is answered the way it arrived, like a Go command's reply.
+type HookResponse struct {
+	Text    string `json:"text,omitempty"`
+	PortNum string `json:"portNum,omitempty"` // default TEXT_MESSAGE_APP
+	Payload []byte `json:"payload,omitempty"` // base64, used instead of Text
+	To      string `json:"to,omitempty"`      // node id, '!ffffffff' for the whole channel
+	Slot    string `json:"slot,omitempty"`    // channel slot when To is set (default: TextMessage.ChannelSlot)
+}
+
+// Hooks runs Bot.Hooks executables for bot commands and port numbers, a few at a time
+type Hooks struct {
+	Config *config.Config
+	Router *Router
+	slots  chan struct{}
+	ports  map[meshtastic.PortNum][]config.BotHook
+}
+
+func NewHooks(c *config.Config, router *Router) *Hooks {
+	return &Hooks{
+		Config: c,
+		Router: router,
+		slots:  make(chan struct{}, max(1, c.Bot.HookConcurrency)),
+		ports:  make(map[meshtastic.PortNum][]config.BotHook),
+	}
+}
+
+// Register adds command hooks to the Router and indexes port hooks for PacketHandler
+func (h *Hooks) Register() {
+	for _, hook := range h.Config.Bot.Hooks {
+		switch {
+		case hook.Exec == "":
+			h.Config.Log.Errorf("bot hook for '%s%s' has no Exec", hook.Command, hook.PortNum)
+		case hook.Command != "":
+			h.Router.Register(Command{Name: hook.Command, Usage: hook.Usage, Help: hook.Help, Handler: func(req *Request) string {
+				h.run(hook, req.Packet, req.Command, req.Args)
+				return ""
+			}})
+		case hook.PortNum != "":
+			portNum, err := parsePortNum(hook.PortNum)
+			if err != nil {
+				h.Config.Log.Errorf("bot hook '%s': %v", hook.Exec, err)
+				continue
+			}
+			h.ports[portNum] = append(h.ports[portNum], hook)
+		default:
+			h.Config.Log.Errorf("bot hook '%s' needs a Command or PortNum", hook.Exec)
+		}
+	}
+}
+
+// PacketHandler runs the port hooks for every packet, in the background
+func (h *Hooks) PacketHandler(p *internal.Packet) {
+	if p.From == h.Router.NodeInfo.MqttClient.NodeNum() {
+		return
+	}
+	for _, hook := range h.ports[p.PortNum] {
+		go h.run(hook, p, "", nil)
+	}
+}
+
+// run waits for a free slot, runs the hook and sends its responses
+func (h *Hooks) run(hook config.BotHook, p *internal.Packet, command string, args []string) {
+	timeout := time.Duration(hook.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(h.Config.Bot.HookTimeoutSec) * time.Second
+	}
+
+	// Queued hooks wait up to another timeout for a running one to finish
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-time.After(timeout):
+		h.Config.Log.Warnf(`{'hook': '%s', 'from': '!%08x', 'packetId': %d, 'error': 'no free slot after %v'}`, hook.Exec, p.From, p.Id, timeout)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	input, err := h.input(p, command, args)
+	if err != nil {
+		h.Config.Log.Errorf("failed to build input for hook '%s': %v", hook.Exec, err)
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Exec, hook.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr := &stderrLog{log: h.Config.Log, exec: hook.Exec}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second // children of a killed hook can hold the pipes open
+
+	start := time.Now()
+	err = cmd.Run()
+	stderr.flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		h.Config.Log.Warnf(`{'hook': '%s', 'from': '!%08x', 'packetId': %d, 'error': 'killed after %v'}`, hook.Exec, p.From, p.Id, timeout)
+		return
+	}
+	if err != nil {
+		h.Config.Log.Warnf(`{'hook': '%s', 'from': '!%08x', 'packetId': %d, 'error': '%v'}`, hook.Exec, p.From, p.Id, err)
+		return
+	}
+	h.Config.Log.Debugf(`{'hook': '%s', 'from': '!%08x', 'packetId': %d, 'took': '%v', 'stdout': %d}`, hook.Exec, p.From, p.Id, time.Since(start), stdout.Len())
+
+	responses, err := parseResponses(stdout.Bytes())
+	if err != nil {
+		h.Config.Log.Warnf(`{'hook': '%s', 'from': '!%08x', 'packetId': %d, 'error': 'bad stdout: %v'}`, hook.Exec, p.From, p.Id, err)
+		return
+	}
+	for _, response := range responses {
+		if err := h.send(p, command, response); err != nil {
+			h.Config.Log.Errorf("hook '%s' response not sent: %v", hook.Exec, err)
+		}
+	}
+}
+
+func (h *Hooks) input(p *internal.Packet, command string, args []string) ([]byte, error) {
+	in := HookInput{
+		Command: command,
+		Args:    args,
+		Packet: HookPacket{
+			Id:           p.Id,
+			From:         fmt.Sprintf("!%08x", p.From),
+			To:           fmt.Sprintf("!%08x", p.To),
+			Topic:        p.Topic,
+			ChannelId:    p.ChannelId,
+			GatewayId:    p.GatewayId,
+			PortNum:      p.PortNum.String(),
+			Payload:      p.Payload,
+			Decoded:      decodePayload(p.PortNum, p.Payload),
+			ReplyId:      p.ReplyId,
+			Emoji:        p.Emoji,
+			DM:           p.To == h.Router.NodeInfo.MqttClient.NodeNum(),
+			PkiEncrypted: p.PkiEncrypted,
+			HopStart:     p.HopStart,
+			HopLimit:     p.HopLimit,
+			RxTime:       p.RxTime,
+		},
+	}
+	if p.Channel != nil {
+		in.Packet.Channel = p.Channel.Slot
+	}
+	if p.PortNum == meshtastic.PortNum_TEXT_MESSAGE_APP {
+		in.Packet.Text = string(p.Payload)
+	}
+
+	ni := h.Router.NodeInfo
+	ni.NodesMutex.Lock()
+	defer ni.NodesMutex.Unlock()
+	in.Node = ni.Nodes[p.From]
+	return json.Marshal(in)
+}
+
+func (h *Hooks) send(p *internal.Packet, command string, response HookResponse) error {
+	portNum := meshtastic.PortNum_TEXT_MESSAGE_APP
+	if response.PortNum != "" {
+		var err error
+		if portNum, err = parsePortNum(response.PortNum); err != nil {
+			return err
+		}
+	}
+	payload := response.Payload
+	if payload == nil {
+		payload = []byte(response.Text)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	if response.To == "" {
+		if portNum == meshtastic.PortNum_TEXT_MESSAGE_APP {
+			h.Router.reply(&Request{Packet: p, Command: command}, string(payload))
+			return nil
+		}
+		deliveries, err := h.Router.NodeInfo.MqttClient.PublishReply(p, portNum, payload)
+		h.ledger(deliveries, p.Topic)
+		return err
+	}
+
+	to, err := internal.ParseNodeId(response.To)
+	if err != nil {
+		return err
+	}
+	slot := response.Slot
+	if slot == "" {
+		slot = h.Config.TextMessage.ChannelSlot
+	}
+	deliveries, err := h.Router.NodeInfo.MqttClient.SendTextData(h.Config.TextMessage.Topic, slot, to, &meshtastic.Data{
+		Portnum: portNum,
+		Payload: payload,
+	})
+	h.ledger(deliveries, h.Config.TextMessage.Topic)
+	return err
+}
+
+func (h *Hooks) ledger(deliveries []*internal.Delivery, topic string) {
+	for _, delivery := range deliveries {
+		h.Router.NodeInfo.AddSentLedger(delivery, topic)
+		h.Config.Log.Infof(`{'hook': 'send', 'to': '!%08x', 'portNum': '%s', 'packetId': %d, 'delivery': '%s', 'attempts': %d}`, delivery.To, delivery.Data.GetPortnum(), delivery.PacketId, delivery, delivery.Attempts)
+	}
+}
+
+// stderrLog writes each line a hook prints on stderr to the client log
+type stderrLog struct {
+	log     *log.Logger
+	exec    string
+	partial []byte
+}
+
+func (s *stderrLog) Write(b []byte) (int, error) {
+	s.partial = append(s.partial, b...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		s.log.Infof(`{'hook': '%s', 'stderr': '%s'}`, s.exec, bytes.TrimRight(s.partial[:i], "\r"))
+		s.partial = s.partial[i+1:]
+	}
+}
+
+func (s *stderrLog) flush() {
+	if len(s.partial) > 0 {
+		s.log.Infof(`{'hook': '%s', 'stderr': '%s'}`, s.exec, s.partial)
+		s.partial = nil
+	}
+}
+
+// parseResponses reads one response object or an array, empty output sends nothing
+func parseResponses(stdout []byte) ([]HookResponse, error) {
+	stdout = bytes.TrimSpace(stdout)
+	if len(stdout) == 0 {
+		return nil, nil
+	}
+	var responses []HookResponse
+	if stdout[0] == '[' {
+		err := json.Unmarshal(stdout, &responses)
+		return responses, err
+	}
+	var response HookResponse
+	err := json.Unmarshal(stdout, &response)
+	return []HookResponse{response}, err
+}
+
+// parsePortNum reads a port by name, eg. 'TELEMETRY_APP' or 'telemetry', or by number
+func parsePortNum(s string) (meshtastic.PortNum, error) {
+	if num, err := strconv.Atoi(s); err == nil {
+		return meshtastic.PortNum(num), nil
+	}
+	name := strings.ToUpper(s)
+	for _, candidate := range []string{name, name + "_APP"} {
+		if num, ok := meshtastic.PortNum_value[candidate]; ok {
+			return meshtastic.PortNum(num), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown port '%s'", s)
+}
+
+// decodePayload renders the protobuf payloads of well known ports as JSON
+func decodePayload(portNum meshtastic.PortNum, payload []byte) json.RawMessage {
+	var msg proto.Message
+	switch portNum {
+	case meshtastic.PortNum_POSITION_APP:
+		msg = &meshtastic.Position{}
+	case meshtastic.PortNum_NODEINFO_APP:
+		msg = &meshtastic.User{}
+	case meshtastic.PortNum_TELEMETRY_APP:
+		msg = &meshtastic.Telemetry{}
+	case meshtastic.PortNum_ROUTING_APP:
+		msg = &meshtastic.Routing{}
+	case meshtastic.PortNum_WAYPOINT_APP:
+		msg = &meshtastic.Waypoint{}
+	case meshtastic.PortNum_NEIGHBORINFO_APP:
+		msg = &meshtastic.NeighborInfo{}
+	case meshtastic.PortNum_MAP_REPORT_APP:
+		msg = &meshtastic.MapReport{}
+	case meshtastic.PortNum_TRACEROUTE_APP:
+		msg = &meshtastic.RouteDiscovery{}
+	case meshtastic.PortNum_STORE_FORWARD_APP:
+		msg = &meshtastic.StoreAndForward{}
+	case meshtastic.PortNum_PAXCOUNTER_APP:
+		msg = &meshtastic.Paxcount{}
+	case meshtastic.PortNum_ATAK_PLUGIN:
+		msg = &meshtastic.TAKPacket{}
+	default:
+		return nil
+	}
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil
+	}
+	decoded, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return decoded
+}
@@ -0,0 +1,249 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/otp"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+// Request is a parsed command from a TEXT_MESSAGE_APP packet, eg. '!unlock 123456 door'
+type Request struct {
+	Packet  *internal.Packet
+	Command string
+	Args    []string // after the one-time password when one was required
+	Text    string
+	DM      bool // sent directly to our node rather than to the channel
+}
+
+// Handler runs a command and returns the reply text, an empty reply sends nothing
+type Handler func(r *Request) string
+
+// Scope is where a command is answered
+type Scope int
+
+const (
+	ScopeAny Scope = iota
+	ScopeDM
+	ScopeChannel
+)
+
+func (s Scope) String() string {
+	return [...]string{"any", "dm", "channel"}[s]
+}
+
+// ParseScope reads a Bot.Commands Scope, empty keeps the command's own
+func ParseScope(s string) (Scope, error) {
+	switch strings.ToLower(s) {
+	case "any", "all":
+		return ScopeAny, nil
+	case "dm", "direct":
+		return ScopeDM, nil
+	case "channel":
+		return ScopeChannel, nil
+	}
+	return ScopeAny, fmt.Errorf("unknown scope '%s' (any, dm or channel)", s)
+}
+
+// Command is a registered bot command, Usage and Help are shown by the 'help' command
+type Command struct {
+	Name    string
+	Usage   string // arguments, eg. '[!nodeid]'
+	Help    string
+	Scope   Scope
+	Public  bool // read-only, no one-time password unless its Bot.Commands entry requires one
+	Handler Handler
+}
+
+// Router parses text messages into commands and only dispatches them once their OTP validates
+type Router struct {
+	Config   *config.Config
+	NodeInfo *nodeinfo.NodeInfoCmd
+	verifier *otp.Verifier
+	commands map[string]*Command
+	mutex    sync.RWMutex
+}
+
+func NewRouter(c *config.Config, ni *nodeinfo.NodeInfoCmd) *Router {
+	return &Router{
+		Config:   c,
+		NodeInfo: ni,
+		verifier: otp.NewVerifier(time.Duration(c.Bot.OTPStepSec)*time.Second, c.Bot.OTPSkew),
+		commands: make(map[string]*Command),
+	}
+}
+
+// Register adds a command, names are matched case-insensitively and replace an earlier command.
+// A Bot.Commands entry with a Scope overrides the command's own.
+func (r *Router) Register(c Command) {
+	if conf := r.commandConfig(c.Name); conf != nil && conf.Scope != "" {
+		scope, err := ParseScope(conf.Scope)
+		if err != nil {
+			r.Config.Log.Errorf("bot command '%s': %v", c.Name, err)
+		} else {
+			c.Scope = scope
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands[strings.ToLower(c.Name)] = &c
+}
+
+// Commands lists the registered commands answered in a DM or on the channel, sorted by name
+func (r *Router) Commands(dm bool) []*Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var commands []*Command
+	for _, c := range r.commands {
+		if c.allowed(dm) {
+			commands = append(commands, c)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+func (r *Router) command(name string) *Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.commands[strings.ToLower(name)]
+}
+
+func (c *Command) allowed(dm bool) bool {
+	return c.Scope == ScopeAny || (c.Scope == ScopeDM) == dm
+}
+
+// PacketHandler is registered with the MqttClient to see every decoded packet
+func (r *Router) PacketHandler(p *internal.Packet) {
+	if p.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP {
+		return
+	}
+	nodeNum := r.NodeInfo.MqttClient.NodeNum()
+	if p.From == nodeNum {
+		return // our own messages echoed back by the broker
+	}
+	if p.To != internal.BroadcastAddr && p.To != nodeNum {
+		return // a direct message to another node
+	}
+	text := strings.TrimSpace(string(p.Payload))
+	if !strings.HasPrefix(text, r.Config.Bot.Prefix) {
+		return
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(text, r.Config.Bot.Prefix))
+	if len(fields) == 0 {
+		return
+	}
+	req := &Request{
+		Packet:  p,
+		Command: strings.ToLower(fields[0]),
+		Args:    fields[1:],
+		Text:    text,
+		DM:      p.To == nodeNum,
+	}
+
+	command := r.command(req.Command)
+	if command == nil {
+		r.Config.Log.Debugf(`{'bot': 'unknown', 'from': '!%08x', 'command': '%s', 'topic': '%s'}`, p.From, req.Command, p.Topic)
+		return
+	}
+	if !command.allowed(req.DM) {
+		r.Config.Log.Debugf(`{'bot': 'scope', 'from': '!%08x', 'command': '%s', 'topic': '%s', 'scope': '%s'}`, p.From, req.Command, p.Topic, command.Scope)
+		if command.Scope == ScopeDM {
+			r.reply(req, fmt.Sprintf("🔒 %s%s only works in a direct message", r.Config.Bot.Prefix, command.Name))
+		}
+		return
+	}
+
+	if err := r.checkOTP(req, command); err != nil {
+		r.Config.Log.Warnf(`{'bot': 'rejected', 'from': '!%08x', 'command': '%s', 'topic': '%s', 'packetId': %d, 'reason': '%v'}`, p.From, req.Command, p.Topic, p.Id, err)
+		r.reply(req, fmt.Sprintf("⛔ %s: %v", req.Command, err))
+		return
+	}
+	r.Config.Log.Infof(`{'bot': 'accepted', 'from': '!%08x', 'command': '%s', 'topic': '%s', 'packetId': %d}`, p.From, req.Command, p.Topic, p.Id)
+
+	r.reply(req, command.Handler(req))
+}
+
+// checkOTP consumes the code from Args when the command requires one. A command's own
+// secret is tried first, otherwise the sender must be an operator with a secret.
+// Only a Bot.Commands entry that sets RequireOTP (or a Secret) changes the default.
+func (r *Router) checkOTP(req *Request, registered *Command) error {
+	command := r.commandConfig(req.Command)
+	requireOTP := r.Config.Bot.RequireOTP && !registered.Public
+	if command != nil && command.RequireOTP != nil {
+		requireOTP = *command.RequireOTP
+	}
+	if command != nil && command.Secret != "" {
+		requireOTP = true
+	}
+	if !requireOTP {
+		return nil
+	}
+
+	if len(req.Args) == 0 {
+		return fmt.Errorf("one-time password required")
+	}
+	code := req.Args[0]
+	req.Args = req.Args[1:]
+
+	identity, secret := "", ""
+	if command != nil && command.Secret != "" {
+		identity, secret = "command:"+command.Name, command.Secret
+	} else if operator := r.operatorConfig(req.Packet.From); operator != nil {
+		identity, secret = "operator:"+operator.Node, operator.Secret
+	} else {
+		return fmt.Errorf("!%08x is not an operator", req.Packet.From)
+	}
+
+	key, err := otp.DecodeSecret(secret)
+	if err != nil {
+		r.Config.Log.Errorf("bad OTP secret for %s: %v", identity, err)
+		return otp.ErrNoSecret
+	}
+	return r.verifier.Verify(identity, key, code, time.Now())
+}
+
+func (r *Router) commandConfig(name string) *config.BotCommand {
+	for i, c := range r.Config.Bot.Commands {
+		if strings.EqualFold(c.Name, name) {
+			return &r.Config.Bot.Commands[i]
+		}
+	}
+	return nil
+}
+
+func (r *Router) operatorConfig(from uint32) *config.BotOperator {
+	for i, o := range r.Config.Bot.Operators {
+		num, err := internal.ParseNodeId(o.Node)
+		if err == nil && num == from {
+			return &r.Config.Bot.Operators[i]
+		}
+	}
+	return nil
+}
+
+func (r *Router) reply(req *Request, text string) {
+	if text == "" {
+		return
+	}
+	deliveries, err := r.NodeInfo.MqttClient.PublishReply(req.Packet, meshtastic.PortNum_TEXT_MESSAGE_APP, []byte(text))
+	for _, delivery := range deliveries {
+		r.NodeInfo.AddSentLedger(delivery, req.Packet.Topic)
+		if delivery.State == internal.DeliveryNak || delivery.State == internal.DeliveryTimeout {
+			r.Config.Log.Warnf(`{'bot': 'reply', 'to': '!%08x', 'command': '%s', 'packetId': %d, 'delivery': '%s', 'attempts': %d}`, req.Packet.From, req.Command, delivery.PacketId, delivery, delivery.Attempts)
+			continue
+		}
+		r.Config.Log.Infof(`{'bot': 'reply', 'to': '!%08x', 'command': '%s', 'packetId': %d, 'delivery': '%s', 'attempts': %d}`, req.Packet.From, req.Command, delivery.PacketId, delivery, delivery.Attempts)
+	}
+	if err != nil {
+		r.Config.Log.Errorf("failed to reply to !%08x: %v", req.Packet.From, err)
+	}
+}
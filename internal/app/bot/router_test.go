@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+const testSender = 0x12345678
+
+func newTestRouter(t *testing.T) (*Router, *mqtttest.Recorder) {
+	t.Chdir(t.TempDir()) // the ledger is written to the working directory
+
+	c := mqtttest.Config()
+	c.Bot.Prefix = "!"
+	c.Bot.OTPStepSec = 30
+	c.Bot.Commands = []config.BotCommand{{Name: "whoami", Scope: "dm"}}
+
+	ni := nodeinfo.NewNodeInfo(c)
+	ni.MqttClient = internal.NewMqttClient(c, &ni.Nodes)
+	rec := new(mqtttest.Recorder)
+	ni.MqttClient.SetClient(rec)
+
+	r := NewRouter(c, ni)
+	r.RegisterBuiltins()
+	return r, rec
+}
+
+func textPacket(to uint32, text string) *internal.Packet {
+	return &internal.Packet{Id: 42, From: testSender, To: to, Topic: "msh/US/2/e/LongFast/!87654321", PortNum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte(text)}
+}
+
+func TestDMScopedReplyIsAddressedToSender(t *testing.T) {
+	r, rec := newTestRouter(t)
+	if command := r.command("whoami"); command.Scope != ScopeDM {
+		t.Fatalf("whoami scope = %s, want dm", command.Scope)
+	}
+
+	r.PacketHandler(textPacket(mqtttest.Node, "!whoami"))
+
+	envelopes := rec.Envelopes()
+	if len(envelopes) == 0 {
+		t.Fatal("no reply published")
+	}
+	for _, envelope := range envelopes {
+		packet := envelope.GetPacket()
+		if packet.GetTo() != testSender {
+			t.Errorf("reply to !%08x, want the sender !%08x", packet.GetTo(), uint32(testSender))
+		}
+		if !packet.GetWantAck() {
+			t.Error("direct reply sent without want_ack")
+		}
+	}
+}
+
+func TestChannelReplyIsBroadcast(t *testing.T) {
+	r, rec := newTestRouter(t)
+
+	r.PacketHandler(textPacket(internal.BroadcastAddr, "!ping"))
+
+	envelopes := rec.Envelopes()
+	if len(envelopes) != 1 {
+		t.Fatalf("published %d replies, want 1", len(envelopes))
+	}
+	if packet := envelopes[0].GetPacket(); packet.GetTo() != internal.BroadcastAddr || packet.GetWantAck() {
+		t.Errorf("reply to !%08x wantAck=%v, want a broadcast without want_ack", packet.GetTo(), packet.GetWantAck())
+	}
+}
+
+func TestDMScopedCommandOnChannelIsRefused(t *testing.T) {
+	r, rec := newTestRouter(t)
+
+	r.PacketHandler(textPacket(internal.BroadcastAddr, "!whoami"))
+
+	if count := rec.Count(); count != 1 {
+		t.Fatalf("published %d replies, want the one refusal", count)
+	}
+}
+
+func TestScopeOnlyEntryStillRequiresOTP(t *testing.T) {
+	optional := false
+	tests := []struct {
+		name  string
+		entry config.BotCommand
+		ran   bool
+	}{
+		{"scope only keeps the default", config.BotCommand{Name: "reboot", Scope: "dm"}, false},
+		{"explicitly optional", config.BotCommand{Name: "reboot", Scope: "dm", RequireOTP: &optional}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRouter(t)
+			r.Config.Bot.RequireOTP = true
+			r.Config.Bot.Commands = append(r.Config.Bot.Commands, tt.entry)
+			ran := false
+			r.Register(Command{Name: "reboot", Help: "restarts the node", Handler: func(*Request) string {
+				ran = true
+				return "rebooting"
+			}})
+
+			r.PacketHandler(textPacket(mqtttest.Node, "!reboot"))
+
+			if ran != tt.ran {
+				t.Errorf("handler ran = %v, want %v", ran, tt.ran)
+			}
+		})
+	}
+}
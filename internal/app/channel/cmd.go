@@ -0,0 +1,153 @@
+package channel
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type ChannelCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewChannel(c *config.Config) (ch *ChannelCmd) {
+	ch = new(ChannelCmd)
+	ch.Config = c
+
+	return ch
+}
+
+func (ch *ChannelCmd) Help(cmd *cobra.Command, argz []string) {
+	ch.CmdOutput.WasSuccess = true
+	fmt.Fprintln(ch.Config.Stdout, help.ChannelHelp(ch.Config))
+}
+
+// List shows the configured channels with the channel hash used to match packets
+func (ch *ChannelCmd) List(cmd *cobra.Command, argz []string) {
+	ch.Config.Log.Trace("ChannelCmd.List")
+
+	keyring, err := internal.NewKeyring(ch.Config.Meshtastic.Channels)
+	if err != nil {
+		fmt.Fprintf(ch.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	for _, k := range keyring {
+		primary := ""
+		if k.IsPrimary {
+			primary = " (primary)"
+		}
+		fmt.Fprintf(ch.Config.Stdout, "  %-12s %-16s hash:%-3d%s\n", k.Slot, k.Name, k.Hash, primary)
+	}
+	ch.CmdOutput.WasSuccess = true
+}
+
+// Import decodes a meshtastic channel URL and writes the channels and LoRa settings into a config file.
+// The file is the second argument, otherwise the '-c' config file, otherwise ./meshtk.yaml
+func (ch *ChannelCmd) Import(cmd *cobra.Command, argz []string) {
+	ch.Config.Log.Trace("ChannelCmd.Import")
+
+	channelURL := string(ch.Config.Stdin)
+	if len(argz) > 0 {
+		channelURL = argz[0]
+	}
+	if strings.TrimSpace(channelURL) == "" {
+		fmt.Fprintln(ch.Config.Stdout, "❌ channel url required, eg. meshtk channel import 'https://meshtastic.org/e/#CgMSAQESBggBQANIAQ'")
+		return
+	}
+
+	set, add, err := internal.DecodeChannelURL(channelURL)
+	if err != nil {
+		ch.Config.Log.Errorf("failed to import channel url: %v", err)
+		fmt.Fprintf(ch.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	channels, lora := internal.ChannelsFromSet(set)
+
+	values := map[string]any{}
+	order := []string{"Meshtastic.Channels"}
+	if add {
+		// '?add=true' urls only carry extra channels, keep what we have and the LoRa settings
+		for i := range channels {
+			channels[i].IsPrimary = false
+		}
+		channels = append(ch.Config.Meshtastic.Channels, channels...)
+	} else {
+		values["Meshtastic.LoRa"] = lora
+		order = append(order, "Meshtastic.LoRa")
+	}
+	channels = uniqueSlots(channels)
+	values["Meshtastic.Channels"] = channels
+
+	filename := ch.Config.ConfigFileName
+	if len(argz) > 1 {
+		filename = argz[1]
+	}
+	if filename == "" {
+		filename = filepath.Join(ch.Config.Cwd, "meshtk.yaml")
+	}
+
+	if err := config.UpdateFile(filename, values, order...); err != nil {
+		ch.Config.Log.Errorf("failed to write channels to %s: %v", filename, err)
+		fmt.Fprintf(ch.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	ch.Config.Log.Infof("imported %d channels into %s", len(channels), filename)
+	fmt.Fprintf(ch.Config.Stdout, "📻 Imported into %s (region:%s preset:%s)\n", filename, lora.Region, lora.ModemPreset)
+	for _, c := range channels {
+		fmt.Fprintf(ch.Config.Stdout, "  %-12s %-16s hash:%d\n", c.Slot, c.Name, internal.GenerateChannelHash(c.Name, c.EncryptKey))
+	}
+	ch.CmdOutput.WasSuccess = true
+}
+
+// Export writes the configured channels and LoRa settings as a meshtastic channel URL
+func (ch *ChannelCmd) Export(cmd *cobra.Command, argz []string) {
+	ch.Config.Log.Trace("ChannelCmd.Export")
+
+	lora := ch.Config.Meshtastic.LoRa
+	if lora.Region == "" {
+		lora.Region = ch.Config.NodeInfo.Region
+	}
+	if lora.ModemPreset == "" {
+		lora.ModemPreset = ch.Config.NodeInfo.ModemPreset
+		lora.UsePreset = true
+	}
+
+	set, err := internal.ChannelSetFromConfig(ch.Config.Meshtastic.Channels, lora)
+	if err != nil {
+		fmt.Fprintf(ch.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	replaceURL, err := internal.EncodeChannelURL(set, false)
+	if err != nil {
+		fmt.Fprintf(ch.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	addURL, _ := internal.EncodeChannelURL(set, true)
+
+	fmt.Fprintf(ch.Config.Stdout, "%s\n", replaceURL)
+	fmt.Fprintf(ch.Config.Stdout, "# to add (instead of replace) channels on a radio:\n%s\n", addURL)
+	ch.CmdOutput.WasSuccess = true
+}
+
+// uniqueSlots suffixes repeated slot names so BySlot lookups stay unambiguous
+func uniqueSlots(channels []config.Channel) []config.Channel {
+	seen := make(map[string]int)
+	for i := range channels {
+		slot := strings.ToLower(channels[i].Slot)
+		seen[slot]++
+		if seen[slot] > 1 {
+			channels[i].Slot = fmt.Sprintf("%s%d", channels[i].Slot, seen[slot])
+		}
+	}
+	return channels
+}
@@ -0,0 +1,281 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/internal/app/storeforward"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+type ChatCmd struct {
+	Config    *config.Config
+	NodeInfo  *nodeinfo.NodeInfoCmd
+	CmdOutput struct {
+		WasSuccess bool
+	}
+	to     uint32 // BroadcastAddr for the channel, otherwise the node from '/dm !id'
+	slot   string
+	dms    map[uint32]uint32 // direct message packet id to sender, so '/reply' goes back to them
+	mutex  sync.Mutex
+	output sync.Mutex
+}
+
+func NewChat(c *config.Config) (ch *ChatCmd) {
+	ch = new(ChatCmd)
+	ch.Config = c
+
+	return ch
+}
+
+func (ch *ChatCmd) Help(cmd *cobra.Command, argz []string) {
+	ch.CmdOutput.WasSuccess = true
+	fmt.Fprintln(ch.Config.Stdout, help.ChatHelp(ch.Config))
+}
+
+// Run shows the ledger scrollback, then live text messages, and sends every typed line
+func (ch *ChatCmd) Run(cmd *cobra.Command, argz []string) {
+	s := help.Render("GlobalHeader", ch.Config)
+	ch.Config.Stdout.Write([]byte(s + "\n"))
+	ch.Config.Log.Trace("ChatCmd.Run")
+
+	ch.to = internal.BroadcastAddr
+	ch.slot = ch.Config.TextMessage.ChannelSlot
+	ch.dms = make(map[uint32]uint32)
+
+	ch.NodeInfo = nodeinfo.NewNodeInfo(ch.Config)
+	handler := ch.PacketHandler
+	if ch.Config.TextMessage.Reassemble {
+		handler = internal.NewReassembler(time.Duration(ch.Config.TextMessage.ReassembleTimeoutSec)*time.Second, handler).Handle
+	}
+	backfill, startBackfill := storeforward.Backfill(ch.Config, ch.NodeInfo, ch.BackfillHandler)
+	if err := ch.NodeInfo.Listen(handler, backfill); err != nil {
+		fmt.Fprintf(ch.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	defer ch.NodeInfo.Close()
+
+	ch.history(ch.Config.Chat.Scrollback)
+	startBackfill()
+	ch.printf("💬 Chatting on '%s' as %s, '/help' for commands\n", ch.slot, ch.name(ch.NodeInfo.MqttClient.NodeNum(), "", ""))
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			if !ch.command(line) {
+				break
+			}
+			continue
+		}
+		ch.send(ch.to, &meshtastic.Data{Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte(line)})
+	}
+
+	ch.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	ch.CmdOutput.WasSuccess = true
+}
+
+// PacketHandler prints text messages as they arrive
+func (ch *ChatCmd) PacketHandler(p *internal.Packet) {
+	if p.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP {
+		return
+	}
+	where := "#" + p.ChannelId
+	if p.To != internal.BroadcastAddr {
+		where = "DM"
+		ch.mutex.Lock()
+		ch.dms[p.Id] = p.From
+		ch.mutex.Unlock()
+	}
+	ch.printf("%s\n", format(time.Now().Format("15:04"), where, ch.name(p.From, "", ""), p.Payload, p.Id, p.ReplyId, p.Emoji != 0))
+}
+
+// BackfillHandler prints messages a Store & Forward router replayed, at the time it heard them
+func (ch *ChatCmd) BackfillHandler(p *internal.Packet) {
+	where := "#" + p.ChannelId
+	if p.To != internal.BroadcastAddr {
+		where = "DM"
+	}
+	when := time.Unix(int64(p.RxTime), 0).Format("01-02 15:04")
+	ch.printf("📥 %s\n", format(when, where, ch.name(p.From, "", ""), p.Payload, p.Id, p.ReplyId, p.Emoji != 0))
+}
+
+// format shows a message with its packet id, for '/reply' and '/react', and what it replies to
+func format(when, where, who string, text []byte, id, replyId uint32, emoji bool) string {
+	switch {
+	case emoji:
+		return fmt.Sprintf("[%s] %s %s reacted %s to #%d", when, where, who, text, replyId)
+	case replyId != 0:
+		return fmt.Sprintf("[%s] %s %s ↩️ #%d: %s  (#%d)", when, where, who, replyId, text, id)
+	case id != 0:
+		return fmt.Sprintf("[%s] %s %s: %s  (#%d)", when, where, who, text, id)
+	}
+	return fmt.Sprintf("[%s] %s %s: %s", when, where, who, text)
+}
+
+// command runs a '/...' line, returning false to quit
+func (ch *ChatCmd) command(line string) bool {
+	fields := strings.Fields(line)
+	name := strings.ToLower(fields[0])
+	switch name {
+	case "/dm":
+		if len(fields) < 2 {
+			ch.printf("❌ usage: /dm !nodeid [message]\n")
+			return true
+		}
+		to, err := internal.ParseNodeId(fields[1])
+		if err != nil {
+			ch.printf("❌ %v\n", err)
+			return true
+		}
+		if len(fields) > 2 {
+			ch.send(to, &meshtastic.Data{Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte(strings.Join(fields[2:], " "))})
+			return true
+		}
+		ch.to = to
+		ch.printf("💬 Now messaging %s directly, '/channel' to go back\n", ch.name(to, "", ""))
+	case "/channel", "/all":
+		if len(fields) > 1 {
+			ch.slot = fields[1]
+		}
+		ch.to = internal.BroadcastAddr
+		ch.printf("💬 Now chatting on '%s'\n", ch.slot)
+	case "/reply", "/react":
+		if len(fields) < 3 {
+			ch.printf("❌ usage: %s #packetid <text>\n", fields[0])
+			return true
+		}
+		replyId, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "#"), 10, 32)
+		if err != nil {
+			ch.printf("❌ invalid packet id '%s': %v\n", fields[1], err)
+			return true
+		}
+		data := &meshtastic.Data{
+			Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+			Payload: []byte(strings.Join(fields[2:], " ")),
+			ReplyId: uint32(replyId),
+		}
+		if name == "/react" {
+			data.Emoji = 1
+		}
+		to := ch.to
+		ch.mutex.Lock()
+		if from, exists := ch.dms[uint32(replyId)]; exists {
+			to = from
+		}
+		ch.mutex.Unlock()
+		ch.send(to, data)
+	case "/history":
+		limit := ch.Config.Chat.Scrollback
+		if len(fields) > 1 {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				limit = n
+			}
+		}
+		ch.history(limit)
+	case "/quit", "/exit":
+		return false
+	default:
+		ch.printf("%s\n", help.Render("ChatCommands", ch.Config))
+	}
+	return true
+}
+
+// send prints the message straight away and, for direct messages, its delivery once the ACK arrives
+func (ch *ChatCmd) send(to uint32, data *meshtastic.Data) {
+	where := "#" + ch.slot
+	if to != internal.BroadcastAddr {
+		where = "DM " + ch.name(to, "", "")
+	}
+	me := ch.name(ch.NodeInfo.MqttClient.NodeNum(), "", "")
+	text := data.GetPayload()
+	ch.printf("%s\n", format(time.Now().Format("15:04"), where, me, text, 0, data.GetReplyId(), data.GetEmoji() != 0))
+
+	topic, slot := ch.Config.TextMessage.Topic, ch.slot
+	go func() {
+		deliveries, err := ch.NodeInfo.MqttClient.SendTextData(topic, slot, to, data)
+		for _, delivery := range deliveries {
+			ch.NodeInfo.AddSentLedger(delivery, topic)
+			switch delivery.State {
+			case internal.DeliveryDelivered:
+				ch.printf("✅ #%d delivered to %s\n", delivery.PacketId, ch.name(to, "", ""))
+			case internal.DeliveryNak:
+				ch.printf("❌ %s refused '%s': %s\n", ch.name(to, "", ""), delivery.Data.GetPayload(), delivery.Reason)
+			case internal.DeliveryTimeout:
+				ch.printf("⌛ no ACK from %s for '%s' after %d attempts\n", ch.name(to, "", ""), delivery.Data.GetPayload(), delivery.Attempts)
+			}
+		}
+		if err != nil {
+			ch.printf("❌ failed to send: %v\n", err)
+		}
+	}()
+}
+
+// history prints the last 'limit' text messages from the ledger
+func (ch *ChatCmd) history(limit int) {
+	messages, err := nodeinfo.ReadTextLedger(limit)
+	if err != nil {
+		ch.printf("❌ failed to read the message ledger: %v\n", err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+	ch.printf("--- last %d messages ---\n", len(messages))
+	for _, m := range messages {
+		where := "#" + topicChannel(m.Topic)
+		if m.To != internal.BroadcastAddr {
+			where = "DM " + ch.name(m.To, m.ToNode.ShortName, m.ToNode.LongName)
+		}
+		when := time.Unix(m.DateTimeStamp, 0).Format("01-02 15:04")
+		who := ch.name(m.From, m.FromNode.ShortName, m.FromNode.LongName)
+		ch.printf("%s\n", format(when, where, who, m.Payload, m.PacketId, m.ReplyId, m.Emoji))
+	}
+	ch.printf("---\n")
+}
+
+// name shows a node as 'ShortName LongName (!id)' from the NodeDB, falling back to the given names
+func (ch *ChatCmd) name(num uint32, shortName, longName string) string {
+	if num == ch.NodeInfo.MqttClient.NodeNum() {
+		shortName, longName = ch.Config.NodeInfo.ShortName, ch.Config.NodeInfo.LongName
+	} else {
+		ch.NodeInfo.NodesMutex.Lock()
+		if node, exists := ch.NodeInfo.Nodes[num]; exists && node.LongName != "" {
+			shortName, longName = node.ShortName, node.LongName
+		}
+		ch.NodeInfo.NodesMutex.Unlock()
+	}
+	if longName == "" {
+		return fmt.Sprintf("!%08x", num)
+	}
+	return fmt.Sprintf("%s %s (!%08x)", shortName, longName, num)
+}
+
+func (ch *ChatCmd) printf(format string, a ...any) {
+	ch.output.Lock()
+	defer ch.output.Unlock()
+	fmt.Fprintf(ch.Config.Stdout, format, a...)
+}
+
+// topicChannel is the channel name from a topic, eg. msh/US/2/e/LongFast/!28a1b2c3 is LongFast
+func topicChannel(topic string) string {
+	topic = strings.TrimSuffix(topic, "/")
+	if strings.HasPrefix(path.Base(topic), "!") {
+		topic = path.Dir(topic)
+	}
+	return path.Base(topic)
+}
@@ -5,7 +5,19 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/whereiskurt/meshtk/internal/app/admin"
+	"github.com/whereiskurt/meshtk/internal/app/atak"
+	"github.com/whereiskurt/meshtk/internal/app/bbs"
+	"github.com/whereiskurt/meshtk/internal/app/bot"
+	"github.com/whereiskurt/meshtk/internal/app/channel"
+	"github.com/whereiskurt/meshtk/internal/app/chat"
+	"github.com/whereiskurt/meshtk/internal/app/keys"
 	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/internal/app/storeforward"
+	"github.com/whereiskurt/meshtk/internal/app/telemetry"
+	"github.com/whereiskurt/meshtk/internal/app/text"
+	"github.com/whereiskurt/meshtk/internal/app/traceroute"
+	"github.com/whereiskurt/meshtk/internal/app/waypoint"
 	"github.com/whereiskurt/meshtk/pkg/config"
 )
 
@@ -50,6 +62,107 @@ func (a *App) RegisterOsArgs() {
 	cmd.NewSubCmd(nodeInfoCmd, "help", ni.Help)
 	cmd.NewSubCmd(nodeInfoCmd, "announce", ni.Announce)
 
+	k := keys.NewKeys(a.Config)
+	keysCmd := cmd.NewCmd([]string{"keys", "k"}, k.Help)
+	cmd.NewSubCmd(keysCmd, "help", k.Help)
+	cmd.NewSubCmd(keysCmd, "generate", k.Generate)
+	cmd.NewSubCmd(keysCmd, "pubkey", k.PublicKey)
+	cmd.NewSubCmd(keysCmd, "verify", k.Verify)
+	cmd.NewSubCmd(keysCmd, "rotate", k.Rotate)
+	cmd.NewSubCmd(keysCmd, "pins", k.Pins)
+	cmd.NewSubCmd(keysCmd, "trust", k.Trust)
+
+	ch := channel.NewChannel(a.Config)
+	channelCmd := cmd.NewCmd([]string{"channel", "ch"}, ch.Help)
+	cmd.NewSubCmd(channelCmd, "help", ch.Help)
+	cmd.NewSubCmd(channelCmd, "list", ch.List)
+	cmd.NewSubCmd(channelCmd, "import", ch.Import)
+	cmd.NewSubCmd(channelCmd, "export", ch.Export)
+
+	adm := admin.NewAdmin(a.Config)
+	adminCmd := cmd.NewCmd([]string{"admin"}, adm.Help)
+	cmd.NewSubCmd(adminCmd, "help", adm.Help)
+	cmd.NewSubCmd(adminCmd, "owner", adm.Owner)
+	cmd.NewSubCmd(adminCmd, "metadata", adm.Metadata)
+	cmd.NewSubCmd(adminCmd, "config", adm.ConfigGet)
+	cmd.NewSubCmd(adminCmd, "module", adm.Module)
+	cmd.NewSubCmd(adminCmd, "channel", adm.Channel)
+	cmd.NewSubCmd(adminCmd, "set-owner", adm.SetOwner)
+	cmd.NewSubCmd(adminCmd, "set-position", adm.SetPosition)
+	cmd.NewSubCmd(adminCmd, "reboot", adm.Reboot)
+
+	t := text.NewText(a.Config)
+	textCmd := cmd.NewCmd([]string{"text", "t"}, t.Help)
+	cmd.NewSubCmd(textCmd, "help", t.Help)
+	textSendCmd := cmd.NewSubCmd(textCmd, "send", t.Send)
+	cmd.FlagS(textSendCmd, "to", &a.Config.TextMessage.To, nil, nil)
+	cmd.FlagS(textSendCmd, "slot", &a.Config.TextMessage.ChannelSlot, []string{"s"}, nil)
+	cmd.FlagI(textSendCmd, "reply-to", &a.Config.TextMessage.ReplyId, nil, nil)
+	cmd.FlagB(textSendCmd, "compress", &a.Config.TextMessage.Compress, nil, nil)
+	textReactCmd := cmd.NewSubCmd(textCmd, "react", t.React)
+	cmd.FlagS(textReactCmd, "to", &a.Config.TextMessage.To, nil, nil)
+	cmd.FlagS(textReactCmd, "slot", &a.Config.TextMessage.ChannelSlot, []string{"s"}, nil)
+
+	cht := chat.NewChat(a.Config)
+	chatCmd := cmd.NewCmd([]string{"chat"}, cht.Run)
+	cmd.NewSubCmd(chatCmd, "help", cht.Help)
+
+	b := bot.NewBot(a.Config)
+	botCmd := cmd.NewCmd([]string{"bot"}, b.Help)
+	cmd.NewSubCmd(botCmd, "help", b.Help)
+	cmd.NewSubCmd(botCmd, "run", b.Run)
+	cmd.NewSubCmd(botCmd, "secret", b.Secret)
+	cmd.NewSubCmd(botCmd, "code", b.Code)
+
+	sf := storeforward.NewStoreForward(a.Config)
+	sfCmd := cmd.NewCmd([]string{"storeforward", "sf"}, sf.Help)
+	cmd.NewSubCmd(sfCmd, "help", sf.Help)
+	cmd.NewSubCmd(sfCmd, "run", sf.Run)
+	cmd.NewSubCmd(sfCmd, "routers", sf.Routers)
+	sfHistoryCmd := cmd.NewSubCmd(sfCmd, "history", sf.History)
+	cmd.FlagI(sfHistoryCmd, "window", &a.Config.StoreForward.HistoryWindowMin, []string{"w"}, nil)
+
+	bb := bbs.NewBbsCmd(a.Config)
+	bbsCmd := cmd.NewCmd([]string{"bbs"}, bb.Help)
+	cmd.NewSubCmd(bbsCmd, "help", bb.Help)
+	cmd.NewSubCmd(bbsCmd, "run", bb.Run)
+
+	tr := traceroute.NewTraceroute(a.Config)
+	trCmd := cmd.NewCmd([]string{"traceroute", "tr"}, tr.Run)
+	cmd.NewSubCmd(trCmd, "help", tr.Help)
+	cmd.FlagS(trCmd, "slot", &a.Config.Traceroute.ChannelSlot, []string{"s"}, nil)
+
+	wp := waypoint.NewWaypoint(a.Config)
+	wpCmd := cmd.NewCmd([]string{"waypoint", "wp"}, wp.Help)
+	cmd.NewSubCmd(wpCmd, "help", wp.Help)
+	for _, c := range []*cobra.Command{cmd.NewSubCmd(wpCmd, "create", wp.Create), cmd.NewSubCmd(wpCmd, "update", wp.Update)} {
+		cmd.FlagS(c, "name", &a.Config.Waypoint.Name, nil, nil)
+		cmd.FlagS(c, "description", &a.Config.Waypoint.Description, nil, nil)
+		cmd.FlagS(c, "icon", &a.Config.Waypoint.Icon, nil, nil)
+		cmd.FlagI(c, "expire", &a.Config.Waypoint.ExpireHours, nil, nil)
+		cmd.FlagB(c, "locked", &a.Config.Waypoint.Locked, nil, nil)
+		cmd.FlagS(c, "slot", &a.Config.Waypoint.ChannelSlot, []string{"s"}, nil)
+	}
+	wpDeleteCmd := cmd.NewSubCmd(wpCmd, "delete", wp.Delete)
+	cmd.FlagS(wpDeleteCmd, "slot", &a.Config.Waypoint.ChannelSlot, []string{"s"}, nil)
+	cmd.NewSubCmd(wpCmd, "list", wp.List)
+	cmd.NewSubCmd(wpCmd, "export", wp.Export)
+
+	tak := atak.NewAtak(a.Config)
+	takCmd := cmd.NewCmd([]string{"atak"}, tak.Help)
+	cmd.NewSubCmd(takCmd, "help", tak.Help)
+	takRunCmd := cmd.NewSubCmd(takCmd, "run", tak.Run)
+	cmd.FlagS(takRunCmd, "slot", &a.Config.Atak.ChannelSlot, []string{"s"}, nil)
+
+	tm := telemetry.NewTelemetry(a.Config)
+	tmCmd := cmd.NewCmd([]string{"telemetry"}, tm.Help)
+	cmd.NewSubCmd(tmCmd, "help", tm.Help)
+	tmRunCmd := cmd.NewSubCmd(tmCmd, "run", tm.Run)
+	cmd.FlagS(tmRunCmd, "slot", &a.Config.Telemetry.ChannelSlot, []string{"s"}, nil)
+	cmd.FlagS(tmRunCmd, "file", &a.Config.Telemetry.File, []string{"f"}, nil)
+	tmShowCmd := cmd.NewSubCmd(tmCmd, "show", tm.Show)
+	cmd.FlagS(tmShowCmd, "file", &a.Config.Telemetry.File, []string{"f"}, nil)
+
 }
 
 func (c *CmdBuilder) NewCmd(s []string, run func(*cobra.Command, []string)) *cobra.Command {
@@ -18,11 +18,47 @@ var (
 	GlobalTmpl string
 	//go:embed nodeinfo.tmpl
 	NodeInfoTmpl string
+	//go:embed keys.tmpl
+	KeysTmpl string
+	//go:embed channel.tmpl
+	ChannelTmpl string
+	//go:embed admin.tmpl
+	AdminTmpl string
+	//go:embed bot.tmpl
+	BotTmpl string
+	//go:embed text.tmpl
+	TextTmpl string
+	//go:embed chat.tmpl
+	ChatTmpl string
+	//go:embed storeforward.tmpl
+	StoreForwardTmpl string
+	//go:embed bbs.tmpl
+	BbsTmpl string
+	//go:embed traceroute.tmpl
+	TracerouteTmpl string
+	//go:embed waypoint.tmpl
+	WaypointTmpl string
+	//go:embed atak.tmpl
+	AtakTmpl string
+	//go:embed telemetry.tmpl
+	TelemetryTmpl string
 )
 
 var TEMPLATES = strings.Join([]string{
 	GlobalTmpl,
 	NodeInfoTmpl,
+	KeysTmpl,
+	ChannelTmpl,
+	AdminTmpl,
+	BotTmpl,
+	TextTmpl,
+	ChatTmpl,
+	StoreForwardTmpl,
+	BbsTmpl,
+	TracerouteTmpl,
+	WaypointTmpl,
+	AtakTmpl,
+	TelemetryTmpl,
 }, "\n")
 
 var Templates = template.Must(template.New("render").Parse(TEMPLATES))
@@ -35,6 +71,54 @@ func NodeInfoHelp(c *config.Config) string {
 	return Render("NodeInfoHelp", c)
 }
 
+func KeysHelp(c *config.Config) string {
+	return Render("KeysHelp", c)
+}
+
+func ChannelHelp(c *config.Config) string {
+	return Render("ChannelHelp", c)
+}
+
+func AdminHelp(c *config.Config) string {
+	return Render("AdminHelp", c)
+}
+
+func BotHelp(c *config.Config) string {
+	return Render("BotHelp", c)
+}
+
+func TextHelp(c *config.Config) string {
+	return Render("TextHelp", c)
+}
+
+func ChatHelp(c *config.Config) string {
+	return Render("ChatHelp", c)
+}
+
+func StoreForwardHelp(c *config.Config) string {
+	return Render("StoreForwardHelp", c)
+}
+
+func BbsHelp(c *config.Config) string {
+	return Render("BbsHelp", c)
+}
+
+func TracerouteHelp(c *config.Config) string {
+	return Render("TracerouteHelp", c)
+}
+
+func WaypointHelp(c *config.Config) string {
+	return Render("WaypointHelp", c)
+}
+
+func AtakHelp(c *config.Config) string {
+	return Render("AtakHelp", c)
+}
+
+func TelemetryHelp(c *config.Config) string {
+	return Render("TelemetryHelp", c)
+}
+
 func Render(name string, c *config.Config) string {
 	name = RegexSafeName.ReplaceAllString(name, "")
 
@@ -0,0 +1,205 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type KeysCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewKeys(c *config.Config) (k *KeysCmd) {
+	k = new(KeysCmd)
+	k.Config = c
+
+	return k
+}
+
+func (k *KeysCmd) Help(cmd *cobra.Command, argz []string) {
+	k.CmdOutput.WasSuccess = true
+	fmt.Fprintln(k.Config.Stdout, help.KeysHelp(k.Config))
+}
+
+// Generate creates a new X25519 keypair and prints it, nothing is written to disk.
+func (k *KeysCmd) Generate(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.Generate")
+
+	publicKey, privateKey, err := internal.GenerateKeyPair()
+	if err != nil {
+		k.Config.Log.Errorf("failed to generate keypair: %v", err)
+		return
+	}
+
+	k.printKeys(publicKey, privateKey)
+	k.CmdOutput.WasSuccess = true
+}
+
+// PublicKey derives the public key from a private key passed as an argument, on stdin or from the config.
+func (k *KeysCmd) PublicKey(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.PublicKey")
+
+	privateKeyStr := k.Config.NodeInfo.PKI.PrivateKey
+	if len(argz) > 0 {
+		privateKeyStr = argz[0]
+	} else if len(k.Config.Stdin) > 0 {
+		privateKeyStr = string(k.Config.Stdin)
+	}
+
+	privateKey, err := internal.ParseKey(privateKeyStr)
+	if err != nil {
+		k.Config.Log.Errorf("failed to read private key: %v", err)
+		fmt.Fprintf(k.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	publicKey, err := internal.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		k.Config.Log.Errorf("failed to derive public key: %v", err)
+		fmt.Fprintf(k.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(k.Config.Stdout, "PublicKey: \"%s\"  (base64: %s)\n", internal.FormatKey(publicKey), base64.StdEncoding.EncodeToString(publicKey))
+	k.CmdOutput.WasSuccess = true
+}
+
+// Verify checks that the configured NodeInfo.PKI.PublicKey belongs to NodeInfo.PKI.PrivateKey.
+func (k *KeysCmd) Verify(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.Verify")
+
+	privateKey, err := internal.ParseKey(k.Config.NodeInfo.PKI.PrivateKey)
+	if err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ NodeInfo.PKI.PrivateKey is invalid: %v\n", err)
+		return
+	}
+	configured, err := internal.ParseKey(k.Config.NodeInfo.PKI.PublicKey)
+	if err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ NodeInfo.PKI.PublicKey is invalid: %v\n", err)
+		return
+	}
+	derived, err := internal.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ NodeInfo.PKI.PrivateKey is invalid: %v\n", err)
+		return
+	}
+
+	if !bytes.Equal(configured, derived) {
+		k.Config.Log.Warnf("configured public key %s does not match private key (expected %s)", internal.FormatKey(configured), internal.FormatKey(derived))
+		fmt.Fprintf(k.Config.Stdout, "❌ PublicKey does not match PrivateKey\n   configured: %s\n   derived:    %s\n", internal.FormatKey(configured), internal.FormatKey(derived))
+		return
+	}
+
+	fmt.Fprintf(k.Config.Stdout, "✅ PublicKey matches PrivateKey: %s\n", internal.FormatKey(configured))
+	k.CmdOutput.WasSuccess = true
+}
+
+// Rotate generates a new keypair and writes it into NodeInfo.PKI of a config file.
+// The file is the first argument, otherwise the '-c' config file, otherwise ./meshtk.yaml
+func (k *KeysCmd) Rotate(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.Rotate")
+
+	filename := k.Config.ConfigFileName
+	if len(argz) > 0 {
+		filename = argz[0]
+	}
+	if filename == "" {
+		filename = filepath.Join(k.Config.Cwd, "meshtk.yaml")
+	}
+
+	publicKey, privateKey, err := internal.GenerateKeyPair()
+	if err != nil {
+		k.Config.Log.Errorf("failed to generate keypair: %v", err)
+		return
+	}
+
+	err = WriteKeys(filename, internal.FormatKey(publicKey), internal.FormatKey(privateKey))
+	if err != nil {
+		k.Config.Log.Errorf("failed to write keys to %s: %v", filename, err)
+		fmt.Fprintf(k.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	k.Config.Log.Infof("rotated PKI keys in %s", filename)
+	fmt.Fprintf(k.Config.Stdout, "🔑 Rotated keys in %s\n", filename)
+	k.printKeys(publicKey, privateKey)
+	k.CmdOutput.WasSuccess = true
+}
+
+// Pins lists nodes whose public key changed, with any pending (rejected) key awaiting trust
+func (k *KeysCmd) Pins(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.Pins")
+
+	nodes := make(internal.NodeDB)
+	if err := nodes.LoadFile(k.Config.NodeDbPath); err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ failed to load %s: %v\n", k.Config.NodeDbPath, err)
+		return
+	}
+	for num, node := range nodes {
+		if node.PubKeyChanges == 0 && node.PendingPubKey == "" {
+			continue
+		}
+		fmt.Fprintf(k.Config.Stdout, "!%08x %-6s changes:%d pinned:%s since:%s\n", num, node.ShortName, node.PubKeyChanges, node.PubKey, time.Unix(node.PubKeyFirstSeen, 0).Format(time.RFC3339))
+		if node.PendingPubKey != "" {
+			fmt.Fprintf(k.Config.Stdout, "          ⚠️  pending:%s (meshtk keys trust !%08x)\n", node.PendingPubKey, num)
+		}
+	}
+	k.CmdOutput.WasSuccess = true
+}
+
+// Trust promotes a node's pending (rejected) public key to be its pinned key
+func (k *KeysCmd) Trust(cmd *cobra.Command, argz []string) {
+	k.Config.Log.Trace("KeysCmd.Trust")
+
+	if len(argz) == 0 {
+		fmt.Fprintln(k.Config.Stdout, "❌ node id required, eg. meshtk keys trust !28a1b2c3")
+		return
+	}
+	num, err := internal.ParseNodeId(argz[0])
+	if err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	nodes := make(internal.NodeDB)
+	if err := nodes.LoadFile(k.Config.NodeDbPath); err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ failed to load %s: %v\n", k.Config.NodeDbPath, err)
+		return
+	}
+	node, exists := nodes[num]
+	if !exists || !node.TrustPendingPubKey() {
+		fmt.Fprintf(k.Config.Stdout, "❌ !%08x has no pending public key\n", num)
+		return
+	}
+	if err := nodes.WriteFile(k.Config.NodeDbPath); err != nil {
+		fmt.Fprintf(k.Config.Stdout, "❌ failed to write %s: %v\n", k.Config.NodeDbPath, err)
+		return
+	}
+
+	k.Config.Log.Infof("trusted new public key %s for !%08x", node.PubKey, num)
+	fmt.Fprintf(k.Config.Stdout, "✅ !%08x now pinned to %s\n", num, node.PubKey)
+	k.CmdOutput.WasSuccess = true
+}
+
+func (k *KeysCmd) printKeys(publicKey, privateKey []byte) {
+	fmt.Fprintf(k.Config.Stdout, "NodeInfo:\n  PKI:\n    PublicKey: \"%s\"\n    PrivateKey: \"%s\"\n", internal.FormatKey(publicKey), internal.FormatKey(privateKey))
+	fmt.Fprintf(k.Config.Stdout, "# base64 public key (as shown in the meshtastic apps): %s\n", base64.StdEncoding.EncodeToString(publicKey))
+}
+
+// WriteKeys sets NodeInfo.PKI.PublicKey/PrivateKey in a yaml config file, keeping the rest of the file.
+func WriteKeys(filename, publicKey, privateKey string) error {
+	return config.UpdateFile(filename, map[string]any{
+		"NodeInfo.PKI.PublicKey":  publicKey,
+		"NodeInfo.PKI.PrivateKey": privateKey,
+	}, "NodeInfo.PKI.PublicKey", "NodeInfo.PKI.PrivateKey")
+}
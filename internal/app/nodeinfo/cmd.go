@@ -16,9 +16,11 @@ import (
 
 type NodeInfoCmd struct {
 	Nodes      internal.NodeDB
+	Waypoints  internal.WaypointDB // kept with the NodeDB and guarded by NodesMutex
 	NodesMutex sync.Mutex
 	Config     *config.Config
 	MqttClient *internal.MqttClient
+	KeyPolicy  internal.KeyPolicy // NodeInfo.PKI.KeyChangePolicy, checked by Listen
 	CmdOutput  struct {
 		WasSuccess bool
 	}
@@ -28,6 +30,7 @@ func NewNodeInfo(c *config.Config) (n *NodeInfoCmd) {
 	n = new(NodeInfoCmd)
 	n.Config = c
 	n.Nodes = make(internal.NodeDB)
+	n.Waypoints = make(internal.WaypointDB)
 
 	return n
 }
@@ -44,14 +47,10 @@ func (n *NodeInfoCmd) Announce(cmd *cobra.Command, argz []string) {
 	n.Config.Log.Trace("NodeInfoCmd.Announce")
 	n.Config.Log.Tracef("%+v", n.Config)
 
-	n.initNodeDb()
-
-	topics := n.Config.NodeInfo.SubscribedTopics
-
-	n.MqttClient = internal.NewMqttClient(n.Config, &n.Nodes)
-
-	n.MqttClient.SetMessageHandler(n.NodeHandler)
-	n.MqttClient.ConnectAndListen(topics)
+	if err := n.Listen(); err != nil {
+		fmt.Fprintf(n.Config.Stdout, "❌ %v\n", err)
+		return
+	}
 
 	if n.Config.NodeInfo.BroadcastOnLoad {
 		n.Config.Stdout.Write([]byte("🚀 Doing a Broadcasting onLoad()"))
@@ -81,6 +80,36 @@ func (n *NodeInfoCmd) Announce(cmd *cobra.Command, argz []string) {
 	n.CmdOutput.WasSuccess = true
 }
 
+// Listen loads the NodeDB and connects to the broker, tracking nodes and the ledger from every packet.
+// Commands built on the virtual node pass their own packet handlers, registered before subscribing.
+func (n *NodeInfoCmd) Listen(handlers ...func(p *internal.Packet)) error {
+	policy, err := internal.ParseKeyPolicy(n.Config.NodeInfo.PKI.KeyChangePolicy)
+	if err != nil {
+		return fmt.Errorf("NodeInfo.PKI: %v", err)
+	}
+	n.KeyPolicy = policy
+	n.initNodeDb()
+
+	topics := n.Config.NodeInfo.SubscribedTopics
+
+	n.MqttClient = internal.NewMqttClient(n.Config, &n.Nodes)
+
+	n.MqttClient.SetMessageHandler(n.NodeHandler)
+	n.MqttClient.SetDuplicateHandler(n.DuplicateHandler)
+	n.MqttClient.AddPacketHandler(n.TextHandler)
+	n.MqttClient.AddPacketHandler(n.TracerouteHandler)
+	for _, handler := range handlers {
+		n.MqttClient.AddPacketHandler(handler)
+	}
+	return n.MqttClient.ConnectAndListen(topics)
+}
+
+// Close disconnects from the broker and writes out the NodeDB
+func (n *NodeInfoCmd) Close() {
+	n.MqttClient.Disconnect()
+	n.flushNodeDb()
+}
+
 func (n *NodeInfoCmd) DoBroadcast() {
 	fromMeshHex := n.Config.NodeInfo.ClientId
 	fromUint, err := strconv.ParseUint(fromMeshHex[1:], 16, 32) // We start at 1 to skip the '!' base16 for 4 bytes
@@ -104,7 +133,7 @@ func (n *NodeInfoCmd) DoBroadcast() {
 	n.MqttClient.PublishNodeInfo(from, ALL, whoamiTopic, n.Config.NodeInfo.LongName, n.Config.NodeInfo.ShortName, meshtastic.HardwareModel(n.Config.NodeInfo.HWModelId), meshtastic.Config_DeviceConfig_CLIENT)
 	n.MqttClient.PublishPosition(from, ALL, whoamiTopic, lat, lng, alt, prec)
 
-	n.MqttClient.PublishMessageEncrypted(from, ALL, whoamiTopic, meshtastic.PortNum_TEXT_MESSAGE_APP, []byte{'h', 'e', 'l', 'l', 'o', ' ', 'w', 'o', 'r', 'l', 'd'})
+	n.MqttClient.PublishMessageEncrypted(from, ALL, whoamiTopic, meshtastic.PortNum_TEXT_MESSAGE_APP, []byte(n.Config.NodeInfo.BroadcastMessage))
 
 	// NOTE: We don't want to publish the map report here, as it is not needed and unencrypted
 	mapTopic := n.Config.NodeInfo.MapTopic
@@ -119,19 +148,26 @@ func (n *NodeInfoCmd) DoBroadcast() {
 
 func (n *NodeInfoCmd) initNodeDb() {
 	n.Nodes.LoadFile(n.Config.NodeDbPath)
+	n.Waypoints.LoadFile(n.Config.Waypoint.DbPath)
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 		for range ticker.C {
-			n.NodesMutex.Lock()
-			n.Nodes.WriteFile(n.Config.NodeDbPath)
-			n.NodesMutex.Unlock()
+			n.flushNodeDb()
 		}
 	}()
 }
 
+// flushNodeDb writes the NodeDB and the waypoint store. Waypoints are merged with the file first,
+// it may have changed under us, eg. 'waypoint create' from a script using the same ClientId.
 func (n *NodeInfoCmd) flushNodeDb() {
 	n.NodesMutex.Lock()
 	n.Nodes.WriteFile(n.Config.NodeDbPath)
+	onDisk := make(internal.WaypointDB)
+	if err := onDisk.LoadFile(n.Config.Waypoint.DbPath); err == nil {
+		n.Waypoints.Merge(onDisk)
+	}
+	n.Waypoints.Prune()
+	n.Waypoints.WriteFile(n.Config.Waypoint.DbPath)
 	n.NodesMutex.Unlock()
 }
@@ -0,0 +1,37 @@
+package nodeinfo
+
+import (
+	"testing"
+	"time"
+
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+)
+
+// A long running process and a 'waypoint create' script share the waypoint store
+func TestFlushKeepsWaypointsFromOtherProcesses(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := mqtttest.Config()
+	c.NodeDbPath = "meshtk.db"
+	c.Waypoint.DbPath = "waypoints.json"
+	now := time.Now().Unix()
+
+	running := NewNodeInfo(c)
+	running.Waypoints[1] = &internal.Waypoint{Id: 1, Name: "heard on the mesh", Updated: now}
+	running.flushNodeDb()
+
+	script := NewNodeInfo(c)
+	script.Waypoints.LoadFile(c.Waypoint.DbPath)
+	script.Waypoints[2] = &internal.Waypoint{Id: 2, From: mqtttest.Node, Name: "from a script", Updated: now}
+	script.flushNodeDb()
+
+	running.flushNodeDb()
+
+	stored := make(internal.WaypointDB)
+	if err := stored.LoadFile(c.Waypoint.DbPath); err != nil {
+		t.Fatal(err)
+	}
+	if stored[1] == nil || stored[2] == nil {
+		t.Errorf("stored %v, want both waypoints", stored)
+	}
+}
@@ -1,6 +1,8 @@
 package nodeinfo
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
@@ -21,14 +23,100 @@ type MessageLedger struct {
 	Topic         string             `json:"topic"`
 	PortNum       meshtastic.PortNum `json:"portNum"`
 	Payload       []byte             `json:"payload"`
+	Event         string             `json:"event,omitempty"` // security events like PUBKEY_CHANGED
+	PacketId      uint32             `json:"packetId,omitempty"`
+	ReplyId       uint32             `json:"replyId,omitempty"`      // the packet this one replies or reacts to
+	Emoji         bool               `json:"emoji,omitempty"`        // a tapback reaction, the payload is the emoji
+	StoreForward  uint32             `json:"storeForward,omitempty"` // the Store & Forward router that replayed it
+	Tak           *TakLedger         `json:"tak,omitempty"`          // a decoded ATAK plugin packet
+}
+
+// TakLedger is an ATAK plugin packet with its strings decompressed
+type TakLedger struct {
+	Kind           string `json:"kind"` // pli, chat, detail, or status with only the contact, group and battery
+	Callsign       string `json:"callsign,omitempty"`
+	DeviceCallsign string `json:"deviceCallsign,omitempty"`
+	Team           string `json:"team,omitempty"`
+	Role           string `json:"role,omitempty"`
+	Battery        uint32 `json:"battery,omitempty"`
+	// PLI
+	Latitude  int32  `json:"latitude,omitempty"`
+	Longitude int32  `json:"longitude,omitempty"`
+	Altitude  int32  `json:"altitude,omitempty"`
+	Speed     uint32 `json:"speed,omitempty"`
+	Course    uint32 `json:"course,omitempty"`
+	// GeoChat
+	Message    string `json:"message,omitempty"`
+	To         string `json:"to,omitempty"`
+	ToCallsign string `json:"toCallsign,omitempty"`
+	// Detail is raw CoT detail XML, maybe compressed or truncated by the sender
+	Detail []byte `json:"detail,omitempty"`
+}
+
+func NewTakLedger(tak *meshtastic.TAKPacket) *TakLedger {
+	t := &TakLedger{
+		Kind:           "status",
+		Callsign:       tak.GetContact().GetCallsign(),
+		DeviceCallsign: tak.GetContact().GetDeviceCallsign(),
+		Battery:        tak.GetStatus().GetBattery(),
+		Detail:         tak.GetDetail(),
+	}
+	if t.Detail != nil {
+		t.Kind = "detail"
+	}
+	if group := tak.GetGroup(); group != nil {
+		t.Team, t.Role = group.GetTeam().String(), group.GetRole().String()
+	}
+	if pli := tak.GetPli(); pli != nil {
+		t.Kind = "pli"
+		t.Latitude, t.Longitude, t.Altitude = pli.GetLatitudeI(), pli.GetLongitudeI(), pli.GetAltitude()
+		t.Speed, t.Course = pli.GetSpeed(), pli.GetCourse()
+	}
+	if chat := tak.GetChat(); chat != nil {
+		t.Kind = "chat"
+		t.Message, t.To, t.ToCallsign = chat.GetMessage(), chat.GetTo(), chat.GetToCallsign()
+	}
+	return t
 }
 
 var sequence uint32
 
 func (n *NodeInfoCmd) AddMessageLedger(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte) {
+	n.AddLedgerEvent(to, from, topic, portNum, payload, "")
+}
+
+// AddLedgerEvent records a message in the ledger along with an event, eg. a public key change
+func (n *NodeInfoCmd) AddLedgerEvent(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte, event string) {
+	n.addLedger(MessageLedger{
+		To:      to,
+		From:    from,
+		Topic:   topic,
+		PortNum: portNum,
+		Payload: payload,
+		Event:   event,
+	})
+}
+
+// AddPacketLedger records a packet with its id and the packet it replies or reacts to,
+// so that conversations can be rebuilt from the ledger
+func (n *NodeInfoCmd) AddPacketLedger(p *mqtt.Packet) {
+	n.addLedger(MessageLedger{
+		To:       p.To,
+		From:     p.From,
+		Topic:    p.Topic,
+		PortNum:  p.PortNum,
+		Payload:  p.Payload,
+		PacketId: p.Id,
+		ReplyId:  p.ReplyId,
+		Emoji:    p.Emoji != 0,
+	})
+}
+
+func (n *NodeInfoCmd) addLedger(message MessageLedger) {
 	MessagesMutex.Lock()
 	defer MessagesMutex.Unlock()
 
+	from, to, topic, event := message.From, message.To, message.Topic, message.Event
 	fromNode := n.Nodes[from]
 	toNode := n.Nodes[to]
 
@@ -39,40 +127,201 @@ func (n *NodeInfoCmd) AddMessageLedger(to, from uint32, topic string, portNum me
 		toNode = mqtt.NewNode(topic)
 		toNode.ShortName = "ALL"
 	}
-	message := MessageLedger{
-		Sequence:      sequence,
-		DateTimeStamp: time.Now().Unix(),
-		To:            to,
-		ToNode:        *toNode,
-		FromNode:      *fromNode,
-		From:          from,
-		Topic:         topic,
-		PortNum:       portNum,
-		Payload:       payload,
+	message.Sequence = sequence
+	if message.DateTimeStamp == 0 {
+		message.DateTimeStamp = time.Now().Unix()
 	}
+	message.FromNode = *fromNode
+	message.ToNode = *toNode
 
 	Messages = append(Messages, message)
 
 	file, err := os.OpenFile("message_ledger.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err == nil {
 		defer file.Close()
-		logMessage := fmt.Sprintf("%d,%v,[%s:!%08x]->%v->[%s:!%08x]:%s\n", sequence, message.DateTimeStamp, fromNode.ShortName, from, message.PortNum, toNode.ShortName, to, message.Topic)
+		logMessage := fmt.Sprintf("%d,%v,[%s:!%08x]->%v->[%s:!%08x]:%s", sequence, message.DateTimeStamp, fromNode.ShortName, from, message.PortNum, toNode.ShortName, to, message.Topic)
+		if event != "" {
+			logMessage += ":" + event
+		}
+		if message.Emoji {
+			logMessage += fmt.Sprintf(":reaction=%d", message.ReplyId)
+		} else if message.ReplyId != 0 {
+			logMessage += fmt.Sprintf(":reply=%d", message.ReplyId)
+		}
+		if message.StoreForward != 0 {
+			logMessage += fmt.Sprintf(":sf=!%08x", message.StoreForward)
+		}
+		if message.Tak != nil {
+			logMessage += fmt.Sprintf(":tak=%s:%s", message.Tak.Kind, message.Tak.Callsign)
+		}
+		logMessage += "\n"
 		file.WriteString(logMessage)
 	} else {
 		fmt.Printf("Failed to write to log file: %v\n", err)
 	}
+	if message.PortNum == meshtastic.PortNum_TEXT_MESSAGE_APP {
+		appendTextLedger(message)
+	}
 	sequence++
 }
 
+// TextHandler records text messages in the ledger with their packet ids
+func (n *NodeInfoCmd) TextHandler(p *mqtt.Packet) {
+	if p.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP {
+		return
+	}
+	if p.Emoji != 0 {
+		n.Config.Log.Tracef(`{'from': '!%08x', 'topic': '%v', 'reaction': '%s', 'replyId': %d}`, p.From, p.Topic, p.Payload, p.ReplyId)
+	} else if p.ReplyId != 0 {
+		n.Config.Log.Tracef(`{'from': '!%08x', 'topic': '%v', 'message': '%s', 'replyId': %d}`, p.From, p.Topic, p.Payload, p.ReplyId)
+	}
+	n.AddPacketLedger(p)
+}
+
+// TracerouteHandler records traceroutes in the ledger, and the paths in every response as routes on
+// the NodeDB: the requester's route to the destination and, from newer firmware, the route back
+func (n *NodeInfoCmd) TracerouteHandler(p *mqtt.Packet) {
+	if p.PortNum != meshtastic.PortNum_TRACEROUTE_APP {
+		return
+	}
+	var route meshtastic.RouteDiscovery
+	if err := proto.Unmarshal(p.Payload, &route); err != nil {
+		n.Config.Log.Warnf(`{error: '%v', from: '%v', topic: '%v'}`, err, p.From, p.Topic)
+		return
+	}
+	n.Config.Log.Tracef(`{'from': '!%08x', 'to': '!%08x', 'topic': '%v', 'requestId': %d, 'route': %v, 'snrTowards': %v, 'routeBack': %v, 'snrBack': %v}`, p.From, p.To, p.Topic, p.RequestId, route.GetRoute(), route.GetSnrTowards(), route.GetRouteBack(), route.GetSnrBack())
+
+	n.NodesMutex.Lock()
+	defer n.NodesMutex.Unlock()
+	if p.RequestId != 0 && p.To != mqtt.BroadcastAddr {
+		if n.Nodes[p.From] == nil {
+			n.Nodes[p.From] = mqtt.NewNode(p.Topic)
+		}
+		if n.Nodes[p.To] == nil {
+			n.Nodes[p.To] = mqtt.NewNode(p.Topic)
+		}
+		n.Nodes[p.To].UpdateRoute(p.From, route.GetRoute(), route.GetSnrTowards())
+		if len(route.GetRouteBack()) > 0 || len(route.GetSnrBack()) > 0 {
+			n.Nodes[p.From].UpdateRoute(p.To, route.GetRouteBack(), route.GetSnrBack())
+		}
+		n.Nodes[p.From].UpdateSeenBy(p.Topic)
+	}
+	n.AddMessageLedger(p.To, p.From, p.Topic, p.PortNum, p.Payload)
+}
+
+// AddStoreForwardLedger records text replayed by a Store & Forward router, dated when the router heard it
+func (n *NodeInfoCmd) AddStoreForwardLedger(p *mqtt.Packet, router uint32) {
+	n.addLedger(MessageLedger{
+		DateTimeStamp: int64(p.RxTime),
+		To:            p.To,
+		From:          p.From,
+		Topic:         p.Topic,
+		PortNum:       p.PortNum,
+		Payload:       p.Payload,
+		PacketId:      p.Id,
+		ReplyId:       p.ReplyId,
+		Emoji:         p.Emoji != 0,
+		StoreForward:  router,
+	})
+}
+
+// AddTakLedger records an ATAK plugin packet along with what it decoded to
+func (n *NodeInfoCmd) AddTakLedger(to, from uint32, topic string, payload []byte, tak *TakLedger) {
+	n.addLedger(MessageLedger{
+		To:      to,
+		From:    from,
+		Topic:   topic,
+		PortNum: meshtastic.PortNum_ATAK_PLUGIN,
+		Payload: payload,
+		Tak:     tak,
+	})
+}
+
+// AddSentLedger records a packet we sent along with its final delivery state
+func (n *NodeInfoCmd) AddSentLedger(d *mqtt.Delivery, topic string) {
+	n.AddPacketLedger(&mqtt.Packet{
+		Id:      d.PacketId,
+		From:    n.MqttClient.NodeNum(),
+		To:      d.To,
+		Topic:   topic,
+		PortNum: d.Data.GetPortnum(),
+		Payload: d.Data.GetPayload(),
+		ReplyId: d.Data.GetReplyId(),
+		Emoji:   d.Data.GetEmoji(),
+	})
+	n.AddDeliveryEvent(d, topic)
+}
+
+// AddDeliveryEvent records the final state of a packet we sent, eg. DELIVERED or NAK:NO_CHANNEL
+func (n *NodeInfoCmd) AddDeliveryEvent(d *mqtt.Delivery, topic string) {
+	n.AddLedgerEvent(d.To, n.MqttClient.NodeNum(), topic, meshtastic.PortNum_ROUTING_APP, nil, fmt.Sprintf("%s:%d", d, d.PacketId))
+}
+
+// TextLedgerFile keeps text messages (with their payload) as JSON lines for chat scrollback
+const TextLedgerFile = "message_ledger.jsonl"
+
+func appendTextLedger(message MessageLedger) {
+	// Only the names are needed to show the message later, not the whole node
+	message.FromNode = mqtt.Node{From: message.From, LongName: message.FromNode.LongName, ShortName: message.FromNode.ShortName}
+	message.ToNode = mqtt.Node{From: message.To, LongName: message.ToNode.LongName, ShortName: message.ToNode.ShortName}
+	line, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Failed to serialize text ledger entry: %v\n", err)
+		return
+	}
+	file, err := os.OpenFile(TextLedgerFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("Failed to write to text ledger file: %v\n", err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+}
+
+// ReadTextLedger returns the last 'limit' text messages from the text ledger, oldest first
+func ReadTextLedger(limit int) ([]MessageLedger, error) {
+	file, err := os.Open(TextLedgerFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []MessageLedger
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var message MessageLedger
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		messages = append(messages, message)
+		if limit > 0 && len(messages) > limit {
+			messages = messages[1:]
+		}
+	}
+	return messages, scanner.Err()
+}
+
 var Messages []MessageLedger
 var MessagesMutex sync.Mutex
 
+// DuplicateHandler counts a copy of a node's packet that another gateway or topic already delivered
+func (n *NodeInfoCmd) DuplicateHandler(from uint32, gateway, topic string) {
+	n.NodesMutex.Lock()
+	defer n.NodesMutex.Unlock()
+	if node := n.Nodes[from]; node != nil {
+		node.AddDuplicate(topic)
+	}
+}
+
 // NodeHandler is the callback function for handling incoming messages from the MQTT client.
 func (n *NodeInfoCmd) NodeHandler(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte) {
 	switch portNum {
 	case meshtastic.PortNum_TEXT_MESSAGE_APP:
 		n.Config.Log.Tracef(`{from: '%v', topic: '%v', message: '%s'}`, from, topic, payload)
-		n.AddMessageLedger(to, from, topic, portNum, payload)
+		// Recorded by TextHandler, which also has the packet, reply and reaction ids
 
 	case meshtastic.PortNum_POSITION_APP:
 		var position meshtastic.Position
@@ -119,8 +368,20 @@ func (n *NodeInfoCmd) NodeHandler(to, from uint32, topic string, portNum meshtas
 		if n.Nodes[from] == nil {
 			n.Nodes[from] = mqtt.NewNode(topic)
 		}
-		n.Nodes[from].UpdateUser(from, longName, shortName, hwModel, role, pubkey)
-		n.AddMessageLedger(to, from, topic, portNum, payload)
+		previousKey := n.Nodes[from].PubKey
+		policy := n.KeyPolicy
+		keyEvent := n.Nodes[from].UpdateUser(from, longName, shortName, hwModel, role, pubkey, policy)
+		switch {
+		case keyEvent == mqtt.KeyChanged && policy == mqtt.KeyPolicyAccept:
+			n.Config.Log.Infof(`{'security': '%s', 'from': '!%08x', 'longName': '%v', 'topic': '%v', 'previous': '%s', 'pubkey': '%s', 'policy': '%s'}`, keyEvent, from, longName, topic, previousKey, n.Nodes[from].PubKey, policy)
+		case keyEvent == mqtt.KeyChanged:
+			n.Config.Log.Warnf(`{'security': '%s', 'from': '!%08x', 'longName': '%v', 'topic': '%v', 'previous': '%s', 'pubkey': '%s', 'policy': '%s'}`, keyEvent, from, longName, topic, previousKey, n.Nodes[from].PubKey, policy)
+		case keyEvent == mqtt.KeyRejected:
+			n.Config.Log.Warnf(`{'security': '%s', 'from': '!%08x', 'longName': '%v', 'topic': '%v', 'pinned': '%s', 'pubkey': '%s', 'policy': '%s'}`, keyEvent, from, longName, topic, previousKey, n.Nodes[from].PendingPubKey, policy)
+		case keyEvent == mqtt.KeyPinned:
+			n.Config.Log.Debugf(`{'security': '%s', 'from': '!%08x', 'longName': '%v', 'pubkey': '%s'}`, keyEvent, from, longName, n.Nodes[from].PubKey)
+		}
+		n.AddLedgerEvent(to, from, topic, portNum, payload, string(keyEvent))
 		n.NodesMutex.Unlock()
 	case meshtastic.PortNum_TELEMETRY_APP:
 		var telemetry meshtastic.Telemetry
@@ -249,12 +510,76 @@ func (n *NodeInfoCmd) NodeHandler(to, from uint32, topic string, portNum meshtas
 		if n.Nodes[from] == nil {
 			n.Nodes[from] = mqtt.NewNode(topic)
 		}
-		n.Nodes[from].UpdateUser(from, longName, shortName, hwModel, role, nil)
+		n.Nodes[from].UpdateUser(from, longName, shortName, hwModel, role, nil, n.KeyPolicy)
 		n.Nodes[from].UpdateMapReport(fwVersion, region, modemPreset, hasDefaultCh, onlineLocalNodes)
 		n.Nodes[from].UpdatePosition(latitude, longitude, altitude, precision)
 		n.Nodes[from].UpdateSeenBy(topic)
 		n.AddMessageLedger(to, from, topic, portNum, payload)
 		n.NodesMutex.Unlock()
+	case meshtastic.PortNum_ROUTING_APP:
+		var routing meshtastic.Routing
+		if err := proto.Unmarshal(payload, &routing); err != nil {
+			n.Config.Log.Warnf(`{error: '%v', from: '%v', topic: '%v'}`, err, from, topic)
+			return
+		}
+		reason := routing.GetErrorReason()
+		n.Config.Log.Tracef(`{'from': '%v', 'to': '%v', 'topic': '%v', 'portNum': '%s', 'errorReason': '%s'}`, from, to, topic, portNum, reason)
+		n.AddLedgerEvent(to, from, topic, portNum, payload, reason.String())
+	case meshtastic.PortNum_STORE_FORWARD_APP:
+		var sf meshtastic.StoreAndForward
+		if err := proto.Unmarshal(payload, &sf); err != nil {
+			n.Config.Log.Warnf(`{error: '%v', from: '%v', topic: '%v'}`, err, from, topic)
+			return
+		}
+		n.Config.Log.Tracef(`{'from': '%v', 'to': '%v', 'topic': '%v', 'portNum': '%s', 'rr': '%s'}`, from, to, topic, portNum, sf.GetRr())
+		n.NodesMutex.Lock()
+		// Replayed text keeps the original sender, only a heartbeat says the sender is a router
+		if sf.GetRr() == meshtastic.StoreAndForward_ROUTER_HEARTBEAT {
+			if n.Nodes[from] == nil {
+				n.Nodes[from] = mqtt.NewNode(topic)
+			}
+			n.Nodes[from].UpdateStoreForward(sf.GetHeartbeat().GetPeriod())
+			n.Nodes[from].UpdateSeenBy(topic)
+		}
+		n.AddMessageLedger(to, from, topic, portNum, payload)
+		n.NodesMutex.Unlock()
+	case meshtastic.PortNum_WAYPOINT_APP:
+		var waypoint meshtastic.Waypoint
+		if err := proto.Unmarshal(payload, &waypoint); err != nil {
+			n.Config.Log.Warnf(`{error: '%v', from: '%v', topic: '%v'}`, err, from, topic)
+			return
+		}
+		n.Config.Log.Tracef(`{'from': '%v', 'topic': '%v', 'portNum': '%s', 'id': %v, 'name': '%v', 'latitude': %v, 'longitude': %v, 'expire': %v, 'lockedTo': %v}`, from, topic, portNum, waypoint.GetId(), waypoint.GetName(), waypoint.GetLatitudeI(), waypoint.GetLongitudeI(), waypoint.GetExpire(), waypoint.GetLockedTo())
+		n.NodesMutex.Lock()
+		if err := n.Waypoints.Update(mqtt.NewWaypoint(from, topic, &waypoint)); err != nil {
+			n.Config.Log.Warnf(`{error: '%v', from: '!%08x', topic: '%v'}`, err, from, topic)
+		}
+		n.AddMessageLedger(to, from, topic, portNum, payload)
+		n.NodesMutex.Unlock()
+	case meshtastic.PortNum_ATAK_PLUGIN:
+		packet, err := mqtt.DecodeTAKPacket(payload)
+		if err != nil {
+			n.Config.Log.Warnf(`{error: '%v', from: '%v', topic: '%v'}`, err, from, topic)
+			return
+		}
+		tak := NewTakLedger(packet)
+		n.Config.Log.Tracef(`{'from': '%v', 'topic': '%v', 'portNum': '%s', 'kind': '%s', 'callsign': '%v', 'team': '%v', 'latitude': %v, 'longitude': %v, 'message': '%v'}`, from, topic, portNum, tak.Kind, tak.Callsign, tak.Team, tak.Latitude, tak.Longitude, tak.Message)
+		n.NodesMutex.Lock()
+		if n.Nodes[from] == nil {
+			n.Nodes[from] = mqtt.NewNode(topic)
+		}
+		if tak.Callsign != "" {
+			n.Nodes[from].UpdateTak(tak.Callsign, tak.Team)
+		}
+		if tak.Kind == "pli" && (tak.Latitude != 0 || tak.Longitude != 0) {
+			n.Nodes[from].UpdatePosition(tak.Latitude, tak.Longitude, tak.Altitude, 32)
+		}
+		n.Nodes[from].UpdateSeenBy(topic)
+		n.AddTakLedger(to, from, topic, payload, tak)
+		n.NodesMutex.Unlock()
+	case meshtastic.PortNum_TRACEROUTE_APP:
+		n.Config.Log.Tracef(`{'from': '%v', 'to': '%v', 'topic': '%v', 'portNum': '%s'}`, from, to, topic, portNum)
+		// Recorded by TracerouteHandler, which needs the request id to tell a response from a request
 	default:
 		n.AddMessageLedger(to, from, topic, portNum, payload)
 		n.Config.Log.Tracef(`{from: '%v', topic: '%v', portNum: '%s'}`, from, topic, portNum)
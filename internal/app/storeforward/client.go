@@ -0,0 +1,337 @@
+package storeforward
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrBusy     = errors.New("router is busy replaying to another client")
+	ErrRefused  = errors.New("router refused the request")
+	ErrNoRouter = errors.New("no Store & Forward router heard")
+)
+
+// Router is a node that announced itself with a Store & Forward heartbeat
+type Router struct {
+	Node          uint32
+	Name          string
+	Period        uint32 // seconds between heartbeats
+	LastHeartbeat time.Time
+}
+
+// History is how a request for history went
+type History struct {
+	Router     uint32
+	Window     time.Duration // what the router agreed to look back
+	Expected   int           // messages the router said it would replay
+	Received   int
+	Ingested   int // new messages added to the ledger
+	Duplicates int // already in the ledger, usually heard live
+}
+
+// Client asks Store & Forward routers for the channel text we missed. Replayed messages go into
+// the ledger marked with the router, unless we already have the packet.
+type Client struct {
+	Config  *config.Config
+	Node    *nodeinfo.NodeInfoCmd
+	Channel *internal.Channel
+	// Ingested is called with every replayed message new to the ledger, eg. to show it in chat
+	Ingested func(p *internal.Packet)
+
+	mutex      sync.Mutex
+	seen       map[packetKey]bool // (from, packet id) of every text in the ledger
+	lastHeard  time.Time          // newest text in the ledger when we started
+	pending    *request
+	heartbeats chan uint32
+}
+
+type packetKey struct {
+	from uint32
+	id   uint32
+}
+
+// request is a CLIENT_HISTORY waiting on its ROUTER_HISTORY answer and replayed messages
+type request struct {
+	history  History
+	answered chan error
+	received chan struct{}
+}
+
+func NewClient(c *config.Config, ni *nodeinfo.NodeInfoCmd) (*Client, error) {
+	ch, err := channel(c)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		Config:     c,
+		Node:       ni,
+		Channel:    ch,
+		seen:       make(map[packetKey]bool),
+		heartbeats: make(chan uint32, 1),
+	}
+	ledger, err := nodeinfo.ReadTextLedger(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ledger {
+		if m.PacketId != 0 {
+			client.seen[packetKey{m.From, m.PacketId}] = true
+		}
+		if when := time.Unix(m.DateTimeStamp, 0); when.After(client.lastHeard) {
+			client.lastHeard = when
+		}
+	}
+	return client, nil
+}
+
+// PacketHandler tracks live text, heartbeats, and the answers and replays for our requests
+func (c *Client) PacketHandler(p *internal.Packet) {
+	switch p.PortNum {
+	case meshtastic.PortNum_TEXT_MESSAGE_APP:
+		c.mutex.Lock()
+		c.seen[packetKey{p.From, p.Id}] = true
+		c.mutex.Unlock()
+
+	case meshtastic.PortNum_STORE_FORWARD_APP:
+		var sf meshtastic.StoreAndForward
+		if err := proto.Unmarshal(p.Payload, &sf); err != nil {
+			c.Config.Log.Warnf("failed to parse StoreAndForward from !%08x: %v", p.From, err)
+			return
+		}
+		if sf.GetRr() == meshtastic.StoreAndForward_ROUTER_HEARTBEAT {
+			select {
+			case c.heartbeats <- p.From:
+			default:
+			}
+			return
+		}
+		if p.To != c.Node.MqttClient.NodeNum() {
+			return
+		}
+		switch sf.GetRr() {
+		case meshtastic.StoreAndForward_ROUTER_HISTORY, meshtastic.StoreAndForward_ROUTER_BUSY, meshtastic.StoreAndForward_ROUTER_ERROR:
+			c.answer(p.From, &sf)
+		case meshtastic.StoreAndForward_ROUTER_TEXT_BROADCAST, meshtastic.StoreAndForward_ROUTER_TEXT_DIRECT:
+			c.ingest(p, &sf)
+		default:
+			c.Config.Log.Debugf(`{'from': '!%08x', 'storeForward': '%v'}`, p.From, sf.GetRr())
+		}
+	}
+}
+
+func (c *Client) answer(router uint32, sf *meshtastic.StoreAndForward) {
+	c.mutex.Lock()
+	r := c.pending
+	if r == nil || r.history.Router != router {
+		c.mutex.Unlock()
+		return
+	}
+	var err error
+	switch sf.GetRr() {
+	case meshtastic.StoreAndForward_ROUTER_BUSY:
+		err = ErrBusy
+	case meshtastic.StoreAndForward_ROUTER_ERROR:
+		err = ErrRefused
+	default:
+		r.history.Expected = int(sf.GetHistory().GetHistoryMessages())
+		r.history.Window = time.Duration(sf.GetHistory().GetWindow()) * time.Millisecond
+	}
+	c.mutex.Unlock()
+
+	select {
+	case r.answered <- err:
+	default:
+	}
+}
+
+// ingest adds a replayed message to the ledger as the original text, at the time the router heard it
+func (c *Client) ingest(p *internal.Packet, sf *meshtastic.StoreAndForward) {
+	to := p.To
+	if sf.GetRr() == meshtastic.StoreAndForward_ROUTER_TEXT_BROADCAST {
+		to = internal.BroadcastAddr
+	}
+	text := &internal.Packet{
+		Id:        p.Id,
+		From:      p.From,
+		To:        to,
+		Topic:     p.Topic,
+		GatewayId: p.GatewayId,
+		ChannelId: p.ChannelId,
+		Channel:   p.Channel,
+		PortNum:   meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload:   sf.GetText(),
+		ReplyId:   p.ReplyId,
+		Emoji:     p.Emoji,
+		RxTime:    p.RxTime,
+	}
+
+	c.mutex.Lock()
+	key := packetKey{p.From, p.Id}
+	duplicate := c.seen[key]
+	c.seen[key] = true
+	r := c.pending
+	router, _ := internal.ParseNodeId(p.GatewayId)
+	if r != nil {
+		router = r.history.Router
+		r.history.Received++
+		if duplicate {
+			r.history.Duplicates++
+		} else {
+			r.history.Ingested++
+		}
+	}
+	c.mutex.Unlock()
+
+	if r != nil {
+		select {
+		case r.received <- struct{}{}:
+		default:
+		}
+	}
+	if duplicate {
+		c.Config.Log.Tracef(`{'from': '!%08x', 'packetId': %d, 'storeForward': 'duplicate'}`, p.From, p.Id)
+		return
+	}
+	c.Config.Log.Debugf(`{'from': '!%08x', 'packetId': %d, 'router': '!%08x', 'message': '%s'}`, p.From, p.Id, router, text.Payload)
+	c.Node.AddStoreForwardLedger(text, router)
+	if c.Ingested != nil {
+		c.Ingested(text)
+	}
+}
+
+// Routers are the nodes we've heard a Store & Forward heartbeat from, latest first
+func (c *Client) Routers() []Router {
+	c.Node.NodesMutex.Lock()
+	defer c.Node.NodesMutex.Unlock()
+
+	var routers []Router
+	for num, node := range c.Node.Nodes {
+		if node.LastStoreForward == 0 {
+			continue
+		}
+		routers = append(routers, Router{
+			Node:          num,
+			Name:          node.LongName,
+			Period:        node.StoreForwardPeriod,
+			LastHeartbeat: time.Unix(node.LastStoreForward, 0),
+		})
+	}
+	sort.Slice(routers, func(i, j int) bool {
+		return routers[i].LastHeartbeat.After(routers[j].LastHeartbeat)
+	})
+	return routers
+}
+
+// RequestHistory asks a router for the text sent in the last 'window' (0 lets the router decide) and
+// waits until everything is replayed, or the router goes quiet for StoreForward.HistoryTimeoutSec
+func (c *Client) RequestHistory(router uint32, window time.Duration) (*History, error) {
+	r := &request{
+		history:  History{Router: router},
+		answered: make(chan error, 1),
+		received: make(chan struct{}, 64),
+	}
+	c.mutex.Lock()
+	if c.pending != nil {
+		busy := c.pending.history.Router
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("already waiting for history from !%08x", busy)
+	}
+	c.pending = r
+	c.mutex.Unlock()
+
+	// The result is a copy, late replays still count towards the pending request until we're done
+	result := func() *History {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		history := r.history
+		return &history
+	}
+	defer func() {
+		c.mutex.Lock()
+		c.pending = nil
+		c.mutex.Unlock()
+	}()
+
+	minutes := uint32((window + time.Minute - 1) / time.Minute)
+	payload, err := proto.Marshal(&meshtastic.StoreAndForward{
+		Rr: meshtastic.StoreAndForward_CLIENT_HISTORY,
+		Variant: &meshtastic.StoreAndForward_History_{History: &meshtastic.StoreAndForward_History{
+			Window: minutes,
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize StoreAndForward: %v", err)
+	}
+	mc := c.Node.MqttClient
+	if err := mc.PublishMessageSlot(c.Channel.Slot, mc.NodeNum(), router, mc.GatewayTopic(c.Channel.Name), meshtastic.PortNum_STORE_FORWARD_APP, payload); err != nil {
+		return nil, err
+	}
+	c.Config.Log.Debugf(`{'to': '!%08x', 'storeForward': 'CLIENT_HISTORY', 'windowMin': %d}`, router, minutes)
+
+	timeout := time.Duration(c.Config.StoreForward.HistoryTimeoutSec) * time.Second
+	select {
+	case err := <-r.answered:
+		if err != nil {
+			return result(), err
+		}
+	case <-time.After(timeout):
+		return result(), fmt.Errorf("no answer from !%08x after %v", router, timeout)
+	}
+
+	for {
+		h := result()
+		if h.Received >= h.Expected {
+			return h, nil
+		}
+		select {
+		case <-r.received:
+		case <-time.After(timeout):
+			if h = result(); h.Received < h.Expected {
+				return h, fmt.Errorf("!%08x went quiet after %d of %d messages", router, h.Received, h.Expected)
+			}
+		}
+	}
+}
+
+// Backfill asks for the text we missed while meshtk wasn't running: everything since the newest ledger
+// message, or StoreForward.HistoryWindowMin, from StoreForward.Router or the router heard most recently.
+// When no router is known it waits StoreForward.DiscoverSec for a heartbeat.
+func (c *Client) Backfill() (*History, error) {
+	router, err := c.router()
+	if err != nil {
+		return nil, err
+	}
+	var window time.Duration
+	if c.Config.StoreForward.HistoryWindowMin > 0 {
+		window = time.Duration(c.Config.StoreForward.HistoryWindowMin) * time.Minute
+	} else if !c.lastHeard.IsZero() {
+		window = time.Since(c.lastHeard)
+	}
+	return c.RequestHistory(router, window)
+}
+
+func (c *Client) router() (uint32, error) {
+	if c.Config.StoreForward.Router != "" {
+		return internal.ParseNodeId(c.Config.StoreForward.Router)
+	}
+	if routers := c.Routers(); len(routers) > 0 {
+		return routers[0].Node, nil
+	}
+	wait := time.Duration(c.Config.StoreForward.DiscoverSec) * time.Second
+	c.Config.Log.Infof("waiting up to %v for a Store & Forward heartbeat", wait)
+	select {
+	case router := <-c.heartbeats:
+		return router, nil
+	case <-time.After(wait):
+		return 0, ErrNoRouter
+	}
+}
@@ -0,0 +1,53 @@
+package storeforward
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const testRouter = 0x33664ae0
+
+func TestRequestHistoryRefused(t *testing.T) {
+	t.Chdir(t.TempDir()) // the ledger is read from the working directory
+
+	c := mqtttest.Config()
+	c.StoreForward.ChannelSlot = "primary"
+	c.StoreForward.HistoryTimeoutSec = 30
+
+	ni := nodeinfo.NewNodeInfo(c)
+	ni.MqttClient = internal.NewMqttClient(c, &ni.Nodes)
+	rec := new(mqtttest.Recorder)
+	ni.MqttClient.SetClient(rec)
+	client, err := NewClient(c, ni)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.RequestHistory(testRouter, time.Hour)
+		done <- err
+	}()
+	for rec.Count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	payload, _ := proto.Marshal(&meshtastic.StoreAndForward{Rr: meshtastic.StoreAndForward_ROUTER_ERROR})
+	client.PacketHandler(&internal.Packet{Id: 9, From: testRouter, To: mqtttest.Node, PortNum: meshtastic.PortNum_STORE_FORWARD_APP, Payload: payload})
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRefused) {
+			t.Errorf("RequestHistory = %v, want ErrRefused", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ROUTER_ERROR didn't end the request")
+	}
+}
@@ -0,0 +1,157 @@
+package storeforward
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type StoreForwardCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewStoreForward(c *config.Config) (s *StoreForwardCmd) {
+	s = new(StoreForwardCmd)
+	s.Config = c
+
+	return s
+}
+
+func (s *StoreForwardCmd) Help(cmd *cobra.Command, argz []string) {
+	s.CmdOutput.WasSuccess = true
+	fmt.Fprintln(s.Config.Stdout, help.StoreForwardHelp(s.Config))
+}
+
+// Run connects the virtual node as a Store & Forward router until killed
+func (s *StoreForwardCmd) Run(cmd *cobra.Command, argz []string) {
+	h := help.Render("GlobalHeader", s.Config)
+	s.Config.Stdout.Write([]byte(h + "\n"))
+	s.Config.Log.Trace("StoreForwardCmd.Run")
+
+	ni := nodeinfo.NewNodeInfo(s.Config)
+	server, err := NewServer(s.Config, ni)
+	if err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	loaded, err := server.Load()
+	if err != nil {
+		s.Config.Log.Warnf("failed to read the text ledger: %v", err)
+	}
+
+	if err := ni.Listen(server.PacketHandler); err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.Config.Stdout, "📦 Store & Forward on '%s' with %d messages from the ledger ...\n", server.Channel.Name, loaded)
+	if server.Channel.IsPublic {
+		fmt.Fprintf(s.Config.Stdout, "⚠️  '%s' uses the default key, only broadcasts are replayed, not direct messages\n", server.Channel.Name)
+	}
+
+	if s.Config.StoreForward.HeartbeatSec > 0 {
+		server.Heartbeat()
+		go func() {
+			ticker := time.NewTicker(time.Duration(s.Config.StoreForward.HeartbeatSec) * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				server.Heartbeat()
+			}
+		}()
+	}
+
+	ni.MqttClient.WaitUntilKill()
+	ni.Close()
+	s.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	s.CmdOutput.WasSuccess = true
+}
+
+// Routers lists the Store & Forward routers in the NodeDB, from heartbeats heard while listening
+func (s *StoreForwardCmd) Routers(cmd *cobra.Command, argz []string) {
+	ni := nodeinfo.NewNodeInfo(s.Config)
+	if err := ni.Nodes.LoadFile(s.Config.NodeDbPath); err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ failed to read the NodeDB: %v\n", err)
+		return
+	}
+	client, err := NewClient(s.Config, ni)
+	if err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	routers := client.Routers()
+	if len(routers) == 0 {
+		fmt.Fprintln(s.Config.Stdout, "No Store & Forward heartbeats heard yet")
+	}
+	for _, r := range routers {
+		fmt.Fprintf(s.Config.Stdout, "  !%08x %-24s heartbeat %s (every %ds)\n", r.Node, r.Name, r.LastHeartbeat.Format(time.DateTime), r.Period)
+	}
+	s.CmdOutput.WasSuccess = true
+}
+
+// History asks a router for the channel text we missed and adds it to the ledger. The router is
+// the first argument, otherwise StoreForward.Router, otherwise the one with the latest heartbeat.
+func (s *StoreForwardCmd) History(cmd *cobra.Command, argz []string) {
+	h := help.Render("GlobalHeader", s.Config)
+	s.Config.Stdout.Write([]byte(h + "\n"))
+	s.Config.Log.Trace("StoreForwardCmd.History")
+
+	if len(argz) > 0 {
+		s.Config.StoreForward.Router = argz[0]
+	}
+	ni := nodeinfo.NewNodeInfo(s.Config)
+	client, err := NewClient(s.Config, ni)
+	if err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	client.Ingested = func(p *internal.Packet) {
+		fmt.Fprintf(s.Config.Stdout, "  [%s] !%08x: %s\n", time.Unix(int64(p.RxTime), 0).Format(time.DateTime), p.From, p.Payload)
+	}
+	if err := ni.Listen(client.PacketHandler); err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	defer ni.Close()
+
+	history, err := client.Backfill()
+	if history != nil {
+		fmt.Fprintf(s.Config.Stdout, "📥 !%08x replayed %d of %d messages from the last %v: %d new, %d already seen\n", history.Router, history.Received, history.Expected, history.Window, history.Ingested, history.Duplicates)
+	}
+	if err != nil {
+		fmt.Fprintf(s.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	s.CmdOutput.WasSuccess = true
+}
+
+// Backfill starts a client that asks for missed history once connected when StoreForward.Backfill
+// is set, for commands that keep the ledger (eg. bot and chat). Pass the handler to Listen, then call start.
+func Backfill(c *config.Config, ni *nodeinfo.NodeInfoCmd, ingested func(p *internal.Packet)) (handler func(p *internal.Packet), start func()) {
+	if !c.StoreForward.Backfill {
+		return func(p *internal.Packet) {}, func() {}
+	}
+	client, err := NewClient(c, ni)
+	if err != nil {
+		c.Log.Warnf("not backfilling from Store & Forward: %v", err)
+		return func(p *internal.Packet) {}, func() {}
+	}
+	client.Ingested = ingested
+	return client.PacketHandler, func() {
+		go func() {
+			history, err := client.Backfill()
+			if err != nil {
+				c.Log.Warnf("Store & Forward backfill: %v", err)
+			}
+			if history != nil {
+				c.Log.Infof("backfilled %d messages from Store & Forward router !%08x, %d already seen", history.Ingested, history.Router, history.Duplicates)
+			}
+		}()
+	}
+}
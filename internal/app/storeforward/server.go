@@ -0,0 +1,330 @@
+package storeforward
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message is a text message kept for replay, sent again exactly as it was first heard
+type Message struct {
+	Id      uint32
+	From    uint32
+	To      uint32
+	RxTime  uint32
+	Payload []byte
+	ReplyId uint32
+	Emoji   uint32
+}
+
+// Server is a virtual Store & Forward router. It keeps the channel's text messages and replays
+// the ones a client missed when it asks with CLIENT_HISTORY, one every PacketIntervalSec like the firmware.
+type Server struct {
+	Config  *config.Config
+	Node    *nodeinfo.NodeInfoCmd
+	Channel *internal.Channel
+
+	mutex       sync.Mutex
+	messages    []Message         // oldest first, at most Records
+	lastRequest map[uint32]uint32 // client to the rx_time of the last message replayed to it
+	busy        uint32            // client being replayed to, 0 when idle
+	abort       bool
+	started     time.Time
+	stats       struct {
+		total           uint32 // messages heard, including the ones since dropped
+		requests        uint32
+		requestsHistory uint32
+	}
+}
+
+func NewServer(c *config.Config, ni *nodeinfo.NodeInfoCmd) (*Server, error) {
+	ch, err := channel(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Config:      c,
+		Node:        ni,
+		Channel:     ch,
+		lastRequest: make(map[uint32]uint32),
+		started:     time.Now(),
+	}, nil
+}
+
+// channel is the StoreForward.ChannelSlot channel, where routers and clients talk
+func channel(c *config.Config) (*internal.Channel, error) {
+	keyring, err := internal.NewKeyring(c.Meshtastic.Channels)
+	if err != nil {
+		return nil, err
+	}
+	ch := keyring.BySlot(c.StoreForward.ChannelSlot)
+	if ch == nil {
+		return nil, fmt.Errorf("no channel configured for slot '%s'", c.StoreForward.ChannelSlot)
+	}
+	return ch, nil
+}
+
+// Load fills the buffer with the channel's text messages from the ledger, returning how many were kept
+func (s *Server) Load() (int, error) {
+	ledger, err := nodeinfo.ReadTextLedger(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range ledger {
+		if m.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP || m.PacketId == 0 || !onChannel(m.Topic, s.Channel.Name) {
+			continue
+		}
+		var emoji uint32
+		if m.Emoji {
+			emoji = 1
+		}
+		s.store(Message{
+			Id:      m.PacketId,
+			From:    m.From,
+			To:      m.To,
+			RxTime:  uint32(m.DateTimeStamp),
+			Payload: m.Payload,
+			ReplyId: m.ReplyId,
+			Emoji:   emoji,
+		})
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.messages), nil
+}
+
+// onChannel is true when the topic names the channel, eg. msh/US/2/e/LongFast/!28a1b2c3
+func onChannel(topic string, name string) bool {
+	return slices.Contains(strings.Split(topic, "/"), name)
+}
+
+// store adds a message unless we already have it, dropping the oldest when the buffer is full
+func (s *Server) store(m Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, have := range s.messages {
+		if have.From == m.From && have.Id == m.Id {
+			return
+		}
+	}
+	s.stats.total++
+	s.messages = append(s.messages, m)
+	if records := s.Config.StoreForward.Records; records > 0 && len(s.messages) > records {
+		s.messages = s.messages[len(s.messages)-records:]
+	}
+}
+
+// PacketHandler buffers channel text and answers STORE_FORWARD_APP requests addressed to us
+func (s *Server) PacketHandler(p *internal.Packet) {
+	switch p.PortNum {
+	case meshtastic.PortNum_TEXT_MESSAGE_APP:
+		if p.Channel == nil || p.Channel.Slot != s.Channel.Slot {
+			return
+		}
+		rxTime := p.RxTime
+		if rxTime == 0 {
+			rxTime = uint32(time.Now().Unix())
+		}
+		s.store(Message{Id: p.Id, From: p.From, To: p.To, RxTime: rxTime, Payload: p.Payload, ReplyId: p.ReplyId, Emoji: p.Emoji})
+
+	case meshtastic.PortNum_STORE_FORWARD_APP:
+		if p.To != s.Node.MqttClient.NodeNum() {
+			return
+		}
+		var sf meshtastic.StoreAndForward
+		if err := proto.Unmarshal(p.Payload, &sf); err != nil {
+			s.Config.Log.Warnf("failed to parse StoreAndForward from !%08x: %v", p.From, err)
+			return
+		}
+		s.request(p.From, &sf)
+	}
+}
+
+func (s *Server) request(client uint32, sf *meshtastic.StoreAndForward) {
+	s.Config.Log.Debugf(`{'from': '!%08x', 'storeForward': '%v'}`, client, sf.GetRr())
+	switch sf.GetRr() {
+	case meshtastic.StoreAndForward_CLIENT_HISTORY:
+		s.countRequest()
+		s.history(client, sf.GetHistory().GetWindow())
+
+	case meshtastic.StoreAndForward_CLIENT_STATS:
+		s.countRequest()
+		s.send(client, &meshtastic.StoreAndForward{
+			Rr:      meshtastic.StoreAndForward_ROUTER_STATS,
+			Variant: &meshtastic.StoreAndForward_Stats{Stats: s.Stats()},
+		})
+
+	case meshtastic.StoreAndForward_CLIENT_PING:
+		s.countRequest()
+		s.send(client, &meshtastic.StoreAndForward{Rr: meshtastic.StoreAndForward_ROUTER_PONG})
+
+	case meshtastic.StoreAndForward_CLIENT_ABORT:
+		s.mutex.Lock()
+		if s.busy == client {
+			s.abort = true
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Server) countRequest() {
+	s.mutex.Lock()
+	s.stats.requests++
+	s.mutex.Unlock()
+}
+
+// history tells the client how many messages it missed in the last 'windowMin' minutes and starts
+// replaying them. Only one client is served at a time, the others are told we're busy.
+// On a channel with the default key direct messages aren't replayed, anyone could read them.
+func (s *Server) history(client uint32, windowMin uint32) {
+	cfg := s.Config.StoreForward
+	window := uint32(cfg.ReturnWindowMin)
+	if windowMin > 0 && windowMin < window {
+		window = windowMin
+	}
+
+	s.mutex.Lock()
+	if s.busy != 0 {
+		s.mutex.Unlock()
+		s.Config.Log.Infof("busy replaying to !%08x, turning away !%08x", s.busy, client)
+		s.send(client, &meshtastic.StoreAndForward{Rr: meshtastic.StoreAndForward_ROUTER_BUSY})
+		return
+	}
+	lastRequest := s.lastRequest[client]
+	since := uint32(time.Now().Add(-time.Duration(window) * time.Minute).Unix())
+	since = max(since, lastRequest)
+
+	var queue []Message
+	for _, m := range s.messages {
+		// The same messages as the firmware: newer than the last replay, not the client's own, and for everyone or the client
+		if m.RxTime <= since || m.From == client || (m.To != internal.BroadcastAddr && m.To != client) {
+			continue
+		}
+		if m.To != internal.BroadcastAddr && s.Channel.IsPublic {
+			continue
+		}
+		queue = append(queue, m)
+	}
+	if cfg.ReturnMax > 0 && len(queue) > cfg.ReturnMax {
+		queue = queue[:cfg.ReturnMax]
+	}
+	s.stats.requestsHistory++
+	if len(queue) > 0 {
+		s.busy, s.abort = client, false
+	}
+	s.mutex.Unlock()
+
+	fmt.Fprintf(s.Config.Stdout, "📦 !%08x asked for %d minutes of history, replaying %d messages\n", client, window, len(queue))
+	s.send(client, &meshtastic.StoreAndForward{
+		Rr: meshtastic.StoreAndForward_ROUTER_HISTORY,
+		Variant: &meshtastic.StoreAndForward_History_{History: &meshtastic.StoreAndForward_History{
+			HistoryMessages: uint32(len(queue)),
+			Window:          window * 60 * 1000,
+			LastRequest:     lastRequest,
+		}},
+	})
+	if len(queue) > 0 {
+		go s.replay(client, queue)
+	}
+}
+
+// replay sends the queued messages to the client with the sender, packet id and time they were heard
+func (s *Server) replay(client uint32, queue []Message) {
+	defer func() {
+		s.mutex.Lock()
+		s.busy, s.abort = 0, false
+		s.mutex.Unlock()
+	}()
+
+	interval := time.Duration(s.Config.StoreForward.PacketIntervalSec) * time.Second
+	for i, m := range queue {
+		time.Sleep(interval)
+
+		s.mutex.Lock()
+		abort := s.abort
+		s.mutex.Unlock()
+		if abort {
+			s.Config.Log.Infof("!%08x aborted the replay after %d of %d messages", client, i, len(queue))
+			return
+		}
+
+		rr := meshtastic.StoreAndForward_ROUTER_TEXT_BROADCAST
+		if m.To != internal.BroadcastAddr {
+			rr = meshtastic.StoreAndForward_ROUTER_TEXT_DIRECT
+		}
+		payload, err := proto.Marshal(&meshtastic.StoreAndForward{
+			Rr:      rr,
+			Variant: &meshtastic.StoreAndForward_Text{Text: m.Payload},
+		})
+		if err != nil {
+			s.Config.Log.Errorf("failed to serialize StoreAndForward: %v", err)
+			return
+		}
+		data := &meshtastic.Data{
+			Portnum: meshtastic.PortNum_STORE_FORWARD_APP,
+			Payload: payload,
+			ReplyId: m.ReplyId,
+			Emoji:   m.Emoji,
+		}
+		if err := s.Node.MqttClient.Relay(s.Config.NodeInfo.Topic, s.Channel.Slot, m.From, m.Id, client, m.RxTime, data); err != nil {
+			s.Config.Log.Warnf("failed to replay message %d to !%08x: %v", m.Id, client, err)
+			return
+		}
+		s.Config.Log.Tracef(`{'to': '!%08x', 'from': '!%08x', 'packetId': %d, 'replay': '%d/%d'}`, client, m.From, m.Id, i+1, len(queue))
+
+		s.mutex.Lock()
+		s.lastRequest[client] = m.RxTime
+		s.mutex.Unlock()
+	}
+}
+
+// Heartbeat tells clients on the channel that a router is available
+func (s *Server) Heartbeat() {
+	s.send(internal.BroadcastAddr, &meshtastic.StoreAndForward{
+		Rr: meshtastic.StoreAndForward_ROUTER_HEARTBEAT,
+		Variant: &meshtastic.StoreAndForward_Heartbeat_{Heartbeat: &meshtastic.StoreAndForward_Heartbeat{
+			Period: uint32(s.Config.StoreForward.HeartbeatSec),
+		}},
+	})
+}
+
+// Stats are what we answer CLIENT_STATS with
+func (s *Server) Stats() *meshtastic.StoreAndForward_Statistics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cfg := s.Config.StoreForward
+	return &meshtastic.StoreAndForward_Statistics{
+		MessagesTotal:   s.stats.total,
+		MessagesSaved:   uint32(len(s.messages)),
+		MessagesMax:     uint32(cfg.Records),
+		UpTime:          uint32(time.Since(s.started).Seconds()),
+		Requests:        s.stats.requests,
+		RequestsHistory: s.stats.requestsHistory,
+		Heartbeat:       cfg.HeartbeatSec > 0,
+		ReturnMax:       uint32(cfg.ReturnMax),
+		ReturnWindow:    uint32(cfg.ReturnWindowMin),
+	}
+}
+
+// send publishes a StoreAndForward control message on the channel, without waiting for an ACK
+func (s *Server) send(to uint32, sf *meshtastic.StoreAndForward) {
+	payload, err := proto.Marshal(sf)
+	if err != nil {
+		s.Config.Log.Errorf("failed to serialize StoreAndForward: %v", err)
+		return
+	}
+	mc := s.Node.MqttClient
+	err = mc.PublishMessageSlot(s.Channel.Slot, mc.NodeNum(), to, mc.GatewayTopic(s.Channel.Name), meshtastic.PortNum_STORE_FORWARD_APP, payload)
+	if err != nil {
+		s.Config.Log.Warnf("failed to send %v to !%08x: %v", sf.GetRr(), to, err)
+	}
+}
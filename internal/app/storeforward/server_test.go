@@ -0,0 +1,103 @@
+package storeforward
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testClient = 0x12345678
+	privateKey = "oKGio6SlpqeoqaqrrK2ur7CxsrO0tba3uLm6u7y9vr8="
+)
+
+func newTestServer(t *testing.T, key string) (*Server, *mqtttest.Recorder) {
+	c := mqtttest.Config()
+	c.Meshtastic.Channels = []config.Channel{{Slot: "primary", Name: "Ops", EncryptKey: key, IsEncrypted: true, IsPrimary: true}}
+	c.StoreForward.ChannelSlot = "primary"
+	c.StoreForward.ReturnWindowMin = 240
+	c.StoreForward.PacketIntervalSec = 3600 // only the ROUTER_HISTORY answer is published during the test
+
+	ni := nodeinfo.NewNodeInfo(c)
+	ni.MqttClient = internal.NewMqttClient(c, &ni.Nodes)
+	rec := new(mqtttest.Recorder)
+	ni.MqttClient.SetClient(rec)
+
+	s, err := NewServer(c, ni)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint32(time.Now().Unix())
+	s.store(Message{Id: 1, From: 0x0badc0de, To: internal.BroadcastAddr, RxTime: now, Payload: []byte("doors open at 9")})
+	s.store(Message{Id: 2, From: 0x0badc0de, To: testClient, RxTime: now, Payload: []byte("your badge is at the desk")})
+	return s, rec
+}
+
+// askForHistory sends CLIENT_HISTORY to the server and returns its ROUTER_HISTORY answer
+func askForHistory(t *testing.T, s *Server, rec *mqtttest.Recorder, key []byte) *meshtastic.StoreAndForward {
+	payload, _ := proto.Marshal(&meshtastic.StoreAndForward{Rr: meshtastic.StoreAndForward_CLIENT_HISTORY})
+	s.PacketHandler(&internal.Packet{Id: 7, From: testClient, To: mqtttest.Node, PortNum: meshtastic.PortNum_STORE_FORWARD_APP, Payload: payload})
+
+	envelopes := rec.Envelopes()
+	if len(envelopes) != 1 {
+		t.Fatalf("published %d answers, want 1", len(envelopes))
+	}
+	packet := envelopes[0].GetPacket()
+	if packet.GetTo() != testClient {
+		t.Errorf("answer to !%08x, want the client", packet.GetTo())
+	}
+
+	data, err := mqtttest.Decrypt(key, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sf meshtastic.StoreAndForward
+	if err := proto.Unmarshal(data.GetPayload(), &sf); err != nil {
+		t.Fatal(err)
+	}
+	if sf.GetRr() != meshtastic.StoreAndForward_ROUTER_HISTORY {
+		t.Fatalf("answered %v, want ROUTER_HISTORY", sf.GetRr())
+	}
+	return &sf
+}
+
+func TestHistoryOnDefaultKeyLeavesOutDirectMessages(t *testing.T) {
+	for _, key := range []string{"AQ==", "Ag==", "Cg=="} {
+		s, rec := newTestServer(t, key)
+		if !s.Channel.IsPublic {
+			t.Fatalf("%s isn't a public channel", key)
+		}
+		expanded := bytes.Clone(internal.DefaultPSK)
+		expanded[15] = internal.DefaultPSK[15] + mustDecode(t, key)[0] - 1
+
+		if sf := askForHistory(t, s, rec, expanded); sf.GetHistory().GetHistoryMessages() != 1 {
+			t.Errorf("%s: replaying %d messages, want only the broadcast", key, sf.GetHistory().GetHistoryMessages())
+		}
+	}
+}
+
+func TestHistoryOnPrivateChannel(t *testing.T) {
+	s, rec := newTestServer(t, privateKey)
+	if s.Channel.IsPublic {
+		t.Fatal("a private key is a public channel")
+	}
+	if sf := askForHistory(t, s, rec, mustDecode(t, privateKey)); sf.GetHistory().GetHistoryMessages() != 2 {
+		t.Errorf("replaying %d messages, want the broadcast and the direct message", sf.GetHistory().GetHistoryMessages())
+	}
+}
+
+func mustDecode(t *testing.T, key string) []byte {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
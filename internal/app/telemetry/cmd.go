@@ -0,0 +1,84 @@
+package telemetry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type TelemetryCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewTelemetry(c *config.Config) (t *TelemetryCmd) {
+	t = new(TelemetryCmd)
+	t.Config = c
+
+	return t
+}
+
+func (t *TelemetryCmd) Help(cmd *cobra.Command, argz []string) {
+	t.CmdOutput.WasSuccess = true
+	fmt.Fprintln(t.Config.Stdout, help.TelemetryHelp(t.Config))
+}
+
+// Run connects the virtual node and sends each kind of telemetry on its interval until killed
+func (t *TelemetryCmd) Run(cmd *cobra.Command, argz []string) {
+	s := help.Render("GlobalHeader", t.Config)
+	t.Config.Stdout.Write([]byte(s + "\n"))
+	t.Config.Log.Trace("TelemetryCmd.Run")
+
+	ni := nodeinfo.NewNodeInfo(t.Config)
+	if err := ni.Listen(); err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+
+	started, err := NewPublisher(t.Config, ni).Start()
+	if err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ %v\n", err)
+		ni.Close()
+		return
+	}
+	if len(started) == 0 {
+		fmt.Fprintln(t.Config.Stdout, "❌ every telemetry interval is 0, nothing to send")
+		ni.Close()
+		return
+	}
+	fmt.Fprintf(t.Config.Stdout, "📈 Sending telemetry as !%08x, %s ...\n", ni.MqttClient.NodeNum(), strings.Join(started, ", "))
+
+	ni.MqttClient.WaitUntilKill()
+	ni.Close()
+	t.Config.Stdout.Write([]byte("\n✅ Cleanly exiting ...\n"))
+	t.CmdOutput.WasSuccess = true
+}
+
+// Show prints the telemetry that would be sent right now, without connecting
+func (t *TelemetryCmd) Show(cmd *cobra.Command, argz []string) {
+	publisher := NewPublisher(t.Config, nil)
+	if err := publisher.Check(); err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	for _, kind := range Kinds {
+		telemetry, err := publisher.Telemetry(kind)
+		if err != nil {
+			fmt.Fprintf(t.Config.Stdout, "❌ %s: %v\n", kind, err)
+			return
+		}
+		if telemetry == nil {
+			fmt.Fprintf(t.Config.Stdout, "%-12s (no readings)\n", kind)
+			continue
+		}
+		fmt.Fprintf(t.Config.Stdout, "%-12s %s\n", kind, protojson.Format(telemetry))
+	}
+	t.CmdOutput.WasSuccess = true
+}
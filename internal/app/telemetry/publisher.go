@@ -0,0 +1,270 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Kinds of telemetry, each sent on its own interval
+const (
+	KindDevice      = "device"
+	KindEnvironment = "environment"
+	KindPower       = "power"
+)
+
+var Kinds = []string{KindDevice, KindEnvironment, KindPower}
+
+// Publisher sends the virtual node's metrics from the configured constants, the JSON file and Linux sources
+type Publisher struct {
+	Config  *config.Config
+	Node    *nodeinfo.NodeInfoCmd
+	started time.Time
+}
+
+func NewPublisher(c *config.Config, ni *nodeinfo.NodeInfoCmd) *Publisher {
+	return &Publisher{Config: c, Node: ni, started: time.Now()}
+}
+
+func (p *Publisher) interval(kind string) time.Duration {
+	var sec int
+	switch kind {
+	case KindDevice:
+		sec = p.Config.Telemetry.DeviceIntervalSec
+	case KindEnvironment:
+		sec = p.Config.Telemetry.EnvironmentIntervalSec
+	case KindPower:
+		sec = p.Config.Telemetry.PowerIntervalSec
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// Start checks the metric names then sends every kind with an interval now and then on its interval,
+// returning the kinds started
+func (p *Publisher) Start() ([]string, error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	var started []string
+	for _, kind := range Kinds {
+		interval := p.interval(kind)
+		if interval <= 0 {
+			continue
+		}
+		started = append(started, fmt.Sprintf("%s every %v", kind, interval))
+		go func() {
+			p.send(kind)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				p.send(kind)
+			}
+		}()
+	}
+	return started, nil
+}
+
+// Check makes sure every constant and source names a metric, so a typo fails once instead of every send.
+// The JSON file is read before every send, its unknown metrics are skipped with a warning.
+func (p *Publisher) Check() error {
+	constants := map[string]map[string]float64{
+		KindDevice:      p.Config.Telemetry.Device,
+		KindEnvironment: p.Config.Telemetry.Environment,
+		KindPower:       p.Config.Telemetry.Power,
+	}
+	for _, kind := range Kinds {
+		_, metrics, _ := newTelemetry(kind)
+		for name := range constants[kind] {
+			if _, err := metricField(metrics, name); err != nil {
+				return fmt.Errorf("Telemetry.%s: %v", kind, err)
+			}
+		}
+	}
+	for _, source := range p.Config.Telemetry.Sources {
+		kind, name, _ := strings.Cut(strings.ToLower(source.Metric), ".")
+		_, metrics, err := newTelemetry(kind)
+		if err == nil {
+			_, err = metricField(metrics, name)
+		}
+		if err != nil {
+			return fmt.Errorf("Telemetry.Sources '%s': %v", source.Metric, err)
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) send(kind string) {
+	if err := p.Send(kind); err != nil {
+		p.Config.Log.Warnf("failed to send %s telemetry: %v", kind, err)
+	}
+}
+
+// Send publishes one kind of telemetry now, nothing is sent for a kind without any readings
+func (p *Publisher) Send(kind string) error {
+	telemetry, err := p.Telemetry(kind)
+	if err != nil || telemetry == nil {
+		return err
+	}
+	if err := p.Node.MqttClient.PublishTelemetry(p.Config.Telemetry.ChannelSlot, telemetry); err != nil {
+		return err
+	}
+	p.Config.Log.Debugf("{'telemetry': '%s', 'metrics': '%v'}", kind, telemetry)
+	return nil
+}
+
+// Telemetry is the message for one kind from the current readings, nil when there are none
+func (p *Publisher) Telemetry(kind string) (*meshtastic.Telemetry, error) {
+	readings := p.Readings(kind)
+	if len(readings) == 0 {
+		return nil, nil
+	}
+
+	telemetry, metrics, err := newTelemetry(kind)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.Time = uint32(time.Now().Unix())
+	if err := setMetrics(metrics, readings); err != nil {
+		return nil, err
+	}
+	return telemetry, nil
+}
+
+// newTelemetry is an empty message for one kind and the metrics inside it
+func newTelemetry(kind string) (*meshtastic.Telemetry, proto.Message, error) {
+	telemetry := new(meshtastic.Telemetry)
+	switch kind {
+	case KindDevice:
+		device := new(meshtastic.DeviceMetrics)
+		telemetry.Variant = &meshtastic.Telemetry_DeviceMetrics{DeviceMetrics: device}
+		return telemetry, device, nil
+	case KindEnvironment:
+		environment := new(meshtastic.EnvironmentMetrics)
+		telemetry.Variant = &meshtastic.Telemetry_EnvironmentMetrics{EnvironmentMetrics: environment}
+		return telemetry, environment, nil
+	case KindPower:
+		power := new(meshtastic.PowerMetrics)
+		telemetry.Variant = &meshtastic.Telemetry_PowerMetrics{PowerMetrics: power}
+		return telemetry, power, nil
+	}
+	return nil, nil, fmt.Errorf("unknown telemetry '%s', expected one of %s", kind, strings.Join(Kinds, ", "))
+}
+
+// Readings are the constants for a kind, overridden by the JSON file and then by the sources.
+// Device metrics always have an uptime, the time since we started unless it's read from somewhere.
+func (p *Publisher) Readings(kind string) map[string]float64 {
+	readings := make(map[string]float64)
+	switch kind {
+	case KindDevice:
+		readings["uptime_seconds"] = time.Since(p.started).Seconds()
+		for name, v := range p.Config.Telemetry.Device {
+			readings[name] = v
+		}
+	case KindEnvironment:
+		for name, v := range p.Config.Telemetry.Environment {
+			readings[name] = v
+		}
+	case KindPower:
+		for name, v := range p.Config.Telemetry.Power {
+			readings[name] = v
+		}
+	}
+
+	if file := p.Config.Telemetry.File; file != "" {
+		values, err := readFile(file)
+		if err != nil {
+			p.Config.Log.Warnf("failed to read telemetry from %s: %v", file, err)
+		}
+		_, metrics, _ := newTelemetry(kind)
+		for name, v := range values[kind] {
+			if _, err := metricField(metrics, name); err != nil {
+				p.Config.Log.Warnf("skipping %s from %s: %v", name, file, err)
+				continue
+			}
+			readings[name] = v
+		}
+	}
+
+	for _, source := range p.Config.Telemetry.Sources {
+		sourceKind, name, ok := strings.Cut(strings.ToLower(source.Metric), ".")
+		if !ok || sourceKind != kind {
+			continue
+		}
+		v, err := readSource(source.Path)
+		if err != nil {
+			p.Config.Log.Warnf("failed to read %s from %s: %v", source.Metric, source.Path, err)
+			continue
+		}
+		if source.Scale != 0 {
+			v *= source.Scale
+		}
+		readings[name] = v
+	}
+	return readings
+}
+
+// readFile is a JSON file of readings by kind, eg. {"environment": {"temperature": 21.5}}
+func readFile(path string) (map[string]map[string]float64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]map[string]float64
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// readSource is the first number in a file, eg. the seconds since boot from /proc/uptime
+func readSource(path string) (float64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%s is empty", path)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// metricField is the numeric field of a metrics message with a protobuf name
+func metricField(metrics proto.Message, name string) (protoreflect.FieldDescriptor, error) {
+	descriptor := metrics.ProtoReflect().Descriptor()
+	field := descriptor.Fields().ByName(protoreflect.Name(strings.ToLower(name)))
+	if field == nil {
+		return nil, fmt.Errorf("%s has no metric '%s'", descriptor.Name(), name)
+	}
+	if field.Kind() != protoreflect.FloatKind && field.Kind() != protoreflect.Uint32Kind {
+		return nil, fmt.Errorf("%s metric '%s' isn't a number", descriptor.Name(), name)
+	}
+	return field, nil
+}
+
+// setMetrics sets the fields of a metrics message by their protobuf names
+func setMetrics(metrics proto.Message, readings map[string]float64) error {
+	m := metrics.ProtoReflect()
+	for name, v := range readings {
+		field, err := metricField(metrics, name)
+		if err != nil {
+			return err
+		}
+		if field.Kind() == protoreflect.FloatKind {
+			m.Set(field, protoreflect.ValueOfFloat32(float32(v)))
+		} else {
+			m.Set(field, protoreflect.ValueOfUint32(uint32(math.Round(max(v, 0)))))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package telemetry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+func TestStartRejectsUnknownMetrics(t *testing.T) {
+	tests := map[string]func(c *config.Config){
+		"constant": func(c *config.Config) { c.Telemetry.Device = map[string]float64{"battery_levle": 90} },
+		"source": func(c *config.Config) {
+			c.Telemetry.Sources = []config.TelemetrySource{{Metric: "environment.temprature", Path: "/proc/uptime"}}
+		},
+		"source kind": func(c *config.Config) { c.Telemetry.Sources = []config.TelemetrySource{{Metric: "uptime_seconds"}} },
+	}
+	for name, configure := range tests {
+		c := mqtttest.Config()
+		c.Telemetry.DeviceIntervalSec = 60
+		configure(c)
+		if started, err := NewPublisher(c, nil).Start(); err == nil {
+			t.Errorf("%s: started %v with an unknown metric", name, started)
+		}
+	}
+}
+
+func TestCheckAcceptsKnownMetrics(t *testing.T) {
+	c := mqtttest.Config()
+	c.Telemetry.Device = map[string]float64{"battery_level": 101, "Voltage": 5}
+	c.Telemetry.Power = map[string]float64{"ch1_voltage": 5}
+	c.Telemetry.Sources = []config.TelemetrySource{{Metric: "Environment.Temperature", Path: "/sys/class/thermal/thermal_zone0/temp"}}
+	if err := NewPublisher(c, nil).Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileSkipsUnknownMetrics(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "readings.json")
+	if err := os.WriteFile(file, []byte(`{"environment": {"temperature": 21.5, "temprature": 99}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := mqtttest.Config()
+	c.Telemetry.File = file
+
+	telemetry, err := NewPublisher(c, nil).Telemetry(KindEnvironment)
+	if err != nil {
+		t.Fatalf("an unknown metric in the file failed the kind: %v", err)
+	}
+	if got := telemetry.GetEnvironmentMetrics().GetTemperature(); got != 21.5 {
+		t.Errorf("temperature = %v, want 21.5", got)
+	}
+}
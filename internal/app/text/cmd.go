@@ -0,0 +1,125 @@
+package text
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+type TextCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewText(c *config.Config) (t *TextCmd) {
+	t = new(TextCmd)
+	t.Config = c
+
+	return t
+}
+
+func (t *TextCmd) Help(cmd *cobra.Command, argz []string) {
+	t.CmdOutput.WasSuccess = true
+	fmt.Fprintln(t.Config.Stdout, help.TextHelp(t.Config))
+}
+
+// Send publishes the message from the arguments, or from stdin when there are none,
+// to TextMessage.To (default everyone) on the TextMessage.ChannelSlot channel.
+// With TextMessage.ReplyId (--reply-to) the message is threaded under that packet.
+func (t *TextCmd) Send(cmd *cobra.Command, argz []string) {
+	message := strings.Join(argz, " ")
+	if message == "" {
+		message = strings.TrimSpace(string(t.Config.Stdin))
+	}
+	if message == "" {
+		fmt.Fprintln(t.Config.Stdout, "❌ message required, eg. meshtk text send \"hello mesh\" or echo \"hello mesh\" | meshtk text send")
+		return
+	}
+	if t.Config.TextMessage.ReplyId < 0 || uint64(t.Config.TextMessage.ReplyId) > math.MaxUint32 {
+		fmt.Fprintf(t.Config.Stdout, "❌ invalid packet id %d\n", t.Config.TextMessage.ReplyId)
+		return
+	}
+
+	t.send(&meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(message),
+		ReplyId: uint32(t.Config.TextMessage.ReplyId),
+	})
+}
+
+// React sends a tapback emoji for a packet id, eg. 'meshtk text react 1234567890 👍'
+func (t *TextCmd) React(cmd *cobra.Command, argz []string) {
+	if len(argz) < 2 {
+		fmt.Fprintln(t.Config.Stdout, "❌ packet id and emoji required, eg. meshtk text react 1234567890 👍")
+		return
+	}
+	replyId, err := strconv.ParseUint(argz[0], 10, 32)
+	if err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ invalid packet id '%s': %v\n", argz[0], err)
+		return
+	}
+
+	t.send(&meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(argz[1]),
+		ReplyId: uint32(replyId),
+		Emoji:   1,
+	})
+}
+
+func (t *TextCmd) send(data *meshtastic.Data) {
+	to := uint32(internal.BroadcastAddr)
+	if t.Config.TextMessage.To != "" {
+		var err error
+		to, err = internal.ParseNodeId(t.Config.TextMessage.To)
+		if err != nil {
+			fmt.Fprintf(t.Config.Stdout, "❌ %v\n", err)
+			return
+		}
+	}
+
+	ni := nodeinfo.NewNodeInfo(t.Config)
+	if err := ni.Listen(); err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	defer ni.Close()
+
+	if to != internal.BroadcastAddr {
+		fmt.Fprintf(t.Config.Stdout, "⏳ sending to !%08x and waiting for an ACK ...\n", to)
+	}
+	topic := t.Config.TextMessage.Topic
+	deliveries, err := ni.MqttClient.SendTextData(topic, t.Config.TextMessage.ChannelSlot, to, data)
+	for _, delivery := range deliveries {
+		ni.AddSentLedger(delivery, topic)
+
+		message := string(delivery.Data.GetPayload())
+		switch delivery.State {
+		case internal.DeliverySent:
+			fmt.Fprintf(t.Config.Stdout, "✅ sent packet %d to !%08x: %s\n", delivery.PacketId, to, message)
+		case internal.DeliveryDelivered:
+			fmt.Fprintf(t.Config.Stdout, "✅ delivered packet %d to !%08x (attempts: %d): %s\n", delivery.PacketId, to, delivery.Attempts, message)
+		case internal.DeliveryNak:
+			fmt.Fprintf(t.Config.Stdout, "❌ packet %d to !%08x was refused: %s\n", delivery.PacketId, to, delivery.Reason)
+			return
+		case internal.DeliveryTimeout:
+			fmt.Fprintf(t.Config.Stdout, "⌛ no ACK for packet %d from !%08x after %d attempts\n", delivery.PacketId, to, delivery.Attempts)
+			return
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ failed to send: %v\n", err)
+		return
+	}
+	t.CmdOutput.WasSuccess = true
+}
@@ -0,0 +1,106 @@
+package traceroute
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+type TracerouteCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewTraceroute(c *config.Config) (t *TracerouteCmd) {
+	t = new(TracerouteCmd)
+	t.Config = c
+
+	return t
+}
+
+func (t *TracerouteCmd) Help(cmd *cobra.Command, argz []string) {
+	t.CmdOutput.WasSuccess = true
+	fmt.Fprintln(t.Config.Stdout, help.TracerouteHelp(t.Config))
+}
+
+// Run sends a traceroute to the node in the first argument and prints the path there and back
+func (t *TracerouteCmd) Run(cmd *cobra.Command, argz []string) {
+	if len(argz) < 1 {
+		fmt.Fprintln(t.Config.Stdout, help.TracerouteHelp(t.Config))
+		return
+	}
+	to, err := internal.ParseNodeId(argz[0])
+	if err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	s := help.Render("GlobalHeader", t.Config)
+	t.Config.Stdout.Write([]byte(s + "\n"))
+	t.Config.Log.Tracef("TracerouteCmd.Run %v", argz)
+
+	ni := nodeinfo.NewNodeInfo(t.Config)
+	if err := ni.Listen(); err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	defer ni.Close()
+
+	timeout := time.Duration(t.Config.Traceroute.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	fmt.Fprintf(t.Config.Stdout, "🛰️  Tracing the route to %s, waiting up to %v ...\n", name(ni, to), timeout)
+	route, err := ni.MqttClient.Traceroute(t.Config.Traceroute.ChannelSlot, to, timeout)
+	if err != nil {
+		fmt.Fprintf(t.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+
+	us := ni.MqttClient.NodeNum()
+	fmt.Fprintln(t.Config.Stdout, "Route there:")
+	fmt.Fprintln(t.Config.Stdout, path(ni, us, to, route.GetRoute(), route.GetSnrTowards()))
+	fmt.Fprintln(t.Config.Stdout, "Route back:")
+	fmt.Fprintln(t.Config.Stdout, path(ni, to, us, route.GetRouteBack(), route.GetSnrBack()))
+	t.CmdOutput.WasSuccess = true
+}
+
+// path is one direction of a traceroute, one hop per line with the SNR it was heard at
+func path(ni *nodeinfo.NodeInfoCmd, from, to uint32, hops []uint32, snrs []int32) string {
+	lines := []string{"  " + name(ni, from)}
+	for i, node := range append(slices.Clone(hops), to) {
+		snr := "?"
+		if i < len(snrs) {
+			if db, ok := internal.RouteSnr(snrs[i]); ok {
+				snr = fmt.Sprintf("%.2f", db)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("  → %s (%sdB)", name(ni, node), snr))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// name is '!28a1b2c3 Long Name' from the NodeDB
+func name(ni *nodeinfo.NodeInfoCmd, node uint32) string {
+	if node == internal.BroadcastAddr {
+		return "unknown hop"
+	}
+	if node == ni.MqttClient.NodeNum() {
+		return fmt.Sprintf("!%08x %s", node, ni.Config.NodeInfo.LongName)
+	}
+	ni.NodesMutex.Lock()
+	defer ni.NodesMutex.Unlock()
+	if n := ni.Nodes[node]; n != nil && n.LongName != "" {
+		return fmt.Sprintf("!%08x %s", node, n.LongName)
+	}
+	return fmt.Sprintf("!%08x", node)
+}
@@ -0,0 +1,268 @@
+package waypoint
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/whereiskurt/meshtk/internal/app/help"
+	"github.com/whereiskurt/meshtk/internal/app/nodeinfo"
+	internal "github.com/whereiskurt/meshtk/internal/mqtt"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+type WaypointCmd struct {
+	Config    *config.Config
+	CmdOutput struct {
+		WasSuccess bool
+	}
+}
+
+func NewWaypoint(c *config.Config) (w *WaypointCmd) {
+	w = new(WaypointCmd)
+	w.Config = c
+
+	return w
+}
+
+func (w *WaypointCmd) Help(cmd *cobra.Command, argz []string) {
+	w.CmdOutput.WasSuccess = true
+	fmt.Fprintln(w.Config.Stdout, help.WaypointHelp(w.Config))
+}
+
+// Create broadcasts a new waypoint, eg. 'meshtk waypoint create -- 43.6532 -79.3832 Aid Station 3'
+// (the '--' keeps a negative longitude from being read as a flag)
+func (w *WaypointCmd) Create(cmd *cobra.Command, argz []string) {
+	if len(argz) < 2 || (len(argz) == 2 && w.Config.Waypoint.Name == "") {
+		fmt.Fprintln(w.Config.Stdout, "❌ latitude, longitude and name required, eg. meshtk waypoint create -- 43.6532 -79.3832 \"Aid Station 3\"")
+		return
+	}
+	latitude, longitude, err := coordinates(argz[0], argz[1])
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	id, err := internal.NewWaypointId()
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to generate waypoint id: %v\n", err)
+		return
+	}
+
+	waypoint := &internal.Waypoint{
+		Id:          id,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		Expire:      expire(w.Config.Waypoint.ExpireHours),
+		Name:        w.Config.Waypoint.Name,
+		Description: w.Config.Waypoint.Description,
+		Icon:        w.Config.Waypoint.Icon,
+	}
+	if len(argz) > 2 {
+		waypoint.Name = strings.Join(argz[2:], " ")
+	}
+	w.publish(func(ni *nodeinfo.NodeInfoCmd) (*internal.Waypoint, error) {
+		if w.Config.Waypoint.Locked {
+			waypoint.LockedTo = ni.MqttClient.NodeNum()
+		}
+		return waypoint, nil
+	}, "📍 created")
+}
+
+// Update broadcasts a changed waypoint from the store, keeping anything that isn't given:
+// 'meshtk waypoint update <id> [latitude longitude] [--name ..] [--description ..] [--icon ..] [--expire hours]'
+func (w *WaypointCmd) Update(cmd *cobra.Command, argz []string) {
+	if len(argz) != 1 && len(argz) != 3 {
+		fmt.Fprintln(w.Config.Stdout, "❌ waypoint id required, eg. meshtk waypoint update 1234567890 [latitude longitude] --name \"Aid Station 4\"")
+		return
+	}
+	id, err := strconv.ParseUint(argz[0], 10, 32)
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ invalid waypoint id '%s': %v\n", argz[0], err)
+		return
+	}
+	var latitude, longitude int32
+	if len(argz) == 3 {
+		if latitude, longitude, err = coordinates(argz[1], argz[2]); err != nil {
+			fmt.Fprintf(w.Config.Stdout, "❌ %v\n", err)
+			return
+		}
+	}
+
+	changed := cmd.Flags().Changed
+	w.publish(func(ni *nodeinfo.NodeInfoCmd) (*internal.Waypoint, error) {
+		waypoint, err := w.owned(ni, uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		if len(argz) == 3 {
+			waypoint.Latitude, waypoint.Longitude = latitude, longitude
+		}
+		if changed("name") {
+			waypoint.Name = w.Config.Waypoint.Name
+		}
+		if changed("description") {
+			waypoint.Description = w.Config.Waypoint.Description
+		}
+		if changed("icon") {
+			waypoint.Icon = w.Config.Waypoint.Icon
+		}
+		if changed("expire") {
+			waypoint.Expire = expire(w.Config.Waypoint.ExpireHours)
+		}
+		if changed("locked") {
+			waypoint.LockedTo = 0
+			if w.Config.Waypoint.Locked {
+				waypoint.LockedTo = ni.MqttClient.NodeNum()
+			}
+		}
+		return waypoint, nil
+	}, "✏️  updated")
+}
+
+// Delete removes a waypoint from everyone's map the way the apps do, by sending it already expired
+func (w *WaypointCmd) Delete(cmd *cobra.Command, argz []string) {
+	if len(argz) < 1 {
+		fmt.Fprintln(w.Config.Stdout, "❌ waypoint id required, eg. meshtk waypoint delete 1234567890")
+		return
+	}
+	id, err := strconv.ParseUint(argz[0], 10, 32)
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ invalid waypoint id '%s': %v\n", argz[0], err)
+		return
+	}
+	w.publish(func(ni *nodeinfo.NodeInfoCmd) (*internal.Waypoint, error) {
+		waypoint, err := w.owned(ni, uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		waypoint.Expire = internal.WaypointDeleted
+		return waypoint, nil
+	}, "🗑️  deleted")
+}
+
+// List prints the waypoints in the store that haven't expired
+func (w *WaypointCmd) List(cmd *cobra.Command, argz []string) {
+	waypoints, ok := w.load()
+	if !ok {
+		return
+	}
+	sorted := waypoints.Sorted()
+	if len(sorted) == 0 {
+		fmt.Fprintln(w.Config.Stdout, "No waypoints heard yet")
+	}
+	for _, waypoint := range sorted {
+		expires := "never"
+		if waypoint.Expire != 0 {
+			expires = time.Unix(waypoint.Expire, 0).Format(time.DateTime)
+		}
+		fmt.Fprintf(w.Config.Stdout, "  %10d %s %-30s %11.7f %12.7f from !%08x expires %s\n", waypoint.Id, waypoint.Icon, waypoint.Name, float64(waypoint.Latitude)/1e7, float64(waypoint.Longitude)/1e7, waypoint.From, expires)
+		if waypoint.Description != "" {
+			fmt.Fprintf(w.Config.Stdout, "  %10s %s\n", "", waypoint.Description)
+		}
+	}
+	w.CmdOutput.WasSuccess = true
+}
+
+// Export writes the store as GeoJSON to the file in the first argument, or to stdout
+func (w *WaypointCmd) Export(cmd *cobra.Command, argz []string) {
+	waypoints, ok := w.load()
+	if !ok {
+		return
+	}
+	geojson, err := waypoints.GeoJSON()
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to build GeoJSON: %v\n", err)
+		return
+	}
+	if len(argz) == 0 {
+		fmt.Fprintln(w.Config.Stdout, string(geojson))
+		w.CmdOutput.WasSuccess = true
+		return
+	}
+	if err := os.WriteFile(argz[0], append(geojson, '\n'), 0644); err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to write %s: %v\n", argz[0], err)
+		return
+	}
+	fmt.Fprintf(w.Config.Stdout, "✅ wrote %d waypoints to %s\n", len(waypoints.Sorted()), argz[0])
+	w.CmdOutput.WasSuccess = true
+}
+
+func (w *WaypointCmd) load() (internal.WaypointDB, bool) {
+	waypoints := make(internal.WaypointDB)
+	if err := waypoints.LoadFile(w.Config.Waypoint.DbPath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to read %s: %v\n", w.Config.Waypoint.DbPath, err)
+		return nil, false
+	}
+	return waypoints, true
+}
+
+// owned is a copy of a waypoint from the store that we're allowed to change
+func (w *WaypointCmd) owned(ni *nodeinfo.NodeInfoCmd, id uint32) (*internal.Waypoint, error) {
+	ni.NodesMutex.Lock()
+	defer ni.NodesMutex.Unlock()
+	existing := ni.Waypoints[id]
+	if existing == nil || existing.Expired() {
+		return nil, fmt.Errorf("no waypoint %d in %s", id, w.Config.Waypoint.DbPath)
+	}
+	if existing.LockedTo != 0 && existing.LockedTo != ni.MqttClient.NodeNum() {
+		return nil, fmt.Errorf("%w: %d is locked to !%08x", internal.ErrWaypointLocked, id, existing.LockedTo)
+	}
+	waypoint := *existing
+	return &waypoint, nil
+}
+
+// publish connects the virtual node, broadcasts the waypoint from 'build' and keeps it in the store
+func (w *WaypointCmd) publish(build func(ni *nodeinfo.NodeInfoCmd) (*internal.Waypoint, error), done string) {
+	ni := nodeinfo.NewNodeInfo(w.Config)
+	if err := ni.Listen(); err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to connect: %v\n", err)
+		return
+	}
+	defer ni.Close()
+
+	waypoint, err := build(ni)
+	if err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ %v\n", err)
+		return
+	}
+	if err := ni.MqttClient.PublishWaypoint(w.Config.Waypoint.ChannelSlot, waypoint); err != nil {
+		fmt.Fprintf(w.Config.Stdout, "❌ failed to send: %v\n", err)
+		return
+	}
+	waypoint.Updated = time.Now().Unix()
+
+	payload, _ := proto.Marshal(waypoint.Proto())
+	ni.NodesMutex.Lock()
+	if err := ni.Waypoints.Update(waypoint); err != nil {
+		w.Config.Log.Warnf("%v", err)
+	}
+	ni.AddMessageLedger(internal.BroadcastAddr, waypoint.From, waypoint.Topic, meshtastic.PortNum_WAYPOINT_APP, payload)
+	ni.NodesMutex.Unlock()
+
+	fmt.Fprintf(w.Config.Stdout, "%s waypoint %d %s '%s' at %.7f,%.7f\n", done, waypoint.Id, waypoint.Icon, waypoint.Name, float64(waypoint.Latitude)/1e7, float64(waypoint.Longitude)/1e7)
+	w.CmdOutput.WasSuccess = true
+}
+
+// coordinates reads decimal degrees into the 1e-7 degree integers the protobufs use
+func coordinates(lat, lng string) (int32, int32, error) {
+	latitude, errLat := strconv.ParseFloat(lat, 64)
+	longitude, errLng := strconv.ParseFloat(lng, 64)
+	if errLat != nil || errLng != nil || latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return 0, 0, fmt.Errorf("latitude/longitude must be decimal degrees, eg. 43.6532 -79.3832")
+	}
+	return int32(math.Round(latitude * 1e7)), int32(math.Round(longitude * 1e7)), nil
+}
+
+// expire is the epoch 'hours' from now, 0 never expires
+func expire(hours int) int64 {
+	if hours <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(hours) * time.Hour).Unix()
+}
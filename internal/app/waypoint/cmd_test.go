@@ -0,0 +1,25 @@
+package waypoint
+
+import "testing"
+
+func TestCoordinatesRound(t *testing.T) {
+	tests := []struct {
+		lat, lng            string
+		latitude, longitude int32
+	}{
+		{"43.6532", "-79.3832", 436532000, -793832000},
+		{"0.0000001", "-0.0000001", 1, -1},
+		{"90", "180", 900000000, 1800000000},
+	}
+	for _, tt := range tests {
+		latitude, longitude, err := coordinates(tt.lat, tt.lng)
+		if err != nil || latitude != tt.latitude || longitude != tt.longitude {
+			t.Errorf("coordinates(%s, %s) = %d, %d, %v, want %d, %d", tt.lat, tt.lng, latitude, longitude, err, tt.latitude, tt.longitude)
+		}
+	}
+	for _, bad := range [][2]string{{"91", "0"}, {"0", "-181"}, {"north", "0"}} {
+		if _, _, err := coordinates(bad[0], bad[1]); err == nil {
+			t.Errorf("coordinates(%s, %s) accepted", bad[0], bad[1])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+/* Reliable delivery follows the firmware's ReliableRouter:
+      https://github.com/meshtastic/firmware/blob/master/src/mesh/ReliableRouter.cpp
+
+	Direct messages are sent with want_ack and the destination answers with a ROUTING_APP
+	packet whose Data.request_id is our packet id. error_reason NONE is an ACK, anything else
+	is a NAK. Retries reuse the packet id so that an ACK for any attempt counts. Broadcasts are
+	never acknowledged over MQTT, so they are only published once.
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+type DeliveryState string
+
+const (
+	DeliverySent      DeliveryState = "SENT" // broadcast, no acknowledgement expected
+	DeliveryDelivered DeliveryState = "DELIVERED"
+	DeliveryNak       DeliveryState = "NAK"
+	DeliveryTimeout   DeliveryState = "TIMEOUT"
+)
+
+// Delivery is the final state of a sent packet
+type Delivery struct {
+	PacketId uint32
+	To       uint32
+	State    DeliveryState
+	Reason   meshtastic.Routing_Error // why a NAK failed
+	Attempts int
+	Data     *meshtastic.Data // what was sent, one part of a split text message
+}
+
+func (d *Delivery) String() string {
+	if d.State == DeliveryNak {
+		return fmt.Sprintf("%s:%s", d.State, d.Reason)
+	}
+	return string(d.State)
+}
+
+// acks are the outstanding want_ack packets waiting on a ROUTING_APP reply
+type acks struct {
+	pending map[uint32]*pendingAck
+	mutex   sync.Mutex
+}
+
+type pendingAck struct {
+	to      uint32
+	waiting chan meshtastic.Routing_Error
+}
+
+// deliver publishes the packet, and for direct messages waits for the ACK/NAK, retrying
+// with a doubling timeout up to the configured retries
+func (c *MqttClient) deliver(o *outgoing) (*Delivery, error) {
+	d := &Delivery{PacketId: o.id, To: o.to, State: DeliverySent, Data: o.data}
+	if o.to == BroadcastAddr {
+		d.Attempts = 1
+		return d, c.publish(o)
+	}
+
+	pending := &pendingAck{to: o.to, waiting: make(chan meshtastic.Routing_Error, 1)}
+	c.acks.mutex.Lock()
+	c.acks.pending[o.id] = pending
+	c.acks.mutex.Unlock()
+	defer func() {
+		c.acks.mutex.Lock()
+		delete(c.acks.pending, o.id)
+		c.acks.mutex.Unlock()
+	}()
+
+	timeout := c.ackTimeout
+	for d.Attempts < c.ackRetries+1 {
+		d.Attempts++
+		if err := c.publish(o); err != nil {
+			return d, err
+		}
+		select {
+		case reason := <-pending.waiting:
+			if reason == meshtastic.Routing_NONE {
+				d.State = DeliveryDelivered
+			} else {
+				d.State, d.Reason = DeliveryNak, reason
+			}
+			c.log.Debugf(`{'delivery': '%s', 'to': '!%08x', 'packetId': %d, 'attempts': %d}`, d, d.To, d.PacketId, d.Attempts)
+			return d, nil
+		case <-time.After(timeout):
+			c.log.Debugf("no ACK for packet %d to !%08x after %v (attempt %d)", o.id, o.to, timeout, d.Attempts)
+			timeout *= 2
+		}
+	}
+
+	d.State = DeliveryTimeout
+	c.log.Debugf(`{'delivery': '%s', 'to': '!%08x', 'packetId': %d, 'attempts': %d}`, d, d.To, d.PacketId, d.Attempts)
+	return d, nil
+}
+
+// resolveAck hands a ROUTING_APP reply to the packet waiting on it. Only the destination
+// can ACK, but any node on the path can NAK (eg. NO_ROUTE or MAX_RETRANSMIT).
+func (c *MqttClient) resolveAck(p *Packet) {
+	if p.PortNum != meshtastic.PortNum_ROUTING_APP || p.RequestId == 0 {
+		return
+	}
+	c.acks.mutex.Lock()
+	pending, exists := c.acks.pending[p.RequestId]
+	c.acks.mutex.Unlock()
+	if !exists {
+		return
+	}
+
+	var routing meshtastic.Routing
+	if err := proto.Unmarshal(p.Payload, &routing); err != nil {
+		c.log.Warnf("failed to parse routing reply from !%08x: %v", p.From, err)
+		return
+	}
+	reason := routing.GetErrorReason()
+	if reason == meshtastic.Routing_NONE && p.From != pending.to {
+		return
+	}
+	select {
+	case pending.waiting <- reason:
+	default: // already answered, a duplicate from another gateway
+	}
+}
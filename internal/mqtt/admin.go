@@ -0,0 +1,160 @@
+package mqtt
+
+/* Remote administration follows the firmware's AdminModule:
+      https://github.com/meshtastic/firmware/blob/master/src/modules/AdminModule.cpp
+
+	Requests are PKI encrypted ADMIN_APP packets with want_response set. Every get_* response
+	carries a session_passkey, and set_* requests must echo a passkey that is under 300s old.
+	The remote node also needs our public key in its security.admin_key list.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const AdminPasskeyTTL = 150 * time.Second // the firmware allows 300s, refresh well before that
+
+var (
+	ErrAdminTimeout = errors.New("timed out waiting for admin response")
+	ErrAdminRouting = errors.New("admin request failed")
+)
+
+// AdminSession sends AdminMessages to one remote node and keeps its session_passkey
+type AdminSession struct {
+	client    *MqttClient
+	Node      uint32
+	Topic     string
+	Timeout   time.Duration
+	passkey   []byte
+	passkeyAt time.Time
+	pending   map[uint32]chan *Packet
+	mutex     sync.Mutex
+}
+
+func (c *MqttClient) NewAdminSession(node uint32, topic string, timeout time.Duration) *AdminSession {
+	s := &AdminSession{
+		client:  c,
+		Node:    node,
+		Topic:   topic,
+		Timeout: timeout,
+		pending: make(map[uint32]chan *Packet),
+	}
+	c.AddPacketHandler(s.handler)
+	return s
+}
+
+func (s *AdminSession) handler(p *Packet) {
+	if p.From != s.Node || p.RequestId == 0 {
+		return
+	}
+	if p.PortNum != meshtastic.PortNum_ADMIN_APP && p.PortNum != meshtastic.PortNum_ROUTING_APP {
+		return
+	}
+	s.mutex.Lock()
+	waiting, exists := s.pending[p.RequestId]
+	s.mutex.Unlock()
+	if exists {
+		select {
+		case waiting <- p:
+		default: // already answered, a duplicate from another gateway
+		}
+	}
+}
+
+// Get sends a get_* request and waits for the matching response
+func (s *AdminSession) Get(msg *meshtastic.AdminMessage) (*meshtastic.AdminMessage, error) {
+	p, err := s.request(msg)
+	if err != nil {
+		return nil, err
+	}
+	if p.PortNum != meshtastic.PortNum_ADMIN_APP {
+		return nil, fmt.Errorf("%w: expected ADMIN_APP response, got %s", ErrAdminRouting, p.PortNum)
+	}
+
+	response := new(meshtastic.AdminMessage)
+	if err := proto.Unmarshal(p.Payload, response); err != nil {
+		return nil, fmt.Errorf("failed to parse admin response: %v", err)
+	}
+	if len(response.GetSessionPasskey()) > 0 {
+		s.passkey = response.GetSessionPasskey()
+		s.passkeyAt = time.Now()
+	}
+	return response, nil
+}
+
+// Set sends a set_* (or reboot, etc.) request with a fresh session_passkey and waits for the ACK
+func (s *AdminSession) Set(msg *meshtastic.AdminMessage) error {
+	if s.passkey == nil || time.Since(s.passkeyAt) > AdminPasskeyTTL {
+		s.client.log.Tracef("refreshing admin session passkey for !%08x", s.Node)
+		_, err := s.Get(&meshtastic.AdminMessage{
+			PayloadVariant: &meshtastic.AdminMessage_GetDeviceMetadataRequest{GetDeviceMetadataRequest: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get session passkey: %w", err)
+		}
+	}
+	msg.SessionPasskey = s.passkey
+
+	_, err := s.request(msg)
+	return err
+}
+
+func (s *AdminSession) request(msg *meshtastic.AdminMessage) (*Packet, error) {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize admin message: %v", err)
+	}
+
+	// Hold the lock while publishing so a fast response waits until we're registered
+	waiting := make(chan *Packet, 1)
+	s.mutex.Lock()
+	id, err := s.client.PublishDataPKI(s.client.nodeNum, s.Node, s.Topic, &meshtastic.Data{
+		Portnum:      meshtastic.PortNum_ADMIN_APP,
+		Payload:      payload,
+		WantResponse: true,
+	})
+	if err == nil {
+		s.pending[id] = waiting
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var p *Packet
+	select {
+	case p = <-waiting:
+	case <-time.After(s.Timeout):
+	}
+
+	s.mutex.Lock()
+	delete(s.pending, id)
+	s.mutex.Unlock()
+
+	if p == nil {
+		return nil, fmt.Errorf("%w: packet %d to !%08x", ErrAdminTimeout, id, s.Node)
+	}
+	if p.PortNum == meshtastic.PortNum_ROUTING_APP {
+		if err := routingError(p.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func routingError(payload []byte) error {
+	var routing meshtastic.Routing
+	if err := proto.Unmarshal(payload, &routing); err != nil {
+		return fmt.Errorf("failed to parse routing response: %v", err)
+	}
+	if reason := routing.GetErrorReason(); reason != meshtastic.Routing_NONE {
+		return fmt.Errorf("%w: %s", ErrAdminRouting, reason)
+	}
+	return nil
+}
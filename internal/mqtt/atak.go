@@ -0,0 +1,135 @@
+package mqtt
+
+/* ATAK plugin packets follow the firmware's AtakPluginModule:
+      https://github.com/meshtastic/firmware/blob/master/src/modules/AtakPluginModule.cpp
+
+	The plugin hands the node a TAKPacket and the firmware Unishox2 compresses the callsigns and
+	chat strings before it goes over the air, setting is_compressed. Compressed strings are rarely
+	valid UTF-8, which protobuf string fields refuse, so they're (de)compressed on the wire instead.
+*/
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/whereiskurt/meshtk/internal/unishox"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// takStrings are the compressed strings, by TAKPacket field and then the field in that message
+var takStrings = map[protowire.Number][]protowire.Number{
+	2: {1, 2},    // contact: callsign, device_callsign
+	6: {1, 2, 3}, // chat: message, to, to_callsign
+}
+
+// DecodeTAKPacket reads an ATAK_PLUGIN payload, the strings are always returned decompressed
+func DecodeTAKPacket(payload []byte) (*meshtastic.TAKPacket, error) {
+	if takCompressed(payload) {
+		plain, err := rewriteTAKStrings(payload, unishox.Decompress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress TAKPacket: %v", err)
+		}
+		payload = plain
+	}
+	tak := new(meshtastic.TAKPacket)
+	if err := proto.Unmarshal(payload, tak); err != nil {
+		return nil, err
+	}
+	tak.IsCompressed = false
+	return tak, nil
+}
+
+// EncodeTAKPacket serializes a TAKPacket with its strings compressed, the way the firmware sends it
+func EncodeTAKPacket(tak *meshtastic.TAKPacket) ([]byte, error) {
+	plain := proto.Clone(tak).(*meshtastic.TAKPacket)
+	plain.IsCompressed = true
+	payload, err := proto.Marshal(plain)
+	if err != nil {
+		return nil, err
+	}
+	return rewriteTAKStrings(payload, func(s []byte) ([]byte, error) {
+		return unishox.Compress(s), nil
+	})
+}
+
+// PublishTAKPacket broadcasts a TAKPacket from us on the channel in 'slot'
+func (c *MqttClient) PublishTAKPacket(slot string, tak *meshtastic.TAKPacket) error {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	payload, err := EncodeTAKPacket(tak)
+	if err != nil {
+		return fmt.Errorf("failed to serialize TAKPacket: %v", err)
+	}
+	return c.publishEncrypted(ch, c.nodeNum, BroadcastAddr, c.GatewayTopic(ch.Name), meshtastic.PortNum_ATAK_PLUGIN, payload)
+}
+
+// takCompressed reads is_compressed straight off the wire
+func takCompressed(payload []byte) bool {
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return false
+		}
+		if num == 1 && typ == protowire.VarintType {
+			v, m := protowire.ConsumeVarint(payload[n:])
+			return m > 0 && v != 0
+		}
+		m := protowire.ConsumeFieldValue(num, typ, payload[n:])
+		if m < 0 {
+			return false
+		}
+		payload = payload[n+m:]
+	}
+	return false
+}
+
+func rewriteTAKStrings(payload []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	return rewriteFields(payload, func(num protowire.Number, message []byte) ([]byte, error) {
+		strings, ok := takStrings[num]
+		if !ok {
+			return message, nil
+		}
+		return rewriteFields(message, func(num protowire.Number, s []byte) ([]byte, error) {
+			if !slices.Contains(strings, num) || len(s) == 0 {
+				return s, nil
+			}
+			return fn(s)
+		})
+	})
+}
+
+// rewriteFields copies a message field by field, passing every length delimited value through fn
+func rewriteFields(b []byte, fn func(num protowire.Number, value []byte) ([]byte, error)) ([]byte, error) {
+	var out []byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		if typ != protowire.BytesType {
+			m := protowire.ConsumeFieldValue(num, typ, b[n:])
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			out = append(out, b[:n+m]...)
+			b = b[n+m:]
+			continue
+		}
+		value, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		value, err := fn(num, value)
+		if err != nil {
+			return nil, err
+		}
+		out = protowire.AppendTag(out, num, typ)
+		out = protowire.AppendBytes(out, value)
+		b = b[n+m:]
+	}
+	return out, nil
+}
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+var ErrUnknownChannel = errors.New("no configured channel matches")
+
+// Channel is a configured meshtastic channel with its expanded key and channel hash
+type Channel struct {
+	Slot      string
+	Name      string
+	Key       string // base64 as configured
+	Hash      uint32 // MeshPacket.Channel for packets on this channel
+	IsPrimary bool
+	IsPublic  bool         // unencrypted or a simple PSK, anyone can read it
+	block     cipher.Block // nil when the channel has no encryption
+}
+
+// crypt applies the channel's AES-CTR keystream, or copies the bytes when the channel is unencrypted
+func (ch *Channel) crypt(from, packetId uint32, in []byte) []byte {
+	out := make([]byte, len(in))
+	if ch.block == nil {
+		copy(out, in)
+		return out
+	}
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint32(nonce[0:], packetId)
+	binary.LittleEndian.PutUint32(nonce[8:], from)
+	cipher.NewCTR(ch.block, nonce).XORKeyStream(out, in)
+	return out
+}
+
+// Keyring holds every configured channel, used to pick the decrypt key for a packet
+type Keyring []*Channel
+
+func NewKeyring(channels []config.Channel) (Keyring, error) {
+	var k Keyring
+	for _, ch := range channels {
+		keyBytes, err := expandKey(ch.EncryptKey)
+		if err != nil {
+			return nil, fmt.Errorf("channel '%s' (%s): %v", ch.Slot, ch.Name, err)
+		}
+		// An empty key means the channel is unencrypted and the 'encrypted' bytes are the plain Data
+		var block cipher.Block
+		if len(keyBytes) > 0 {
+			block, err = aes.NewCipher(keyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("channel '%s' (%s): %v", ch.Slot, ch.Name, err)
+			}
+		}
+		k = append(k, &Channel{
+			Slot:      ch.Slot,
+			Name:      ch.Name,
+			Key:       ch.EncryptKey,
+			Hash:      uint32(GenerateChannelHash(ch.Name, ch.EncryptKey)),
+			IsPrimary: ch.IsPrimary,
+			IsPublic:  len(keyBytes) == 0 || bytes.Equal(keyBytes[:len(DefaultPSK)-1], DefaultPSK[:len(DefaultPSK)-1]),
+			block:     block,
+		})
+	}
+	if len(k) == 0 {
+		return nil, fmt.Errorf("no channels configured")
+	}
+	return k, nil
+}
+
+// Primary is the channel marked IsPrimary, otherwise the first channel
+func (k Keyring) Primary() *Channel {
+	for _, ch := range k {
+		if ch.IsPrimary {
+			return ch
+		}
+	}
+	return k[0]
+}
+
+// BySlot finds a channel by its slot (eg. 'primary'), falling back to the channel name
+func (k Keyring) BySlot(slot string) *Channel {
+	for _, ch := range k {
+		if strings.EqualFold(ch.Slot, slot) {
+			return ch
+		}
+	}
+	for _, ch := range k {
+		if strings.EqualFold(ch.Name, slot) {
+			return ch
+		}
+	}
+	return nil
+}
+
+// Candidates returns the channels whose hash matches, the channel named in the ServiceEnvelope first.
+// More than one channel can share a hash since it is only 8 bits.
+func (k Keyring) Candidates(hash uint32, channelId string) []*Channel {
+	var matches []*Channel
+	for _, ch := range k {
+		if ch.Hash != hash {
+			continue
+		}
+		if ch.Name == channelId {
+			matches = append([]*Channel{ch}, matches...)
+		} else {
+			matches = append(matches, ch)
+		}
+	}
+	return matches
+}
+
+// DefaultPSK is the firmware's default channel key, selected by the simple PSK index 1 (AQ==)
+var DefaultPSK = []byte{0xd4, 0xf1, 0xbb, 0x3a, 0x20, 0x29, 0x07, 0x59, 0xf0, 0xbc, 0xff, 0xab, 0xcf, 0x4e, 0x69, 0x01}
+
+// expandKey turns a configured base64 PSK into the AES key the firmware uses (see Channels::getKey):
+//   - 0 bytes or index 0 (AA==) means no encryption and returns an empty key
+//   - 1 byte is a simple PSK index, DefaultPSK with the last byte bumped by index-1 (AQ== through Cg==)
+//   - short keys are zero padded to 16 bytes, keys between 16 and 32 bytes to 32 bytes
+func expandKey(base64Key string) ([]byte, error) {
+	replacedKey := strings.ReplaceAll(strings.ReplaceAll(base64Key, "-", "+"), "_", "/")
+	keyBytes, err := base64.StdEncoding.DecodeString(replacedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 key: %v", err)
+	}
+
+	switch {
+	case len(keyBytes) == 0:
+		return nil, nil
+	case len(keyBytes) == 1:
+		index := keyBytes[0]
+		if index == 0 {
+			return nil, nil
+		}
+		keyBytes = bytes.Clone(DefaultPSK)
+		keyBytes[len(keyBytes)-1] += index - 1
+	case len(keyBytes) < 16:
+		keyBytes = append(keyBytes, make([]byte, 16-len(keyBytes))...)
+	case len(keyBytes) > 16 && len(keyBytes) < 32:
+		keyBytes = append(keyBytes, make([]byte, 32-len(keyBytes))...)
+	case len(keyBytes) > 32:
+		return nil, fmt.Errorf("key is %d bytes, at most 32 bytes are allowed", len(keyBytes))
+	}
+	return keyBytes, nil
+}
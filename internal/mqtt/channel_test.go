@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/whereiskurt/meshtk/pkg/config"
+)
+
+func TestExpandKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string // hex, empty is no encryption
+	}{
+		{"index 0 is no encryption", "AA==", ""},
+		{"index 1 is the default key", "AQ==", "d4f1bb3a20290759f0bcffabcf4e6901"},
+		{"index 2", "Ag==", "d4f1bb3a20290759f0bcffabcf4e6902"},
+		{"index 10", "Cg==", "d4f1bb3a20290759f0bcffabcf4e690a"},
+		{"empty", "", ""},
+		{"short keys are zero padded to AES-128", "AQID", "01020300000000000000000000000000"},
+		{"url safe base64", "-_8=", "fbff0000000000000000000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := expandKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := hex.DecodeString(tt.want); !bytes.Equal(key, want) {
+				t.Errorf("expandKey(%q) = %x, want %s", tt.key, key, tt.want)
+			}
+		})
+	}
+
+	if _, err := expandKey(string(bytes.Repeat([]byte("A"), 48))); err == nil {
+		t.Error("a 36 byte key was accepted")
+	}
+}
+
+func TestGenerateChannelHash(t *testing.T) {
+	// the hash the firmware puts on every LongFast packet with the default key
+	if hash := GenerateChannelHash("LongFast", "AQ=="); hash != 8 {
+		t.Errorf("LongFast/AQ== hash = %d, want 8", hash)
+	}
+}
+
+func TestChannelIsPublic(t *testing.T) {
+	tests := map[string]bool{
+		"":                         true,
+		"AA==":                     true,
+		"AQ==":                     true,
+		"Cg==":                     true,
+		"1PG7OiApB1nwvP+rz05pAQ==": true, // the default key written out in full
+		"AQID":                     false,
+		"oKGio6SlpqeoqaqrrK2ur7CxsrO0tba3uLm6u7y9vr8=": false,
+	}
+	for key, public := range tests {
+		keyring, err := NewKeyring([]config.Channel{{Slot: "primary", Name: "Ops", EncryptKey: key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyring[0].IsPublic != public {
+			t.Errorf("%q IsPublic = %v, want %v", key, keyring[0].IsPublic, public)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChannelURLPrefix is how the meshtastic apps share a ChannelSet, the fragment is the base64url protobuf
+const ChannelURLPrefix = "https://meshtastic.org/e/"
+
+// PresetChannelNames are the channel names the firmware uses for an unnamed primary channel
+var PresetChannelNames = map[meshtastic.Config_LoRaConfig_ModemPreset]string{
+	meshtastic.Config_LoRaConfig_LONG_FAST:      "LongFast",
+	meshtastic.Config_LoRaConfig_LONG_SLOW:      "LongSlow",
+	meshtastic.Config_LoRaConfig_VERY_LONG_SLOW: "VLongSlow",
+	meshtastic.Config_LoRaConfig_MEDIUM_SLOW:    "MediumSlow",
+	meshtastic.Config_LoRaConfig_MEDIUM_FAST:    "MediumFast",
+	meshtastic.Config_LoRaConfig_SHORT_SLOW:     "ShortSlow",
+	meshtastic.Config_LoRaConfig_SHORT_FAST:     "ShortFast",
+	meshtastic.Config_LoRaConfig_LONG_MODERATE:  "LongMod",
+	meshtastic.Config_LoRaConfig_SHORT_TURBO:    "ShortTurbo",
+}
+
+// DecodeChannelURL parses a 'https://meshtastic.org/e/#...' URL. The returned bool is true
+// for '?add=true' URLs, which add channels instead of replacing them.
+func DecodeChannelURL(channelURL string) (*meshtastic.ChannelSet, bool, error) {
+	u, err := url.Parse(strings.TrimSpace(channelURL))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid channel url: %v", err)
+	}
+	if u.Fragment == "" {
+		return nil, false, fmt.Errorf("channel url has no '#<ChannelSet>' fragment")
+	}
+	add := strings.EqualFold(u.Query().Get("add"), "true")
+
+	// The apps use unpadded base64url, but be forgiving of padding and the standard alphabet
+	fragment := strings.TrimRight(u.Fragment, "=")
+	fragment = strings.ReplaceAll(strings.ReplaceAll(fragment, "+", "-"), "/", "_")
+	raw, err := base64.RawURLEncoding.DecodeString(fragment)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode channel url: %v", err)
+	}
+
+	set := new(meshtastic.ChannelSet)
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return nil, false, fmt.Errorf("failed to parse ChannelSet: %v", err)
+	}
+	if len(set.GetSettings()) == 0 {
+		return nil, false, fmt.Errorf("channel url has no channels")
+	}
+	return set, add, nil
+}
+
+// EncodeChannelURL writes a ChannelSet as a shareable URL
+func EncodeChannelURL(set *meshtastic.ChannelSet, add bool) (string, error) {
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize ChannelSet: %v", err)
+	}
+	prefix := ChannelURLPrefix
+	if add {
+		prefix += "?add=true"
+	}
+	return prefix + "#" + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ChannelsFromSet converts a ChannelSet into config channels and LoRa settings
+func ChannelsFromSet(set *meshtastic.ChannelSet) ([]config.Channel, config.LoRa) {
+	lora := LoRaFromProto(set.GetLoraConfig())
+
+	var channels []config.Channel
+	for i, settings := range set.GetSettings() {
+		name := settings.GetName()
+		if name == "" {
+			name = PresetChannelNames[meshtastic.Config_LoRaConfig_ModemPreset(meshtastic.Config_LoRaConfig_ModemPreset_value[lora.ModemPreset])]
+		}
+		psk := settings.GetPsk()
+		slot := strings.ToLower(name)
+		if i == 0 {
+			slot = "primary"
+		}
+		channels = append(channels, config.Channel{
+			Slot:        slot,
+			Name:        name,
+			EncryptKey:  base64.StdEncoding.EncodeToString(psk),
+			IsEncrypted: len(psk) > 1 || (len(psk) == 1 && psk[0] != 0),
+			IsPrimary:   i == 0,
+		})
+	}
+	return channels, lora
+}
+
+// ChannelSetFromConfig builds a ChannelSet with the primary channel first
+func ChannelSetFromConfig(channels []config.Channel, lora config.LoRa) (*meshtastic.ChannelSet, error) {
+	set := &meshtastic.ChannelSet{LoraConfig: LoRaToProto(lora)}
+
+	ordered := make([]config.Channel, 0, len(channels))
+	for _, ch := range channels {
+		if ch.IsPrimary {
+			ordered = append([]config.Channel{ch}, ordered...)
+		} else {
+			ordered = append(ordered, ch)
+		}
+	}
+
+	for _, ch := range ordered {
+		replacedKey := strings.ReplaceAll(strings.ReplaceAll(ch.EncryptKey, "-", "+"), "_", "/")
+		psk, err := base64.StdEncoding.DecodeString(replacedKey)
+		if err != nil {
+			return nil, fmt.Errorf("channel '%s' key is not base64: %v", ch.Slot, err)
+		}
+		set.Settings = append(set.Settings, &meshtastic.ChannelSettings{
+			Name:            ch.Name,
+			Psk:             psk,
+			UplinkEnabled:   true,
+			DownlinkEnabled: true,
+		})
+	}
+	return set, nil
+}
+
+func LoRaFromProto(l *meshtastic.Config_LoRaConfig) config.LoRa {
+	return config.LoRa{
+		Region:         l.GetRegion().String(),
+		ModemPreset:    l.GetModemPreset().String(),
+		UsePreset:      l.GetUsePreset(),
+		Bandwidth:      l.GetBandwidth(),
+		SpreadFactor:   l.GetSpreadFactor(),
+		CodingRate:     l.GetCodingRate(),
+		HopLimit:       l.GetHopLimit(),
+		ChannelNum:     l.GetChannelNum(),
+		TxPower:        l.GetTxPower(),
+		TxEnabled:      l.GetTxEnabled(),
+		ConfigOkToMqtt: l.GetConfigOkToMqtt(),
+	}
+}
+
+func LoRaToProto(l config.LoRa) *meshtastic.Config_LoRaConfig {
+	return &meshtastic.Config_LoRaConfig{
+		Region:         meshtastic.Config_LoRaConfig_RegionCode(meshtastic.Config_LoRaConfig_RegionCode_value[l.Region]),
+		ModemPreset:    meshtastic.Config_LoRaConfig_ModemPreset(meshtastic.Config_LoRaConfig_ModemPreset_value[l.ModemPreset]),
+		UsePreset:      l.UsePreset,
+		Bandwidth:      l.Bandwidth,
+		SpreadFactor:   l.SpreadFactor,
+		CodingRate:     l.CodingRate,
+		HopLimit:       l.HopLimit,
+		ChannelNum:     l.ChannelNum,
+		TxPower:        l.TxPower,
+		TxEnabled:      l.TxEnabled,
+		ConfigOkToMqtt: l.ConfigOkToMqtt,
+	}
+}
@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/whereiskurt/meshtk/pkg/config"
+	"google.golang.org/protobuf/proto"
+)
+
+// appDefaultURL is the share link the Meshtastic app shows for a new US LongFast node
+const appDefaultURL = "https://meshtastic.org/e/#CgMSAQESCAgBOAFAA0gB"
+
+func TestDecodeChannelURLFromApp(t *testing.T) {
+	set, add, err := DecodeChannelURL(appDefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if add {
+		t.Error("a replace url decoded as add")
+	}
+
+	channels, lora := ChannelsFromSet(set)
+	want := config.Channel{Slot: "primary", Name: "LongFast", EncryptKey: "AQ==", IsEncrypted: true, IsPrimary: true}
+	if len(channels) != 1 || channels[0] != want {
+		t.Fatalf("channels = %+v, want [%+v]", channels, want)
+	}
+	if lora.Region != "US" || lora.ModemPreset != "LONG_FAST" || !lora.UsePreset || lora.HopLimit != 3 || !lora.TxEnabled {
+		t.Errorf("lora = %+v, want US LONG_FAST preset with hop limit 3", lora)
+	}
+
+	// the same bytes come back out, unpadded base64url
+	url, err := EncodeChannelURL(set, false)
+	if err != nil || url != appDefaultURL {
+		t.Errorf("EncodeChannelURL = %s, %v, want %s", url, err, appDefaultURL)
+	}
+}
+
+func TestChannelURLRoundTrip(t *testing.T) {
+	channels := []config.Channel{
+		{Slot: "admin", Name: "admin", EncryptKey: "3q2+7wABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhs=", IsEncrypted: true},
+		{Slot: "primary", Name: "LongFast", EncryptKey: "AQ==", IsEncrypted: true, IsPrimary: true},
+	}
+	lora := config.LoRa{Region: "EU_868", ModemPreset: "MEDIUM_FAST", UsePreset: true, HopLimit: 5, TxEnabled: true}
+
+	set, err := ChannelSetFromConfig(channels, lora)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := EncodeChannelURL(set, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, add, err := DecodeChannelURL(url)
+	if err != nil {
+		t.Fatalf("DecodeChannelURL(%s): %v", url, err)
+	}
+	if !add || !proto.Equal(decoded, set) {
+		t.Errorf("round trip add=%v %v, want %v", add, decoded, set)
+	}
+
+	got, gotLora := ChannelsFromSet(decoded)
+	if len(got) != 2 || !got[0].IsPrimary || got[0].Name != "LongFast" || got[1].Slot != "admin" || got[1].EncryptKey != channels[0].EncryptKey {
+		t.Errorf("channels = %+v, want the primary first then admin", got)
+	}
+	if gotLora.Region != lora.Region || gotLora.ModemPreset != lora.ModemPreset || gotLora.HopLimit != lora.HopLimit {
+		t.Errorf("lora = %+v, want %+v", gotLora, lora)
+	}
+}
+
+func TestDecodeChannelURLForgiving(t *testing.T) {
+	// padding and the standard alphabet are accepted as well as the apps' base64url
+	for _, url := range []string{appDefaultURL + "==", " " + appDefaultURL + "\n"} {
+		if _, _, err := DecodeChannelURL(url); err != nil {
+			t.Errorf("DecodeChannelURL(%q): %v", url, err)
+		}
+	}
+	for _, url := range []string{"https://meshtastic.org/e/", "https://meshtastic.org/e/#!!!", "https://meshtastic.org/e/#CAE"} {
+		if _, _, err := DecodeChannelURL(url); err == nil {
+			t.Errorf("DecodeChannelURL(%q) accepted", url)
+		}
+	}
+}
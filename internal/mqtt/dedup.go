@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Sighting is every copy of one MeshPacket we've heard, from each gateway and topic that uplinked it
+type Sighting struct {
+	First    time.Time
+	Last     time.Time
+	Copies   int
+	Gateways map[string]int // gateway id, eg. '!33664ae0', to the copies it uplinked
+	Topics   map[string]int
+}
+
+// sightingKey is (from, packet id). A Store & Forward replay reuses the original sender and id
+// for a STORE_FORWARD_APP packet, so replays are kept apart from the text they carry.
+type sightingKey struct {
+	from   uint32
+	id     uint32
+	replay bool
+}
+
+// dedup remembers packets by (from, packet id) for a window, so copies arriving through other
+// gateways and topics on a '#' subscription are only handled once. Packets are only recorded
+// once they decrypt, so a corrupt copy from one gateway doesn't hide the good ones.
+type dedup struct {
+	window     time.Duration
+	mutex      sync.Mutex
+	seen       map[sightingKey]*Sighting
+	pruned     time.Time
+	packets    uint64
+	duplicates uint64
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{window: window, seen: make(map[sightingKey]*Sighting), pruned: time.Now()}
+}
+
+// duplicate records the copy and returns true when the same packet was already heard in the window
+func (d *dedup) duplicate(from, id uint32, replay bool, gateway, topic string, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.packets++
+	if d.window <= 0 || id == 0 {
+		return false
+	}
+	if now.Sub(d.pruned) > d.window {
+		for key, s := range d.seen {
+			if now.Sub(s.First) > d.window {
+				delete(d.seen, key)
+			}
+		}
+		d.pruned = now
+	}
+
+	key := sightingKey{from, id, replay}
+	if s := d.seen[key]; s != nil && now.Sub(s.First) <= d.window {
+		s.Last = now
+		s.Copies++
+		s.Gateways[gateway]++
+		s.Topics[topic]++
+		d.duplicates++
+		return true
+	}
+	d.seen[key] = &Sighting{
+		First:    now,
+		Last:     now,
+		Copies:   1,
+		Gateways: map[string]int{gateway: 1},
+		Topics:   map[string]int{topic: 1},
+	}
+	return false
+}
+
+// Sighting is a copy of where a packet was heard, nil once it's older than the dedup window
+func (c *MqttClient) Sighting(from, id uint32) *Sighting {
+	c.dedup.mutex.Lock()
+	defer c.dedup.mutex.Unlock()
+	s := c.dedup.seen[sightingKey{from: from, id: id}]
+	if s == nil {
+		return nil
+	}
+	sighting := *s
+	sighting.Gateways = maps.Clone(s.Gateways)
+	sighting.Topics = maps.Clone(s.Topics)
+	return &sighting
+}
+
+// DedupStats is how many packets arrived and how many of them were copies we dropped
+func (c *MqttClient) DedupStats() (packets, duplicates uint64) {
+	c.dedup.mutex.Lock()
+	defer c.dedup.mutex.Unlock()
+	return c.dedup.packets, c.dedup.duplicates
+}
+
+// SetDuplicateHandler registers a callback for every dropped copy, with the gateway and topic it came through
+func (c *MqttClient) SetDuplicateHandler(f func(from uint32, gateway, topic string)) {
+	c.duplicateHandler = f
+}
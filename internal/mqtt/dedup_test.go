@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDedupWindow(t *testing.T) {
+	d := newDedup(time.Minute)
+	start := time.Now()
+
+	if d.duplicate(0x1234, 42, false, "!gw000001", "msh/US/2/e/LongFast/!gw000001", start) {
+		t.Fatal("first copy is a duplicate")
+	}
+	if !d.duplicate(0x1234, 42, false, "!gw000002", "msh/CA/2/e/LongFast/!gw000002", start.Add(30*time.Second)) {
+		t.Fatal("second copy inside the window isn't a duplicate")
+	}
+	if d.duplicate(0x1234, 42, true, "!gw000001", "msh/US/2/e/LongFast/!gw000001", start.Add(40*time.Second)) {
+		t.Error("a Store & Forward replay of the packet is a duplicate")
+	}
+	if d.duplicate(0x1234, 43, false, "!gw000001", "msh/US/2/e/LongFast/!gw000001", start.Add(40*time.Second)) {
+		t.Error("another packet id is a duplicate")
+	}
+	if d.duplicate(0x1234, 42, false, "!gw000001", "msh/US/2/e/LongFast/!gw000001", start.Add(2*time.Minute)) {
+		t.Error("a copy after the window is a duplicate")
+	}
+	if packets, duplicates := d.packets, d.duplicates; packets != 5 || duplicates != 1 {
+		t.Errorf("packets %d duplicates %d, want 5 and 1", packets, duplicates)
+	}
+
+	// Packet id 0 and a 0 window never dedup
+	if d.duplicate(0x1234, 0, false, "", "", start) || d.duplicate(0x1234, 0, false, "", "", start) {
+		t.Error("packet id 0 is a duplicate")
+	}
+	off := newDedup(0)
+	off.duplicate(0x1234, 42, false, "", "", start)
+	if off.duplicate(0x1234, 42, false, "", "", start) {
+		t.Error("dedup with no window dropped a copy")
+	}
+}
+
+func TestDedupEviction(t *testing.T) {
+	start := time.Now()
+	d := newDedup(time.Minute)
+	d.pruned = start
+	for id := uint32(1); id <= 100; id++ {
+		d.duplicate(0x1234, id, false, "!gw000001", "", start)
+	}
+	d.duplicate(0x5678, 1, false, "!gw000001", "", start.Add(90*time.Second))
+	if len(d.seen) != 1 {
+		t.Errorf("%d packets remembered after the window, want only the newest", len(d.seen))
+	}
+}
+
+// message is an MQTT message as the broker delivers it
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 0 }
+func (m message) Retained() bool    { return false }
+func (m message) Topic() string     { return m.topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.payload }
+func (m message) Ack()              {}
+
+func TestDispatcherDropsCopiesFromOtherGateways(t *testing.T) {
+	c := mqtttest.Config()
+	c.Mqtt.DedupWindowSec = 600
+	nodes := make(NodeDB)
+	client := NewMqttClient(c, &nodes)
+	client.SetMessageHandler(func(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte) {})
+	var delivered, dropped int
+	client.AddPacketHandler(func(p *Packet) { delivered++ })
+	client.SetDuplicateHandler(func(from uint32, gateway, topic string) { dropped++ })
+
+	const from, id = 0x12345678, 0x0badf00d
+	data := &meshtastic.Data{Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte("!ping")}
+	plain, _ := proto.Marshal(data)
+	ch := client.primary
+	uplink := func(gateway string, packet *meshtastic.MeshPacket) {
+		topic := "msh/US/2/e/LongFast/" + gateway
+		payload, _ := proto.Marshal(&meshtastic.ServiceEnvelope{Packet: packet, ChannelId: "LongFast", GatewayId: gateway})
+		client.dispatcher(nil, message{topic, payload})
+	}
+
+	// a copy on a channel we don't have the key for isn't remembered, so it can't hide the others
+	uplink("!gw000001", &meshtastic.MeshPacket{From: from, To: BroadcastAddr, Id: id, Channel: ch.Hash + 1,
+		PayloadVariant: &meshtastic.MeshPacket_Encrypted{Encrypted: []byte{0xde, 0xad}}})
+	// the same packet uplinked decoded by one gateway and encrypted by another
+	uplink("!gw000002", &meshtastic.MeshPacket{From: from, To: BroadcastAddr, Id: id, Channel: ch.Hash,
+		PayloadVariant: &meshtastic.MeshPacket_Decoded{Decoded: data}})
+	uplink("!gw000003", &meshtastic.MeshPacket{From: from, To: BroadcastAddr, Id: id, Channel: ch.Hash,
+		PayloadVariant: &meshtastic.MeshPacket_Encrypted{Encrypted: ch.crypt(from, id, plain)}})
+
+	if delivered != 1 || dropped != 1 {
+		t.Errorf("delivered %d dropped %d, want 1 and 1", delivered, dropped)
+	}
+	s := client.Sighting(from, id)
+	if s == nil || s.Copies != 2 || s.Gateways["!gw000002"] != 1 || s.Gateways["!gw000003"] != 1 {
+		t.Errorf("sighting = %+v, want a copy from each of the two gateways that decrypted", s)
+	}
+	if packets, duplicates := client.DedupStats(); packets != 2 || duplicates != 1 {
+		t.Errorf("DedupStats = %d, %d, want 2, 1", packets, duplicates)
+	}
+}
@@ -6,45 +6,91 @@ import (
 	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
+	"github.com/whereiskurt/meshtk/internal/unishox"
 	"github.com/whereiskurt/meshtk/pkg/config"
 	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
 	"google.golang.org/protobuf/proto"
 )
 
+// Packet is a decoded MeshPacket with the envelope details that request/response handlers need
+type Packet struct {
+	Id           uint32
+	From         uint32
+	To           uint32
+	Topic        string
+	GatewayId    string
+	ChannelId    string   // ServiceEnvelope channel, 'PKI' for direct messages
+	Channel      *Channel // nil for PKI and unencrypted packets
+	PortNum      meshtastic.PortNum
+	Payload      []byte
+	RequestId    uint32
+	ReplyId      uint32
+	Emoji        uint32
+	WantResponse bool
+	WantAck      bool
+	PkiEncrypted bool
+	Compressed   bool // arrived as TEXT_MESSAGE_COMPRESSED_APP, PortNum and Payload are the decoded text
+	HopLimit     uint32
+	HopStart     uint32
+	RxTime       uint32
+}
+
 type MqttClient struct {
-	log            *log.Logger
-	blockCipher    cipher.Block
-	messageHandler func(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte)
-	client         mqtt.Client
-	topics         []string
-	channel        string //Needed for meshtastic publish packet construction
-	key            string //Needed for meshtastic publish packet construction
-	pkiPrivateKey  []byte
-	pkiPublicKey   []byte
-	nodes          *NodeDB
+	log              *log.Logger
+	keyring          Keyring  //Every configured channel, selected by channel hash when decrypting
+	primary          *Channel //Default channel for publishing
+	messageHandler   func(to, from uint32, topic string, portNum meshtastic.PortNum, payload []byte)
+	duplicateHandler func(from uint32, gateway, topic string)
+	packetHandlers   []func(p *Packet)
+	handlersMutex    sync.RWMutex
+	client           mqtt.Client
+	topics           []string
+	pkiPrivateKey    []byte
+	pkiPublicKey     []byte
+	nodeNum          uint32 //Our virtual node, PKI packets are only decryptable when addressed to us
+	topic            string //Our channel topic (eg. msh/US/2/e/LongFast) for building reply topics
+	nodes            *NodeDB
+	acks             acks          //Outstanding want_ack packets by packet id
+	ackTimeout       time.Duration //Wait for the first ACK, doubled on every retry
+	ackRetries       int
+	compressText     bool   //Send text as TEXT_MESSAGE_COMPRESSED_APP when that's smaller
+	dedup            *dedup //Recently heard packets, copies through other gateways and topics are dropped
+	traces           traces //Outstanding traceroute requests by packet id
 }
 
 func NewMqttClient(c *config.Config, nodes *NodeDB) *MqttClient {
 	mqc := MqttClient{
-		log:     c.Log,
-		nodes:   nodes,
-		channel: c.Meshtastic.Channels[0].Name,
-		key:     c.Meshtastic.Channels[0].EncryptKey,
+		log:        c.Log,
+		nodes:      nodes,
+		topic:      c.NodeInfo.Topic,
+		acks:       acks{pending: make(map[uint32]*pendingAck)},
+		traces:     traces{pending: make(map[uint32]chan *Packet)},
+		ackTimeout: time.Duration(c.Ack.TimeoutSec) * time.Second,
+		ackRetries: c.Ack.Retries,
+
+		compressText: c.TextMessage.Compress,
+		dedup:        newDedup(time.Duration(c.Mqtt.DedupWindowSec) * time.Second),
 	}
 
-	var err error
+	nodeNum, err := strconv.ParseUint(strings.TrimPrefix(c.NodeInfo.ClientId, "!"), 16, 32)
+	if err != nil {
+		c.Log.Errorf("failed to parse node id '%s': %v", c.NodeInfo.ClientId, err)
+	}
+	mqc.nodeNum = uint32(nodeNum)
+
 	mqc.pkiPublicKey, err = hex.DecodeString(strings.TrimPrefix(c.NodeInfo.PKI.PublicKey, "0x"))
 	if err != nil {
 		c.Log.Errorf("failed to decode public key: %v", err)
@@ -54,20 +100,15 @@ func NewMqttClient(c *config.Config, nodes *NodeDB) *MqttClient {
 		c.Log.Errorf("failed to decode private key: %v", err)
 	}
 
-	base64Key := c.Meshtastic.Channels[0].EncryptKey
-	keyBytes, err := base64.StdEncoding.DecodeString(base64Key)
+	mqc.keyring, err = NewKeyring(c.Meshtastic.Channels)
 	if err != nil {
-		log.Fatal(err)
+		c.Log.Fatalf("failed to build channel keyring: %v", err)
 	}
-
-	// Ensure the key is 16 bytes (AES-128), 24 bytes (AES-192), or 32 bytes (AES-256)
-	if len(keyBytes) == 1 && base64Key == "AQ==" {
-		// Expand the single byte key to 16 bytes for AES-128
-		keyBytes = append(keyBytes, make([]byte, 15)...)
+	mqc.primary = mqc.keyring.Primary()
+	for _, ch := range mqc.keyring {
+		c.Log.Tracef("channel slot '%s' name '%s' hash %d", ch.Slot, ch.Name, ch.Hash)
 	}
 
-	mqc.blockCipher = NewAESCipher(keyBytes)
-
 	opts := mqtt.NewClientOptions()
 	opts.AutoReconnect = true
 	opts.SetConnectRetry(true)
@@ -115,8 +156,12 @@ func (c *MqttClient) dispatcher(_ mqtt.Client, msg mqtt.Message) {
 
 	from := packet.GetFrom()
 	to := packet.GetTo()
-
+	if from == c.nodeNum {
+		c.log.Tracef("skipping our own packet %d echoed back on %v", packet.GetId(), topic)
+		return
+	}
 	isEncrypted := false
+	var channel *Channel
 	data := packet.GetDecoded()
 	if data == nil {
 		encrypted := packet.GetEncrypted()
@@ -124,37 +169,36 @@ func (c *MqttClient) dispatcher(_ mqtt.Client, msg mqtt.Message) {
 			c.log.Warnf("skipping MeshPacket from %v with no data on %v", from, topic)
 			return
 		}
-		nonce := make([]byte, 16)
-		binary.LittleEndian.PutUint32(nonce[0:], packet.GetId())
-		binary.LittleEndian.PutUint32(nonce[8:], from)
-
 		if !packet.GetPkiEncrypted() {
-			decrypted := make([]byte, len(encrypted))
-			cipher.NewCTR(c.blockCipher, nonce).XORKeyStream(decrypted, encrypted)
-			data = new(meshtastic.Data)
-			if err := proto.Unmarshal(decrypted, data); err != nil {
-				c.log.Errorf("failed to unmarshal decrypted data: %v", err)
+			var err error
+			data, channel, err = c.decryptChannel(packet, envelope.GetChannelId())
+			if errors.Is(err, ErrUnknownChannel) {
+				c.log.Tracef("skipping packet from %v on %v: %v", from, topic, err)
+				return
+			} else if err != nil {
+				c.log.Errorf("failed to decrypt packet from %v on %v: %v", from, topic, err)
 				return
 			}
+			c.log.Tracef("decrypted packet from %v with channel '%s' (%s)", from, channel.Slot, channel.Name)
 			isEncrypted = true
 		} else {
 			c.log.Tracef("MeshPacket from %v with PKI encryption on %v", from, topic)
+			if to != c.nodeNum {
+				c.log.Tracef("skipping PKI MeshPacket from %v to %v not addressed to us on %v", from, to, topic)
+				return
+			}
 
-			// payload := data.GetPayload()
-			copy(nonce[8:11], encrypted[len(encrypted)-4:])
-
-			pkiDecrypted, pkiErr := c.decryptWithPKI(from, nonce, encrypted)
+			pkiDecrypted, pkiErr := c.decryptWithPKI(from, packet.GetId(), encrypted)
 			if pkiErr != nil {
-				c.log.Warnf("PKI(1) decrypt error failed for packet from %v on %v: %v", from, topic, pkiErr)
+				c.log.Warnf("PKI decrypt failed for packet from %v on %v: %v", from, topic, pkiErr)
 				return
 			}
 			data = new(meshtastic.Data)
 			if err := proto.Unmarshal(pkiDecrypted, data); err != nil {
-				c.log.Errorf("PKI(2) unmarshal error decrypted data: %v", err)
+				c.log.Errorf("failed to unmarshal PKI decrypted data: %v", err)
 				return
 			}
-
-			// c.log.Tracef("success PKI decrypted payload from %v on %v: %x", from, topic, pkiDecrypted)
+			isEncrypted = true
 		}
 	}
 
@@ -164,51 +208,91 @@ func (c *MqttClient) dispatcher(_ mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
+	replay := portNum == meshtastic.PortNum_STORE_FORWARD_APP
+	if c.dedup.duplicate(from, packet.GetId(), replay, envelope.GetGatewayId(), topic, time.Now()) {
+		c.log.Tracef("skipping duplicate packet %d from %v via gateway %s on %v", packet.GetId(), from, envelope.GetGatewayId(), topic)
+		if c.duplicateHandler != nil {
+			c.duplicateHandler(from, envelope.GetGatewayId(), topic)
+		}
+		return
+	}
+
 	payload := data.GetPayload()
 	if payload == nil {
 		c.log.Warnf("skipping Data from %v with no payload on %v", from, topic)
 		return
 	}
 
+	// Compressed text is handled like any other text once decoded, the same as the firmware does
+	compressed := false
+	if portNum == meshtastic.PortNum_TEXT_MESSAGE_COMPRESSED_APP {
+		text, err := unishox.Decompress(payload)
+		if err != nil {
+			c.log.Warnf("failed to decompress text from %v on %v: %v", from, topic, err)
+		} else {
+			portNum, payload, compressed = meshtastic.PortNum_TEXT_MESSAGE_APP, text, true
+		}
+	}
+
 	c.log.Tracef(`{'from': %v, 'topic': '%v', 'portNum': %v, 'isEncrypted': %v, 'payload': '0x%x'}`, from, topic, portNum, isEncrypted, payload)
 	c.messageHandler(to, from, topic, portNum, payload)
-}
 
-// This is not working yet and totally wrong actually
-// Review the source: src/mesh/CryptoEngine.cpp in the meshtastic_firmware repo
-func (c *MqttClient) decryptWithPKI(from uint32, nonce []byte, encrypted []byte) ([]byte, error) {
-	//Do we have the senders public key?
-	node, exists := (*c.nodes)[from]
-	if !exists {
-		return nil, fmt.Errorf("haven't see node with ID %v does not exist", from)
+	p := &Packet{
+		Id:           packet.GetId(),
+		From:         from,
+		To:           to,
+		Topic:        topic,
+		GatewayId:    envelope.GetGatewayId(),
+		ChannelId:    envelope.GetChannelId(),
+		Channel:      channel,
+		PortNum:      portNum,
+		Payload:      payload,
+		RequestId:    data.GetRequestId(),
+		ReplyId:      data.GetReplyId(),
+		Emoji:        data.GetEmoji(),
+		WantResponse: data.GetWantResponse(),
+		WantAck:      packet.GetWantAck(),
+		PkiEncrypted: packet.GetPkiEncrypted(),
+		Compressed:   compressed,
+		HopLimit:     packet.GetHopLimit(),
+		HopStart:     packet.GetHopStart(),
+		RxTime:       packet.GetRxTime(),
 	}
-
-	publicKeyBytes, err := hex.DecodeString(strings.TrimPrefix(node.PubKey, "0x"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read public key: %v", err)
-	}
-
-	sharedSecret, err := GenerateSharedSecret(c.pkiPrivateKey, publicKeyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate shared secret: %v", err)
+	c.resolveAck(p)
+	c.resolveTraceroute(p)
+	c.answerTraceroute(p)
+
+	c.handlersMutex.RLock()
+	handlers := c.packetHandlers
+	c.handlersMutex.RUnlock()
+	for _, handler := range handlers {
+		handler(p)
 	}
+}
 
-	// Ensure the shared secret is the correct length for AES
-	if len(sharedSecret) != 32 {
-		return nil, fmt.Errorf("unexpected shared secret length: %d", len(sharedSecret))
+// decryptChannel tries each channel matching the packet's channel hash until one decodes
+func (c *MqttClient) decryptChannel(packet *meshtastic.MeshPacket, channelId string) (*meshtastic.Data, *Channel, error) {
+	candidates := c.keyring.Candidates(packet.GetChannel(), channelId)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("%w: hash %d (%s)", ErrUnknownChannel, packet.GetChannel(), channelId)
 	}
 
-	// Create AES cipher block
-	block, err := aes.NewCipher(sharedSecret)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	encrypted := packet.GetEncrypted()
+	var lastErr error
+	for _, ch := range candidates {
+		decrypted := ch.crypt(packet.GetFrom(), packet.GetId(), encrypted)
+		data := new(meshtastic.Data)
+		if err := proto.Unmarshal(decrypted, data); err != nil {
+			lastErr = fmt.Errorf("failed to unmarshal decrypted data: %v", err)
+			continue
+		}
+		if data.GetPortnum() == meshtastic.PortNum_UNKNOWN_APP {
+			lastErr = fmt.Errorf("decrypted data has no portnum")
+			continue
+		}
+		return data, ch, nil
 	}
-
-	// Decrypt the message using AES-CTR
-	decrypted := make([]byte, len(encrypted))
-	cipher.NewCTR(block, nonce).XORKeyStream(decrypted, encrypted)
-
-	return decrypted, nil
+	return nil, nil, lastErr
 }
 
 func (c *MqttClient) subscribeMultiple(topics []string) error {
@@ -243,6 +327,8 @@ func (c *MqttClient) Connect() error {
 
 func (c *MqttClient) Disconnect() {
 	if c.client.IsConnected() {
+		packets, duplicates := c.DedupStats()
+		c.log.Infof(`{'packets': %d, 'duplicates': %d}`, packets, duplicates)
 		c.client.Disconnect(1000)
 	}
 }
@@ -291,6 +377,32 @@ func (c *MqttClient) SetMessageHandler(f func(to, from uint32, topic string, por
 	c.messageHandler = f
 }
 
+// AddPacketHandler registers a callback for every decoded packet, called after the message handler
+func (c *MqttClient) AddPacketHandler(f func(p *Packet)) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	c.packetHandlers = append(c.packetHandlers, f)
+}
+
+// SetClient replaces the broker connection, eg. with one that records what's published
+func (c *MqttClient) SetClient(client mqtt.Client) {
+	c.client = client
+}
+
+// NodeNum is our virtual node's number, from NodeInfo.ClientId
+func (c *MqttClient) NodeNum() uint32 {
+	return c.nodeNum
+}
+
+// GatewayTopic is where we uplink packets for a channel, eg. msh/US/2/e/<channelId>/!28a1b2c3
+func (c *MqttClient) GatewayTopic(channelId string) string {
+	return c.gatewayTopic(c.topic, channelId)
+}
+
+func (c *MqttClient) gatewayTopic(channelTopic string, channelId string) string {
+	return fmt.Sprintf("%s/!%08x", ChannelTopic(channelTopic, channelId), c.nodeNum)
+}
+
 func NewAESCipher(key []byte) cipher.Block {
 	c, err := aes.NewCipher(key)
 	if err != nil {
@@ -299,22 +411,25 @@ func NewAESCipher(key []byte) cipher.Block {
 	return c
 }
 
-func (c *MqttClient) GenerateKeyPair() {
+// GenerateKeyPair creates a new X25519 keypair for the node's PKI identity
+func GenerateKeyPair() (publicKey []byte, privateKey []byte, err error) {
 	curve := ecdh.X25519()
 
-	privateKey, err := curve.GenerateKey(rand.Reader)
+	key, err := curve.GenerateKey(rand.Reader)
 	if err != nil {
-		return
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
 	}
 
-	publicKeyBytes := privateKey.PublicKey().Bytes()
-	privateKeyBytes := privateKey.Bytes()
-
-	fmt.Printf("Public Key: %x\n", publicKeyBytes)
-	fmt.Printf("Private Key: %x\n", privateKeyBytes)
-
-	// c.pkiPrivateKey = privateKey
+	return key.PublicKey().Bytes(), key.Bytes(), nil
+}
 
+// PublicKeyFromPrivate derives the X25519 public key for a private key
+func PublicKeyFromPrivate(privateKeyBytes []byte) ([]byte, error) {
+	privateKey, err := ecdh.X25519().NewPrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return privateKey.PublicKey().Bytes(), nil
 }
 
 func GenerateSharedSecret(privateKeyBytes, publicKeyBytes []byte) ([]byte, error) {
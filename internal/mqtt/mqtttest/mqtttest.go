@@ -0,0 +1,89 @@
+// Package mqtttest has the broker and config fixtures shared by the virtual node's tests
+package mqtttest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/whereiskurt/meshtk/pkg/config"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// Node is the virtual node's number in Config
+const Node = 0x0000abcd
+
+// Config is a quiet config for Node with the default LongFast channel as 'primary'
+func Config() *config.Config {
+	c := &config.Config{Log: log.New(), Stdout: io.Discard}
+	c.Log.SetOutput(io.Discard)
+	c.NodeInfo.ClientId = "!0000abcd"
+	c.Meshtastic.Channels = []config.Channel{{Slot: "primary", Name: "LongFast", EncryptKey: "AQ==", IsEncrypted: true, IsPrimary: true}}
+	return c
+}
+
+// Recorder is a broker connection that keeps every published envelope, see MqttClient.SetClient
+type Recorder struct {
+	paho.Client
+	mutex     sync.Mutex
+	envelopes []*meshtastic.ServiceEnvelope
+}
+
+func (r *Recorder) Publish(topic string, qos byte, retained bool, payload any) paho.Token {
+	envelope := new(meshtastic.ServiceEnvelope)
+	if err := proto.Unmarshal(payload.([]byte), envelope); err == nil {
+		r.mutex.Lock()
+		r.envelopes = append(r.envelopes, envelope)
+		r.mutex.Unlock()
+	}
+	return doneToken{}
+}
+
+// Envelopes are the envelopes published so far, oldest first
+func (r *Recorder) Envelopes() []*meshtastic.ServiceEnvelope {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*meshtastic.ServiceEnvelope(nil), r.envelopes...)
+}
+
+func (r *Recorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.envelopes)
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// Decrypt reads a packet encrypted with the channel's expanded AES key, the nonce is the packet id then the sender
+func Decrypt(key []byte, packet *meshtastic.MeshPacket) (*meshtastic.Data, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint32(nonce[0:], packet.GetId())
+	binary.LittleEndian.PutUint32(nonce[8:], packet.GetFrom())
+	plain := make([]byte, len(packet.GetEncrypted()))
+	cipher.NewCTR(block, nonce).XORKeyStream(plain, packet.GetEncrypted())
+
+	data := new(meshtastic.Data)
+	if err := proto.Unmarshal(plain, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -12,12 +12,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	SeenByLimit   = 10
 	NeighborLimit = 100
+	RouteLimit    = 100
 )
 
 func cleanFloat(f float32) float32 {
@@ -33,6 +36,13 @@ type NeighborInfo struct {
 	Updated int64   `json:"updated"`
 }
 
+// RouteInfo is the path from a node to another, from a traceroute response heard on MQTT
+type RouteInfo struct {
+	Hops    []uint32 `json:"hops,omitempty"` // nodes in between, 0xffffffff is a hop that didn't add itself
+	Snr     []int32  `json:"snr,omitempty"`  // dB x4 heard at each hop then the destination, -128 is unknown
+	Updated int64    `json:"updated"`
+}
+
 type Node struct {
 	From    uint32 `json:"from"`
 	FromStr string `json:"fromStr"`
@@ -42,6 +52,11 @@ type Node struct {
 	HwModel   string `json:"hwModel"`
 	Role      string `json:"role"`
 	PubKey    string `json:"pubkey,omitempty"`
+	// PubKey pinning (trust-on-first-use)
+	PubKeyFirstSeen int64  `json:"pubkeyFirstSeen,omitempty"`
+	PubKeyChanges   int    `json:"pubkeyChanges,omitempty"`
+	PubKeyChangedAt int64  `json:"pubkeyChangedAt,omitempty"`
+	PendingPubKey   string `json:"pendingPubkey,omitempty"` // rejected new key, PKI is refused until trusted
 	// MapReport
 	FwVersion        string `json:"fwVersion,omitempty"`
 	Region           string `json:"region,omitempty"`
@@ -75,8 +90,19 @@ type Node struct {
 	LastEnvironmentMetrics int64   `json:"lastEnvironmentMetrics,omitempty"`
 	// NeighborInfo
 	Neighbors map[uint32]*NeighborInfo `json:"neighbors,omitempty"`
+	// StoreAndForward router heartbeat
+	StoreForwardPeriod uint32 `json:"storeForwardPeriod,omitempty"`
+	LastStoreForward   int64  `json:"lastStoreForward,omitempty"`
+	// ATAK plugin
+	Callsign string `json:"callsign,omitempty"`
+	Team     string `json:"team,omitempty"`
+	LastTak  int64  `json:"lastTak,omitempty"`
+	// Traceroute paths to other nodes, keyed by destination
+	Routes map[uint32]*RouteInfo `json:"routes,omitempty"`
 	// key=mqtt topic, value=first seen/last position update
 	SeenBy map[string]int64 `json:"seenBy"`
+	// Copies of the node's packets dropped because another gateway or topic delivered them first
+	Duplicates uint64 `json:"duplicates,omitempty"`
 }
 
 func NewNode(topic string) *Node {
@@ -165,6 +191,24 @@ func (node *Node) Prune(seenByTtl, neighborTtl, metricsTtl, mapReportTtl int64)
 		}
 		delete(node.Neighbors, toDelete)
 	}
+	// Routes
+	for to, route := range node.Routes {
+		if route.Updated+neighborTtl < now {
+			delete(node.Routes, to)
+		}
+	}
+	if len(node.Routes) == 0 {
+		node.Routes = nil
+	}
+	for len(node.Routes) > RouteLimit {
+		var toDelete uint32
+		for to, route := range node.Routes {
+			if toDelete == 0 || route.Updated < node.Routes[toDelete].Updated {
+				toDelete = to
+			}
+		}
+		delete(node.Routes, toDelete)
+	}
 	// DeviceMetrics
 	if node.LastDeviceMetrics > 0 && node.LastDeviceMetrics+metricsTtl < now {
 		node.ClearDeviceMetrics()
@@ -221,6 +265,28 @@ func (node *Node) UpdateNeighborInfo(neighborNum uint32, snr float32) {
 	}
 }
 
+func (node *Node) UpdateRoute(to uint32, hops []uint32, snr []int32) {
+	if node.Routes == nil {
+		node.Routes = make(map[uint32]*RouteInfo)
+	}
+	node.Routes[to] = &RouteInfo{
+		Hops:    hops,
+		Snr:     snr,
+		Updated: time.Now().Unix(),
+	}
+}
+
+func (node *Node) UpdateStoreForward(period uint32) {
+	node.StoreForwardPeriod = period
+	node.LastStoreForward = time.Now().Unix()
+}
+
+func (node *Node) UpdateTak(callsign, team string) {
+	node.Callsign = callsign
+	node.Team = team
+	node.LastTak = time.Now().Unix()
+}
+
 func (node *Node) UpdatePosition(latitude, longitude, altitude int32, precision uint32) {
 	node.Latitude = latitude
 	node.Longitude = longitude
@@ -232,7 +298,13 @@ func (node *Node) UpdateSeenBy(topic string) {
 	node.SeenBy[topic] = time.Now().Unix()
 }
 
-func (node *Node) UpdateUser(from uint32, longName, shortName, hwModel, role string, pubkey []byte) {
+// AddDuplicate counts a dropped copy, the topic it came through still heard the node
+func (node *Node) AddDuplicate(topic string) {
+	node.Duplicates++
+	node.UpdateSeenBy(topic)
+}
+
+func (node *Node) UpdateUser(from uint32, longName, shortName, hwModel, role string, pubkey []byte, policy KeyPolicy) KeyEvent {
 	node.From = from
 	node.FromStr = fmt.Sprintf("!%08x", from)
 	node.LongName = longName
@@ -240,8 +312,102 @@ func (node *Node) UpdateUser(from uint32, longName, shortName, hwModel, role str
 	node.HwModel = hwModel
 	node.Role = role
 	if len(pubkey) > 0 {
-		node.PubKey = fmt.Sprintf("0x%x", pubkey)
+		return node.PinPubKey(fmt.Sprintf("0x%x", pubkey), policy)
+	}
+	return KeyUnchanged
+}
+
+// KeyPolicy decides what happens when a node announces a different public key than the pinned one
+type KeyPolicy string
+
+const (
+	KeyPolicyAccept KeyPolicy = "accept" // replace the pinned key quietly
+	KeyPolicyWarn   KeyPolicy = "warn"   // replace the pinned key and raise a security event
+	KeyPolicyReject KeyPolicy = "reject" // keep the pinned key and refuse PKI until the new key is trusted
+)
+
+// ParseKeyPolicy reads NodeInfo.PKI.KeyChangePolicy, empty is the default 'warn'
+func ParseKeyPolicy(s string) (KeyPolicy, error) {
+	switch policy := KeyPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case "":
+		return KeyPolicyWarn, nil
+	case KeyPolicyAccept, KeyPolicyWarn, KeyPolicyReject:
+		return policy, nil
+	}
+	return KeyPolicyReject, fmt.Errorf("unknown KeyChangePolicy '%s' (accept, warn or reject)", s)
+}
+
+type KeyEvent string
+
+const (
+	KeyUnchanged KeyEvent = ""
+	KeyPinned    KeyEvent = "PUBKEY_PINNED"
+	KeyChanged   KeyEvent = "PUBKEY_CHANGED"
+	KeyRejected  KeyEvent = "PUBKEY_REJECTED"
+)
+
+// PinPubKey trusts the first key seen for a node and applies the policy to any later change.
+// Only accept and warn replace the pinned key, anything else is treated as reject.
+func (node *Node) PinPubKey(pubkey string, policy KeyPolicy) KeyEvent {
+	now := time.Now().Unix()
+	switch {
+	case node.PubKey == "":
+		node.PubKey = pubkey
+		node.PubKeyFirstSeen = now
+		return KeyPinned
+	case node.PubKey == pubkey:
+		if node.PubKeyFirstSeen == 0 {
+			node.PubKeyFirstSeen = now
+		}
+		// back on the pinned key, a rejected key no longer holds up PKI
+		node.PendingPubKey = ""
+		return KeyUnchanged
+	case policy == KeyPolicyAccept || policy == KeyPolicyWarn:
+		node.PubKey = pubkey
+		node.PendingPubKey = ""
+		node.PubKeyFirstSeen = now
+		node.PubKeyChanges++
+		node.PubKeyChangedAt = now
+		return KeyChanged
+	default:
+		if node.PendingPubKey == pubkey {
+			return KeyUnchanged
+		}
+		node.PendingPubKey = pubkey
+		node.PubKeyChanges++
+		node.PubKeyChangedAt = now
+		return KeyRejected
+	}
+}
+
+// TrustPendingPubKey promotes a rejected key to be the pinned key
+func (node *Node) TrustPendingPubKey() bool {
+	if node.PendingPubKey == "" {
+		return false
+	}
+	node.PubKey = node.PendingPubKey
+	node.PendingPubKey = ""
+	node.PubKeyFirstSeen = time.Now().Unix()
+	return true
+}
+
+// ParseNodeId reads a node id as '!28a1b2c3', '0x28a1b2c3' or decimal
+func ParseNodeId(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	var id uint64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "!"):
+		id, err = strconv.ParseUint(s[1:], 16, 32)
+	case strings.HasPrefix(s, "0x"):
+		id, err = strconv.ParseUint(s[2:], 16, 32)
+	default:
+		id, err = strconv.ParseUint(s, 10, 32)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid node id '%s': %v", s, err)
 	}
+	return uint32(id), nil
 }
 
 type NodeDB map[uint32]*Node
@@ -0,0 +1,58 @@
+package mqtt
+
+import "testing"
+
+func TestPinPubKeyRejectThenPinnedAgain(t *testing.T) {
+	node := NewNode("msh/US/2/e/LongFast/!12345678")
+	if event := node.PinPubKey("0xaa", KeyPolicyReject); event != KeyPinned {
+		t.Fatalf("first key = %q, want %q", event, KeyPinned)
+	}
+	if event := node.PinPubKey("0xbb", KeyPolicyReject); event != KeyRejected {
+		t.Fatalf("different key = %q, want %q", event, KeyRejected)
+	}
+	if node.PubKey != "0xaa" || node.PendingPubKey != "0xbb" {
+		t.Fatalf("pinned %q pending %q, want 0xaa pending 0xbb", node.PubKey, node.PendingPubKey)
+	}
+	if event := node.PinPubKey("0xaa", KeyPolicyReject); event != KeyUnchanged {
+		t.Fatalf("pinned key again = %q, want unchanged", event)
+	}
+	if node.PendingPubKey != "" {
+		t.Errorf("pending key %q kept after the pinned key was announced again", node.PendingPubKey)
+	}
+}
+
+func TestPinPubKeyAcceptReplaces(t *testing.T) {
+	node := NewNode("msh/US/2/e/LongFast/!12345678")
+	node.PinPubKey("0xaa", KeyPolicyAccept)
+	if event := node.PinPubKey("0xbb", KeyPolicyAccept); event != KeyChanged || node.PubKey != "0xbb" {
+		t.Errorf("event %q key %q, want %q and 0xbb", event, node.PubKey, KeyChanged)
+	}
+}
+
+func TestParseKeyPolicy(t *testing.T) {
+	tests := map[string]KeyPolicy{
+		"accept":    KeyPolicyAccept,
+		"warn":      KeyPolicyWarn,
+		"":          KeyPolicyWarn,
+		"Reject":    KeyPolicyReject,
+		" REJECT  ": KeyPolicyReject,
+	}
+	for s, want := range tests {
+		if policy, err := ParseKeyPolicy(s); err != nil || policy != want {
+			t.Errorf("ParseKeyPolicy(%q) = %q, %v, want %q", s, policy, err, want)
+		}
+	}
+	for _, s := range []string{"rejct", "deny", "accept!"} {
+		if _, err := ParseKeyPolicy(s); err == nil {
+			t.Errorf("ParseKeyPolicy(%q) accepted", s)
+		}
+	}
+}
+
+func TestPinPubKeyUnknownPolicyRejects(t *testing.T) {
+	node := NewNode("msh/US/2/e/LongFast/!12345678")
+	node.PinPubKey("0xaa", "")
+	if event := node.PinPubKey("0xbb", "Reject"); event != KeyRejected || node.PubKey != "0xaa" {
+		t.Errorf("event %q key %q, want %q and the pinned 0xaa", event, node.PubKey, KeyRejected)
+	}
+}
@@ -0,0 +1,240 @@
+package mqtt
+
+/* PKI direct messages follow the firmware's CryptoEngine:
+      https://github.com/meshtastic/firmware/blob/master/src/mesh/CryptoEngine.cpp
+
+	The X25519 shared secret is hashed with SHA-256 and used as an AES-256 key for
+	AES-CCM (8 byte tag, 13 byte nonce). On the wire the payload is laid out as
+	[ciphertext][auth tag (8)][extra nonce (4)].
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	PKIAuthTagLen    = 8
+	PKIExtraNonceLen = 4
+	PKIOverhead      = PKIAuthTagLen + PKIExtraNonceLen // MESHTASTIC_PKC_OVERHEAD
+
+	ccmNonceLen = 13
+	ccmLenBytes = 15 - ccmNonceLen // 'L' in RFC 3610, the firmware uses L=2
+)
+
+var (
+	ErrPKINoPrivateKey    = errors.New("no PKI private key configured")
+	ErrPKIUnknownSender   = errors.New("sender is not in the node database")
+	ErrPKIUnknownKey      = errors.New("no public key known for node")
+	ErrPKIShortPayload    = errors.New("PKI payload is shorter than the PKI overhead")
+	ErrPKIAuthFailed      = errors.New("PKI authentication tag did not verify")
+	ErrPKIKeyChanged      = errors.New("node announced a new public key that has not been trusted")
+	ErrPKIPayloadTooLarge = errors.New("payload is too large for AES-CCM")
+)
+
+// PKIError carries the node and packet that a PKI operation failed on. Use
+// errors.Is against the ErrPKI* values to find out why.
+type PKIError struct {
+	Node     uint32
+	PacketId uint32
+	Err      error
+}
+
+func (e *PKIError) Error() string {
+	return fmt.Sprintf("pki node !%08x packet %d: %v", e.Node, e.PacketId, e.Err)
+}
+
+func (e *PKIError) Unwrap() error {
+	return e.Err
+}
+
+// PKINonce builds the 13 byte CCM nonce the same way initNonce() does in the firmware.
+func PKINonce(from, packetId, extraNonce uint32) []byte {
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint64(nonce[0:], uint64(packetId))
+	binary.LittleEndian.PutUint32(nonce[8:], from)
+	if extraNonce != 0 {
+		binary.LittleEndian.PutUint32(nonce[4:], extraNonce)
+	}
+	return nonce[:ccmNonceLen]
+}
+
+// DecryptPKI opens a PKI payload sent by 'from' with packet id 'packetId'.
+func DecryptPKI(privateKey, senderPublicKey []byte, from, packetId uint32, encrypted []byte) ([]byte, error) {
+	if len(encrypted) <= PKIOverhead {
+		return nil, ErrPKIShortPayload
+	}
+
+	sharedKey, err := GenerateSharedSecret(privateKey, senderPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+
+	ciphertextLen := len(encrypted) - PKIOverhead
+	ciphertext := encrypted[:ciphertextLen]
+	tag := encrypted[ciphertextLen : ciphertextLen+PKIAuthTagLen]
+	extraNonce := binary.LittleEndian.Uint32(encrypted[ciphertextLen+PKIAuthTagLen:])
+
+	return ccmOpen(block, PKINonce(from, packetId, extraNonce), ciphertext, tag)
+}
+
+// EncryptPKI seals 'plain' for the owner of 'recipientPublicKey', appending the tag and extra nonce.
+func EncryptPKI(privateKey, recipientPublicKey []byte, from, packetId, extraNonce uint32, plain []byte) ([]byte, error) {
+	sharedKey, err := GenerateSharedSecret(privateKey, recipientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+
+	ciphertext, tag, err := ccmSeal(block, PKINonce(from, packetId, extraNonce), plain)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(ciphertext)+PKIOverhead)
+	out = append(out, ciphertext...)
+	out = append(out, tag...)
+	out = binary.LittleEndian.AppendUint32(out, extraNonce)
+	return out, nil
+}
+
+// decryptWithPKI looks up the sender's public key in the node database and opens the packet.
+func (c *MqttClient) decryptWithPKI(from, packetId uint32, encrypted []byte) ([]byte, error) {
+	if len(c.pkiPrivateKey) == 0 {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: ErrPKINoPrivateKey}
+	}
+
+	//Do we have the senders public key?
+	node, exists := (*c.nodes)[from]
+	if !exists {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: ErrPKIUnknownSender}
+	}
+	if len(node.PubKey) == 0 {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: ErrPKIUnknownKey}
+	}
+	if node.PendingPubKey != "" {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: ErrPKIKeyChanged}
+	}
+
+	publicKeyBytes, err := hex.DecodeString(strings.TrimPrefix(node.PubKey, "0x"))
+	if err != nil {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: fmt.Errorf("failed to read public key: %v", err)}
+	}
+
+	decrypted, err := DecryptPKI(c.pkiPrivateKey, publicKeyBytes, from, packetId, encrypted)
+	if err != nil {
+		return nil, &PKIError{Node: from, PacketId: packetId, Err: err}
+	}
+	return decrypted, nil
+}
+
+// ccmSeal implements AES-CCM (RFC 3610) with an 8 byte tag and no associated data.
+func ccmSeal(block cipher.Block, nonce, plain []byte) ([]byte, []byte, error) {
+	mac, err := ccmMac(block, nonce, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext := make([]byte, len(plain))
+	ctr := ccmCounter(nonce, 1)
+	cipher.NewCTR(block, ctr).XORKeyStream(ciphertext, plain)
+
+	tag := make([]byte, PKIAuthTagLen)
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, ccmCounter(nonce, 0))
+	subtle.XORBytes(tag, mac[:PKIAuthTagLen], s0[:PKIAuthTagLen])
+
+	return ciphertext, tag, nil
+}
+
+func ccmOpen(block cipher.Block, nonce, ciphertext, tag []byte) ([]byte, error) {
+	if len(ciphertext) >= 1<<(8*ccmLenBytes) {
+		return nil, ErrPKIPayloadTooLarge
+	}
+
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, ccmCounter(nonce, 1)).XORKeyStream(plain, ciphertext)
+
+	mac, err := ccmMac(block, nonce, plain)
+	if err != nil {
+		return nil, err
+	}
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, ccmCounter(nonce, 0))
+	expected := make([]byte, PKIAuthTagLen)
+	subtle.XORBytes(expected, mac[:PKIAuthTagLen], s0[:PKIAuthTagLen])
+
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, ErrPKIAuthFailed
+	}
+	return plain, nil
+}
+
+// ccmMac is the CBC-MAC over B_0 and the plaintext blocks.
+func ccmMac(block cipher.Block, nonce, plain []byte) ([]byte, error) {
+	if len(plain) >= 1<<(8*ccmLenBytes) {
+		return nil, ErrPKIPayloadTooLarge
+	}
+
+	b := make([]byte, aes.BlockSize)
+	b[0] = byte(((PKIAuthTagLen-2)/2)<<3 | (ccmLenBytes - 1))
+	copy(b[1:], nonce)
+	binary.BigEndian.PutUint16(b[aes.BlockSize-ccmLenBytes:], uint16(len(plain)))
+
+	x := make([]byte, aes.BlockSize)
+	block.Encrypt(x, b)
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		end := min(i+aes.BlockSize, len(plain))
+		subtle.XORBytes(x, x, plain[i:end])
+		block.Encrypt(x, x)
+	}
+	return x, nil
+}
+
+// ccmCounter returns the A_i counter block for the nonce.
+func ccmCounter(nonce []byte, i uint16) []byte {
+	a := make([]byte, aes.BlockSize)
+	a[0] = ccmLenBytes - 1
+	copy(a[1:], nonce)
+	binary.BigEndian.PutUint16(a[aes.BlockSize-ccmLenBytes:], i)
+	return a
+}
+
+// ParseKey reads a 32 byte X25519 key as '0x' hex (like meshtk.yaml) or base64 (like the meshtastic apps)
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	var key []byte
+	var err error
+	if strings.HasPrefix(s, "0x") || len(s) == 64 {
+		key, err = hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	} else {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		// the key may be a private key, so only its length goes into the error
+		return nil, fmt.Errorf("failed to decode %d character key: %v", len(s), err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// FormatKey writes a key in the '0x' hex form used by meshtk.yaml and the NodeDB
+func FormatKey(key []byte) string {
+	return fmt.Sprintf("0x%x", key)
+}
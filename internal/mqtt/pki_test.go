@@ -0,0 +1,158 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// firmwarePKI is a direct message captured from the firmware, the vector in its test/test_crypto suite
+var firmwarePKI = struct {
+	privateKey, senderPublicKey string
+	from, packetId              uint32
+	radio                       string // the 16 byte radio header then the encrypted payload
+	nonce, plain                string
+}{
+	privateKey:      "a00330633e63522f8a4d81ec6d9d1e6617f6c8ffd3a4c698229537d44e522277",
+	senderPublicKey: "db18fc50eea47f00251cb784819a3cf5fc361882597f589f0d7ff820e8064457",
+	from:            0x0929,
+	packetId:        0x13b2d662,
+	radio:           "8c646d7a2909000062d6b2136b00000040df24abfcc30a17a3d9046726099e796a1c036a792b",
+	nonce:           "62d6b213036a792b2909000000",
+	plain:           "08011204746573744800", // Data{portnum: TEXT_MESSAGE_APP, payload: 'test'}
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func firmwarePayload(t *testing.T) []byte {
+	return unhex(t, firmwarePKI.radio)[16:]
+}
+
+func TestDecryptPKIFirmwarePacket(t *testing.T) {
+	plain, err := DecryptPKI(unhex(t, firmwarePKI.privateKey), unhex(t, firmwarePKI.senderPublicKey), firmwarePKI.from, firmwarePKI.packetId, firmwarePayload(t))
+	if err != nil {
+		t.Fatalf("DecryptPKI: %v", err)
+	}
+	if want := unhex(t, firmwarePKI.plain); !bytes.Equal(plain, want) {
+		t.Errorf("plain = %x, want %x", plain, want)
+	}
+}
+
+func TestPKINonceFirmware(t *testing.T) {
+	payload := firmwarePayload(t)
+	extraNonce := binary.LittleEndian.Uint32(payload[len(payload)-4:])
+	nonce := PKINonce(firmwarePKI.from, firmwarePKI.packetId, extraNonce)
+	if want := unhex(t, firmwarePKI.nonce); !bytes.Equal(nonce, want) {
+		t.Errorf("nonce = %x, want %x", nonce, want)
+	}
+}
+
+func TestEncryptPKIRoundTrip(t *testing.T) {
+	private := unhex(t, firmwarePKI.privateKey)
+	public := unhex(t, firmwarePKI.senderPublicKey)
+	plain := []byte("a direct message that's longer than one AES block")
+	encrypted, err := EncryptPKI(private, public, 0x1234, 0x5678, 0x9abc, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) != len(plain)+PKIOverhead {
+		t.Errorf("encrypted %d bytes, want %d", len(encrypted), len(plain)+PKIOverhead)
+	}
+	// X25519 is symmetric, the same pair of keys opens it
+	decrypted, err := DecryptPKI(private, public, 0x1234, 0x5678, encrypted)
+	if err != nil || !bytes.Equal(decrypted, plain) {
+		t.Errorf("decrypted %q, %v", decrypted, err)
+	}
+}
+
+func TestDecryptPKIFailures(t *testing.T) {
+	private := unhex(t, firmwarePKI.privateKey)
+	public := unhex(t, firmwarePKI.senderPublicKey)
+
+	badTag := firmwarePayload(t)
+	badTag[len(badTag)-PKIOverhead] ^= 0x01
+	if _, err := DecryptPKI(private, public, firmwarePKI.from, firmwarePKI.packetId, badTag); !errors.Is(err, ErrPKIAuthFailed) {
+		t.Errorf("bad tag: %v, want %v", err, ErrPKIAuthFailed)
+	}
+
+	badCiphertext := firmwarePayload(t)
+	badCiphertext[0] ^= 0x01
+	if _, err := DecryptPKI(private, public, firmwarePKI.from, firmwarePKI.packetId, badCiphertext); !errors.Is(err, ErrPKIAuthFailed) {
+		t.Errorf("bad ciphertext: %v, want %v", err, ErrPKIAuthFailed)
+	}
+
+	if _, err := DecryptPKI(private, public, firmwarePKI.from, firmwarePKI.packetId+1, firmwarePayload(t)); !errors.Is(err, ErrPKIAuthFailed) {
+		t.Errorf("wrong packet id: %v, want %v", err, ErrPKIAuthFailed)
+	}
+
+	short := firmwarePayload(t)[:PKIOverhead]
+	if _, err := DecryptPKI(private, public, firmwarePKI.from, firmwarePKI.packetId, short); !errors.Is(err, ErrPKIShortPayload) {
+		t.Errorf("short payload: %v, want %v", err, ErrPKIShortPayload)
+	}
+}
+
+func TestDecryptWithPKINodeDB(t *testing.T) {
+	private := unhex(t, firmwarePKI.privateKey)
+	pinned := NewNode("msh/US/2/e/PKI/!00000929")
+	pinned.PubKey = "0x" + firmwarePKI.senderPublicKey
+	pending := NewNode("msh/US/2/e/PKI/!00000929")
+	pending.PubKey, pending.PendingPubKey = pinned.PubKey, "0xbb"
+
+	tests := []struct {
+		name    string
+		private []byte
+		nodes   NodeDB
+		want    error
+	}{
+		{"decrypts", private, NodeDB{firmwarePKI.from: pinned}, nil},
+		{"no private key", nil, NodeDB{firmwarePKI.from: pinned}, ErrPKINoPrivateKey},
+		{"unknown sender", private, NodeDB{}, ErrPKIUnknownSender},
+		{"unknown key", private, NodeDB{firmwarePKI.from: NewNode("msh/US/2/e/PKI/!00000929")}, ErrPKIUnknownKey},
+		{"key changed", private, NodeDB{firmwarePKI.from: pending}, ErrPKIKeyChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &MqttClient{pkiPrivateKey: tt.private, nodes: &tt.nodes}
+			plain, err := c.decryptWithPKI(firmwarePKI.from, firmwarePKI.packetId, firmwarePayload(t))
+			if tt.want == nil {
+				if err != nil || !bytes.Equal(plain, unhex(t, firmwarePKI.plain)) {
+					t.Errorf("plain %x, %v", plain, err)
+				}
+				return
+			}
+			var pkiErr *PKIError
+			if !errors.As(err, &pkiErr) || !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want a *PKIError wrapping %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeyErrorHidesKey(t *testing.T) {
+	// a private key with one mistyped character, and one cut short
+	for _, key := range []string{
+		"0xa00330633e63522f8a4d81ec6d9d1e6617f6c8ffd3a4c698229537d44e52227z",
+		"oAMwYz5jUi+KTYHsbZ0eZhf2yP/TpMaYIpU31E5SIn",
+	} {
+		_, err := ParseKey(key)
+		if err == nil {
+			t.Fatalf("ParseKey(%q) accepted", key)
+		}
+		if strings.Contains(err.Error(), key[4:20]) {
+			t.Errorf("error %q repeats the key", err)
+		}
+	}
+	if key, err := ParseKey("oAMwYz5jUi+KTYHsbZ0eZhf2yP/TpMaYIpU31E5SInc="); err != nil || len(key) != 32 {
+		t.Errorf("ParseKey(base64) = %x, %v", key, err)
+	}
+}
@@ -1,11 +1,11 @@
 package mqtt
 
 import (
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"path"
 	"strings"
 	"time"
 
@@ -65,7 +65,7 @@ func (c *MqttClient) PublishMessagePlain(from uint32, to uint32, topic string, p
 	envelope := &meshtastic.ServiceEnvelope{
 		Packet:    packet,
 		GatewayId: fmt.Sprintf("!%08x", from),
-		ChannelId: c.channel,
+		ChannelId: c.primary.Name,
 	}
 
 	// Serialize the envelope
@@ -85,33 +85,205 @@ func (c *MqttClient) PublishMessagePlain(from uint32, to uint32, topic string, p
 	return nil
 }
 
+// PublishMessageEncrypted sends on the primary channel
 func (c *MqttClient) PublishMessageEncrypted(from uint32, to uint32, topic string, portNum meshtastic.PortNum, payload []byte) error {
-	data := &meshtastic.Data{
+	return c.publishEncrypted(c.primary, from, to, topic, portNum, payload)
+}
+
+// PublishMessageSlot sends on the channel configured with slot name 'slot' (eg. 'primary')
+func (c *MqttClient) PublishMessageSlot(slot string, from uint32, to uint32, topic string, portNum meshtastic.PortNum, payload []byte) error {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	return c.publishEncrypted(ch, from, to, topic, portNum, payload)
+}
+
+func (c *MqttClient) publishEncrypted(ch *Channel, from uint32, to uint32, topic string, portNum meshtastic.PortNum, payload []byte) error {
+	_, err := c.publishDataEncrypted(ch, from, to, topic, &meshtastic.Data{
 		Portnum: portNum,
 		Payload: payload,
+	})
+	return err
+}
+
+// publishDataEncrypted sends a prepared Data on a channel, returning the packet id
+func (c *MqttClient) publishDataEncrypted(ch *Channel, from uint32, to uint32, topic string, data *meshtastic.Data) (uint32, error) {
+	o, err := c.prepareEncrypted(ch, from, to, topic, data, false)
+	if err != nil {
+		return 0, err
+	}
+	return o.id, c.publish(o)
+}
+
+// outgoing is a serialized ServiceEnvelope, kept so a retry goes out with the same packet id
+type outgoing struct {
+	id       uint32
+	to       uint32
+	topic    string
+	envelope []byte
+	data     *meshtastic.Data
+}
+
+func (c *MqttClient) publish(o *outgoing) error {
+	token := c.client.Publish(o.topic, 0, false, o.envelope)
+	<-token.Done()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to publish message: %v", err)
+	}
+	return nil
+}
+
+func (c *MqttClient) prepareEncrypted(ch *Channel, from uint32, to uint32, topic string, data *meshtastic.Data, wantAck bool) (*outgoing, error) {
+	// Create a random message ID
+	messageID, err := randomUint32()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate message ID: %v", err)
 	}
 
+	return c.sealEncrypted(ch, from, &meshtastic.MeshPacket{
+		From:    from,
+		To:      to,
+		Id:      messageID,
+		WantAck: wantAck,
+		RxTime:  uint32(time.Now().Unix()),
+	}, topic, data)
+}
+
+// Relay publishes Data on the channel in 'slot' as a packet from another node, keeping its id and
+// receive time, the way a Store & Forward router replays history. It goes out through our gateway.
+func (c *MqttClient) Relay(channelTopic string, slot string, from, id, to, rxTime uint32, data *meshtastic.Data) error {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	o, err := c.sealEncrypted(ch, c.nodeNum, &meshtastic.MeshPacket{
+		From:   from,
+		To:     to,
+		Id:     id,
+		RxTime: rxTime,
+	}, c.gatewayTopic(channelTopic, ch.Name), data)
+	if err != nil {
+		return err
+	}
+	return c.publish(o)
+}
+
+// sealEncrypted encrypts data with the channel's key into the packet and wraps it in a ServiceEnvelope from 'gateway'
+func (c *MqttClient) sealEncrypted(ch *Channel, gateway uint32, packet *meshtastic.MeshPacket, topic string, data *meshtastic.Data) (*outgoing, error) {
 	// Serialize the data
 	dataBytes, err := proto.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("failed to serialize data: %v", err)
+		return nil, fmt.Errorf("failed to serialize data: %v", err)
 	}
 
-	// Create a random message ID
-	msgID := make([]byte, 4)
-	if _, err := rand.Read(msgID); err != nil {
-		return fmt.Errorf("failed to generate message ID: %v", err)
+	// Encrypt the data with the channel's AES key
+	encrypted := ch.crypt(packet.From, packet.Id, dataBytes)
+	if err := checkPacketSize(encrypted); err != nil {
+		return nil, err
 	}
-	messageID := binary.LittleEndian.Uint32(msgID)
 
-	// Encrypt the data with AES-256
-	nonce := make([]byte, 16)
-	binary.LittleEndian.PutUint32(nonce[0:], messageID)
-	binary.LittleEndian.PutUint32(nonce[8:], from)
-	encrypted := make([]byte, len(dataBytes))
-	cipher.NewCTR(c.blockCipher, nonce).XORKeyStream(encrypted, dataBytes)
+	// Put the encrypted data in the PayloadVariant
+	packet.PayloadVariant = &meshtastic.MeshPacket_Encrypted{
+		Encrypted: encrypted,
+	}
+	packet.Channel = ch.Hash
+	packet.RxRssi = -20
+	packet.ViaMqtt = true
 
-	// Create MeshPacket with the encrypted data in the PayloadVariant
+	// Create ServiceEnvelope
+	envelope := &meshtastic.ServiceEnvelope{
+		Packet:    packet,
+		GatewayId: fmt.Sprintf("!%08x", gateway),
+		ChannelId: ch.Name,
+	}
+
+	// Serialize the envelope
+	envelopeBytes, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize envelope: %v", err)
+	}
+
+	return &outgoing{id: packet.Id, to: packet.To, topic: topic, envelope: envelopeBytes, data: data}, nil
+}
+
+// PublishMessagePKI sends a direct message encrypted to the recipient's public key from the NodeDB.
+// The packet goes out on the 'PKI' channel, the same way the firmware uplinks direct messages.
+func (c *MqttClient) PublishMessagePKI(from uint32, to uint32, topic string, portNum meshtastic.PortNum, payload []byte) error {
+	_, err := c.PublishDataPKI(from, to, topic, &meshtastic.Data{
+		Portnum: portNum,
+		Payload: payload,
+	})
+	return err
+}
+
+// PublishDataPKI is PublishMessagePKI for a prepared Data (eg. with WantResponse set), returning the packet id
+func (c *MqttClient) PublishDataPKI(from uint32, to uint32, topic string, data *meshtastic.Data) (uint32, error) {
+	o, err := c.preparePKI(from, to, topic, data, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.publish(o); err != nil {
+		return 0, err
+	}
+	c.log.Tracef("published PKI message to %s for !%08x: %s", topic, to, data)
+	return o.id, nil
+}
+
+// CanPKI is nil when a direct message to 'to' can be PKI encrypted, otherwise the *PKIError saying why not
+func (c *MqttClient) CanPKI(to uint32) error {
+	_, err := c.recipientKey(to)
+	return err
+}
+
+func (c *MqttClient) recipientKey(to uint32) ([]byte, error) {
+	if len(c.pkiPrivateKey) == 0 {
+		return nil, &PKIError{Node: to, Err: ErrPKINoPrivateKey}
+	}
+	node, exists := (*c.nodes)[to]
+	if !exists || len(node.PubKey) == 0 {
+		return nil, &PKIError{Node: to, Err: ErrPKIUnknownKey}
+	}
+	if node.PendingPubKey != "" {
+		return nil, &PKIError{Node: to, Err: ErrPKIKeyChanged}
+	}
+	recipientKey, err := hex.DecodeString(strings.TrimPrefix(node.PubKey, "0x"))
+	if err != nil || len(recipientKey) != 32 {
+		return nil, &PKIError{Node: to, Err: fmt.Errorf("%w: invalid stored key '%s'", ErrPKIUnknownKey, node.PubKey)}
+	}
+	return recipientKey, nil
+}
+
+func (c *MqttClient) preparePKI(from uint32, to uint32, topic string, data *meshtastic.Data, wantAck bool) (*outgoing, error) {
+	recipientKey, err := c.recipientKey(to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serialize the data
+	dataBytes, err := proto.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize data: %v", err)
+	}
+
+	messageID, err := randomUint32()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate message ID: %v", err)
+	}
+	extraNonce, err := randomUint32()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate extra nonce: %v", err)
+	}
+
+	encrypted, err := EncryptPKI(c.pkiPrivateKey, recipientKey, from, messageID, extraNonce, dataBytes)
+	if err != nil {
+		return nil, &PKIError{Node: to, PacketId: messageID, Err: err}
+	}
+	if err := checkPacketSize(encrypted); err != nil {
+		return nil, err
+	}
+
+	// PKI packets always use channel 0 and carry the recipient's public key
 	packet := &meshtastic.MeshPacket{
 		From: from,
 		To:   to,
@@ -119,34 +291,59 @@ func (c *MqttClient) PublishMessageEncrypted(from uint32, to uint32, topic strin
 		PayloadVariant: &meshtastic.MeshPacket_Encrypted{
 			Encrypted: encrypted,
 		},
-		Channel: uint32(GenerateChannelHash(c.channel, c.key)),
-		RxTime:  uint32(time.Now().Unix()),
-		RxRssi:  -20,
-		ViaMqtt: true,
+		Channel:      0,
+		WantAck:      wantAck,
+		PkiEncrypted: true,
+		PublicKey:    recipientKey,
+		RxTime:       uint32(time.Now().Unix()),
+		RxRssi:       -20,
+		ViaMqtt:      true,
 	}
 
 	// Create ServiceEnvelope
 	envelope := &meshtastic.ServiceEnvelope{
 		Packet:    packet,
 		GatewayId: fmt.Sprintf("!%08x", from),
-		ChannelId: c.channel,
+		ChannelId: PKIChannelId,
 	}
 
 	// Serialize the envelope
 	envelopeBytes, err := proto.Marshal(envelope)
 	if err != nil {
-		return fmt.Errorf("failed to serialize envelope: %v", err)
+		return nil, fmt.Errorf("failed to serialize envelope: %v", err)
 	}
 
-	// Publish the message
-	token := c.client.Publish(topic, 0, false, envelopeBytes)
-	<-token.Done()
-	if err := token.Error(); err != nil {
-		return fmt.Errorf("failed to publish message: %v", err)
-	}
+	return &outgoing{id: messageID, to: to, topic: topic, envelope: envelopeBytes, data: data}, nil
+}
 
-	return nil
+// PublishReply answers a received packet the way it arrived: PKI direct messages get a direct
+// message back, direct messages on a channel get one on the same channel, and only broadcasts are
+// answered with a broadcast. The reply is threaded to the packet with ReplyId, long text is split
+// into parts, and direct replies wait for the ACK.
+func (c *MqttClient) PublishReply(p *Packet, portNum meshtastic.PortNum, payload []byte) ([]*Delivery, error) {
+	data := &meshtastic.Data{
+		Portnum: portNum,
+		Payload: payload,
+		ReplyId: p.Id,
+	}
+	if p.PkiEncrypted {
+		return c.sendParts(data, true, func(part *meshtastic.Data) (*outgoing, error) {
+			return c.preparePKI(c.nodeNum, p.From, c.GatewayTopic(PKIChannelId), part, true)
+		})
+	}
+	ch := p.Channel
+	if ch == nil {
+		ch = c.primary
+	}
+	to := uint32(BroadcastAddr)
+	if p.To != BroadcastAddr {
+		to = p.From
+	}
+	return c.sendParts(data, false, func(part *meshtastic.Data) (*outgoing, error) {
+		return c.prepareEncrypted(ch, c.nodeNum, to, c.GatewayTopic(ch.Name), part, to != BroadcastAddr)
+	})
 }
+
 func (c *MqttClient) PublishPosition(from uint32, to uint32, topic string, latitudeI, longitudeI, altitude int32, precision uint32) error {
 	// Create Position protobuf
 	position := &meshtastic.Position{
@@ -166,6 +363,22 @@ func (c *MqttClient) PublishPosition(from uint32, to uint32, topic string, latit
 	// Send the Position message
 	return c.PublishMessageEncrypted(from, to, topic, meshtastic.PortNum_POSITION_APP, positionBytes)
 }
+
+// PublishTelemetry broadcasts our metrics on the channel in 'slot', stamped now unless Time is set
+func (c *MqttClient) PublishTelemetry(slot string, telemetry *meshtastic.Telemetry) error {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	if telemetry.Time == 0 {
+		telemetry.Time = uint32(time.Now().Unix())
+	}
+	payload, err := proto.Marshal(telemetry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize telemetry: %v", err)
+	}
+	return c.publishEncrypted(ch, c.nodeNum, BroadcastAddr, c.GatewayTopic(ch.Name), meshtastic.PortNum_TELEMETRY_APP, payload)
+}
 func (c *MqttClient) PublishMapReport(from uint32, to uint32, topic string, longName, shortName string, hwModel meshtastic.HardwareModel, role meshtastic.Config_DeviceConfig_Role, firmwareVersion, region, modemPreset string, hasDefaultCh bool, onlineNodes uint32, latitudeI, longitudeI, altitude int32, precision uint32) error {
 	// Create MapReport protobuf
 	mapReport := &meshtastic.MapReport{
@@ -202,9 +415,9 @@ func xorHash(data []byte) int {
 	return hash
 }
 
+// GenerateChannelHash matches the firmware's Channels::generateHash, using the expanded key
 func GenerateChannelHash(name string, key string) int {
-	replacedKey := strings.ReplaceAll(strings.ReplaceAll(key, "-", "+"), "_", "/")
-	keyBytes, err := base64.StdEncoding.DecodeString(replacedKey)
+	keyBytes, err := expandKey(key)
 	if err != nil {
 		panic("failed to decode base64 key: " + err.Error())
 	}
@@ -213,3 +426,27 @@ func GenerateChannelHash(name string, key string) int {
 	result := hName ^ hKey
 	return result
 }
+
+// BroadcastAddr is the 'to' of packets sent to everyone on a channel
+const BroadcastAddr = 0xffffffff
+
+// PKIChannelId is the ServiceEnvelope channel the firmware uses for PKI direct messages
+const PKIChannelId = "PKI"
+
+// PKITopic swaps the channel name at the end of a topic (eg. msh/US/2/e/LongFast) for 'PKI'
+func PKITopic(channelTopic string) string {
+	return ChannelTopic(channelTopic, PKIChannelId)
+}
+
+// ChannelTopic swaps the channel name at the end of a topic (eg. msh/US/2/e/LongFast) for 'channelId'
+func ChannelTopic(channelTopic string, channelId string) string {
+	return path.Join(path.Dir(strings.TrimSuffix(channelTopic, "/")), channelId)
+}
+
+func randomUint32() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
@@ -0,0 +1,193 @@
+package mqtt
+
+/* Packet size limits follow the firmware's RadioInterface:
+      https://github.com/meshtastic/firmware/blob/master/src/mesh/RadioInterface.h
+
+	A LoRa frame is at most 255 bytes and the firmware's PacketHeader takes 16 of them, leaving
+	239 bytes for the encrypted Data. PKI packets also carry the 12 byte tag and extra nonce.
+	Anything larger is published to the broker fine, but real radios drop it.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	LoRaMaxPacketLen = 255 // MAX_LORA_PAYLOAD_LEN
+	LoRaHeaderLen    = 16  // sizeof(PacketHeader)
+	MaxEncryptedLen  = LoRaMaxPacketLen - LoRaHeaderLen
+)
+
+var ErrPacketTooLarge = errors.New("packet is too large for a LoRa frame")
+
+func checkPacketSize(encrypted []byte) error {
+	if len(encrypted) > MaxEncryptedLen {
+		return fmt.Errorf("%w: %d encrypted bytes, at most %d fit", ErrPacketTooLarge, len(encrypted), MaxEncryptedLen)
+	}
+	return nil
+}
+
+// DataFits reports whether Data still fits in one frame once encrypted, PKI adds its overhead
+func DataFits(data *meshtastic.Data, pki bool) bool {
+	size := proto.Size(data)
+	if pki {
+		size += PKIOverhead
+	}
+	return size <= MaxEncryptedLen
+}
+
+// SplitText breaks text into parts numbered like '(1/3) ' that each fit, as reported by 'fits'.
+// Parts end on whitespace where possible and keep it, so a word cut in two (eg. a long URL)
+// joins back without a space. Text that already fits is returned as it is.
+func SplitText(text string, fits func(part string) bool) ([]string, error) {
+	if fits(text) {
+		return []string{text}, nil
+	}
+	for total := 2; ; {
+		// Leave room for the widest prefix, eg. '(10/10) '
+		width := len(partPrefix(total, total))
+		var parts []string
+		for remaining := text; remaining != ""; {
+			chunk := longestFit(remaining, func(s string) bool { return fits(strings.Repeat(" ", width) + s) })
+			if chunk == "" {
+				return nil, fmt.Errorf("%w: not even one character fits", ErrPacketTooLarge)
+			}
+			if len(chunk) < len(remaining) {
+				if i := strings.LastIndexAny(chunk, " \n\t"); i > 0 {
+					chunk = chunk[:i+1]
+				}
+			}
+			parts = append(parts, chunk)
+			remaining = remaining[len(chunk):]
+		}
+		if len(parts) > total {
+			total = len(parts)
+			continue
+		}
+		for i := range parts {
+			parts[i] = partPrefix(i+1, len(parts)) + parts[i]
+		}
+		return parts, nil
+	}
+}
+
+func partPrefix(part, total int) string {
+	return fmt.Sprintf("(%d/%d) ", part, total)
+}
+
+// longestFit is the longest prefix of s, cut on a rune boundary, that fits
+func longestFit(s string, fits func(string) bool) string {
+	var ends []int // byte offset after each rune
+	for i := 0; i < len(s); {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		ends = append(ends, i)
+	}
+	n := sort.Search(len(ends), func(i int) bool { return !fits(s[:ends[i]]) })
+	if n == 0 {
+		return ""
+	}
+	return s[:ends[n-1]]
+}
+
+var partPattern = regexp.MustCompile(`^\((\d+)/(\d+)\) `)
+
+// Reassembler stitches '(1/3) ' numbered text parts from the same sender back into one
+// packet. Anything else is handed on straight away. Parts that never complete are handed
+// on joined together after the timeout, so nothing is lost.
+type Reassembler struct {
+	timeout time.Duration
+	handler func(p *Packet)
+	pending map[string]*partial
+	mutex   sync.Mutex
+}
+
+type partial struct {
+	first *Packet
+	parts map[int][]byte
+	total int
+	timer *time.Timer
+}
+
+func NewReassembler(timeout time.Duration, handler func(p *Packet)) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		handler: handler,
+		pending: make(map[string]*partial),
+	}
+}
+
+// Handle is registered as a packet handler in place of the wrapped handler
+func (r *Reassembler) Handle(p *Packet) {
+	if p.PortNum != meshtastic.PortNum_TEXT_MESSAGE_APP || p.Emoji != 0 {
+		r.handler(p)
+		return
+	}
+	match := partPattern.FindSubmatch(p.Payload)
+	if match == nil {
+		r.handler(p)
+		return
+	}
+	part, _ := strconv.Atoi(string(match[1]))
+	total, _ := strconv.Atoi(string(match[2]))
+	if part < 1 || total < 2 || part > total {
+		r.handler(p)
+		return
+	}
+
+	key := fmt.Sprintf("%08x:%08x:%s:%d", p.From, p.To, p.ChannelId, total)
+	r.mutex.Lock()
+	pending, exists := r.pending[key]
+	if !exists {
+		pending = &partial{parts: make(map[int][]byte), total: total}
+		pending.timer = time.AfterFunc(r.timeout, func() { r.flush(key) })
+		r.pending[key] = pending
+	}
+	if part == 1 || pending.first == nil {
+		pending.first = p
+	}
+	pending.parts[part] = p.Payload[len(match[0]):]
+	complete := len(pending.parts) == total
+	r.mutex.Unlock()
+
+	if complete {
+		r.flush(key)
+	}
+}
+
+func (r *Reassembler) flush(key string) {
+	r.mutex.Lock()
+	pending, exists := r.pending[key]
+	delete(r.pending, key)
+	r.mutex.Unlock()
+	if !exists {
+		return
+	}
+	pending.timer.Stop()
+
+	var texts [][]byte
+	for i := 1; i <= pending.total; i++ {
+		if text, ok := pending.parts[i]; ok {
+			texts = append(texts, text)
+		}
+	}
+	combined := *pending.first
+	// Parts keep the whitespace they were split on, a part without it was cut mid-word
+	combined.Payload = bytes.Join(texts, nil)
+	if len(texts) < pending.total {
+		combined.Payload = append(combined.Payload, fmt.Sprintf(" [%d/%d parts]", len(texts), pending.total)...)
+	}
+	r.handler(&combined)
+}
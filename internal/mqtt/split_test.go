@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+)
+
+func TestSplitTextReassembles(t *testing.T) {
+	const limit = 40
+	fits := func(part string) bool { return len(part) <= limit }
+
+	tests := map[string]string{
+		"words":       "the quick brown fox jumps over the lazy dog and keeps on running past the barn until sunset",
+		"long word":   "see https://meshtastic.org/docs/configuration/radio/channels/#channel-settings-values for details",
+		"no spaces":   strings.Repeat("0123456789", 12),
+		"whitespace":  "line one\nline two  with  doubled  spaces\tand a tab that must all survive the trip",
+		"short":       "fits in one",
+		"trailing ws": "ends with whitespace that should come back exactly as it was sent   ",
+	}
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			parts, err := SplitText(text, fits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, part := range parts {
+				if !fits(part) {
+					t.Errorf("part %q is %d bytes, over %d", part, len(part), limit)
+				}
+			}
+
+			var got []string
+			r := NewReassembler(time.Minute, func(p *Packet) { got = append(got, string(p.Payload)) })
+			// parts can arrive out of order
+			for i := len(parts) - 1; i >= 0; i-- {
+				r.Handle(&Packet{From: 0x1234, To: BroadcastAddr, ChannelId: "LongFast", PortNum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte(parts[i])})
+			}
+			if len(got) != 1 || got[0] != text {
+				t.Errorf("reassembled %q from %q, want %q", got, parts, text)
+			}
+		})
+	}
+}
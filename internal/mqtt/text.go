@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/whereiskurt/meshtk/internal/unishox"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// SendText sends a TEXT_MESSAGE_APP packet from our node, see SendTextData
+func (c *MqttClient) SendText(channelTopic string, slot string, to uint32, text string) ([]*Delivery, error) {
+	return c.SendTextData(channelTopic, slot, to, &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(text),
+	})
+}
+
+// SendTextReply sends text that the apps thread under packet 'replyId'
+func (c *MqttClient) SendTextReply(channelTopic string, slot string, to uint32, replyId uint32, text string) ([]*Delivery, error) {
+	return c.SendTextData(channelTopic, slot, to, &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(text),
+		ReplyId: replyId,
+	})
+}
+
+// SendReaction sends a tapback, an emoji (eg. 👍) shown on packet 'replyId' instead of as a message
+func (c *MqttClient) SendReaction(channelTopic string, slot string, to uint32, replyId uint32, emoji string) ([]*Delivery, error) {
+	return c.SendTextData(channelTopic, slot, to, &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(emoji),
+		ReplyId: replyId,
+		Emoji:   1,
+	})
+}
+
+// SendTextPKI sends text that must only go PKI encrypted, eg. private mail. Unlike SendText it
+// never falls back to the channel, it fails with the *PKIError from CanPKI instead.
+func (c *MqttClient) SendTextPKI(channelTopic string, to uint32, text string) ([]*Delivery, error) {
+	if err := c.CanPKI(to); err != nil {
+		return nil, err
+	}
+	data := &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(text),
+	}
+	return c.sendParts(data, true, func(part *meshtastic.Data) (*outgoing, error) {
+		return c.preparePKI(c.nodeNum, to, c.gatewayTopic(channelTopic, PKIChannelId), part, true)
+	})
+}
+
+// SendTextData is Send for text that may not fit in one frame. Long text is split into
+// numbered parts, eg. '(1/3) ', sent in order until one of them isn't delivered.
+func (c *MqttClient) SendTextData(channelTopic string, slot string, to uint32, data *meshtastic.Data) ([]*Delivery, error) {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return nil, fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	// Direct messages leave room for the PKI overhead even if they fall back to the channel
+	pki := to != BroadcastAddr && len(c.pkiPrivateKey) > 0
+	return c.sendParts(data, pki, func(part *meshtastic.Data) (*outgoing, error) {
+		return c.prepareData(channelTopic, ch, to, part)
+	})
+}
+
+// Send publishes Data from our node and returns its final delivery state. Broadcasts go out
+// on the channel in 'slot'. Direct messages use PKI when we know the recipient's public key,
+// otherwise they fall back to the channel like older firmware, and wait for an ACK.
+// The uplink topic is built from 'channelTopic' (eg. msh/US/2/e/LongFast).
+func (c *MqttClient) Send(channelTopic string, slot string, to uint32, data *meshtastic.Data) (*Delivery, error) {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return nil, fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	o, err := c.prepareData(channelTopic, ch, to, data)
+	if err != nil {
+		return nil, err
+	}
+	return c.deliver(o)
+}
+
+func (c *MqttClient) prepareData(channelTopic string, ch *Channel, to uint32, data *meshtastic.Data) (*outgoing, error) {
+	wantAck := to != BroadcastAddr
+	if to != BroadcastAddr && len(c.pkiPrivateKey) > 0 {
+		o, err := c.preparePKI(c.nodeNum, to, c.gatewayTopic(channelTopic, PKIChannelId), data, wantAck)
+		if err == nil || !errors.Is(err, ErrPKIUnknownKey) {
+			return o, err
+		}
+		c.log.Warnf("no public key for !%08x, sending the direct message on the channel instead: %v", to, err)
+	}
+	return c.prepareEncrypted(ch, c.nodeNum, to, c.gatewayTopic(channelTopic, ch.Name), data, wantAck)
+}
+
+// compress swaps text for TEXT_MESSAGE_COMPRESSED_APP when enabled and the Unishox2 payload
+// is smaller, saving airtime. Reactions stay plain so the apps show them.
+func (c *MqttClient) compress(data *meshtastic.Data) *meshtastic.Data {
+	if !c.compressText || data.GetPortnum() != meshtastic.PortNum_TEXT_MESSAGE_APP || data.GetEmoji() != 0 {
+		return data
+	}
+	compressed := unishox.Compress(data.GetPayload())
+	if len(compressed) >= len(data.GetPayload()) {
+		return data
+	}
+	c.log.Tracef("compressed text from %d to %d bytes", len(data.GetPayload()), len(compressed))
+	wire := proto.Clone(data).(*meshtastic.Data)
+	wire.Portnum = meshtastic.PortNum_TEXT_MESSAGE_COMPRESSED_APP
+	wire.Payload = compressed
+	return wire
+}
+
+// sendParts splits TEXT_MESSAGE_APP payloads that don't fit one frame and delivers each part
+func (c *MqttClient) sendParts(data *meshtastic.Data, pki bool, prepare func(part *meshtastic.Data) (*outgoing, error)) ([]*Delivery, error) {
+	parts := []string{string(data.GetPayload())}
+	if data.GetPortnum() == meshtastic.PortNum_TEXT_MESSAGE_APP && data.GetEmoji() == 0 {
+		var err error
+		parts, err = SplitText(string(data.GetPayload()), func(part string) bool {
+			candidate := proto.Clone(data).(*meshtastic.Data)
+			candidate.Payload = []byte(part)
+			return DataFits(candidate, pki)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var deliveries []*Delivery
+	for _, text := range parts {
+		part := proto.Clone(data).(*meshtastic.Data)
+		part.Payload = []byte(text)
+		o, err := prepare(c.compress(part))
+		if err != nil {
+			return deliveries, err
+		}
+		o.data = part
+		d, err := c.deliver(o)
+		if d != nil {
+			deliveries = append(deliveries, d)
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		if d.State == DeliveryNak || d.State == DeliveryTimeout {
+			break
+		}
+	}
+	return deliveries, nil
+}
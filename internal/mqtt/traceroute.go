@@ -0,0 +1,170 @@
+package mqtt
+
+/* Traceroute follows the firmware's TraceRouteModule:
+      https://github.com/meshtastic/firmware/blob/master/src/modules/TraceRouteModule.cpp
+
+	The request is a TRACEROUTE_APP packet with want_response and an empty RouteDiscovery. Every
+	node that rebroadcasts it appends itself to route and its SNR (dB x4) to snr_towards, the
+	destination only appends its SNR. The response carries the RouteDiscovery back with request_id
+	set, and the nodes on the way back fill route_back and snr_back the same way. Traceroutes are
+	never PKI encrypted by the firmware, so the nodes in between can change them.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// UnknownSnr marks a hop whose SNR wasn't recorded, we hear everything over MQTT so ours is always unknown
+const UnknownSnr = math.MinInt8
+
+// routeSize is the most hops a RouteDiscovery holds in each direction (the firmware's max_count:8)
+const routeSize = 8
+
+var ErrTracerouteTimeout = errors.New("timed out waiting for traceroute response")
+
+// traces are the outstanding traceroute requests waiting on a response
+type traces struct {
+	pending map[uint32]chan *Packet
+	mutex   sync.Mutex
+}
+
+// Traceroute sends a request to 'to' on the channel in 'slot' and waits for the response. The
+// returned route has our unknown SNR appended to snr_back, as the firmware does when it arrives.
+func (c *MqttClient) Traceroute(slot string, to uint32, timeout time.Duration) (*meshtastic.RouteDiscovery, error) {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return nil, fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	payload, err := proto.Marshal(&meshtastic.RouteDiscovery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize route discovery: %v", err)
+	}
+	o, err := c.prepareEncrypted(ch, c.nodeNum, to, c.GatewayTopic(ch.Name), &meshtastic.Data{
+		Portnum:      meshtastic.PortNum_TRACEROUTE_APP,
+		Payload:      payload,
+		WantResponse: true,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := make(chan *Packet, 1)
+	c.traces.mutex.Lock()
+	c.traces.pending[o.id] = waiting
+	c.traces.mutex.Unlock()
+	defer func() {
+		c.traces.mutex.Lock()
+		delete(c.traces.pending, o.id)
+		c.traces.mutex.Unlock()
+	}()
+
+	if err := c.publish(o); err != nil {
+		return nil, err
+	}
+	c.log.Debugf(`{'traceroute': '!%08x', 'packetId': %d, 'channel': '%s'}`, to, o.id, ch.Name)
+
+	var p *Packet
+	select {
+	case p = <-waiting:
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%w: packet %d to !%08x", ErrTracerouteTimeout, o.id, to)
+	}
+
+	route := new(meshtastic.RouteDiscovery)
+	if err := proto.Unmarshal(p.Payload, route); err != nil {
+		return nil, fmt.Errorf("failed to parse traceroute response: %v", err)
+	}
+	insertUnknownHops(p, route, false)
+	route.SnrBack = append(route.SnrBack, UnknownSnr)
+	return route, nil
+}
+
+// resolveTraceroute hands a traceroute response to the request waiting on it
+func (c *MqttClient) resolveTraceroute(p *Packet) {
+	if p.PortNum != meshtastic.PortNum_TRACEROUTE_APP || p.RequestId == 0 || p.To != c.nodeNum {
+		return
+	}
+	c.traces.mutex.Lock()
+	waiting, exists := c.traces.pending[p.RequestId]
+	c.traces.mutex.Unlock()
+	if !exists {
+		return
+	}
+	select {
+	case waiting <- p:
+	default: // already answered, a duplicate from another gateway
+	}
+}
+
+// answerTraceroute responds to a traceroute request addressed to us. As the destination we only
+// append our SNR to snr_towards, the same way the firmware does, then send the route back.
+func (c *MqttClient) answerTraceroute(p *Packet) {
+	if p.PortNum != meshtastic.PortNum_TRACEROUTE_APP || p.RequestId != 0 || !p.WantResponse || p.To != c.nodeNum {
+		return
+	}
+	route := new(meshtastic.RouteDiscovery)
+	if err := proto.Unmarshal(p.Payload, route); err != nil {
+		c.log.Warnf("failed to parse traceroute request from !%08x: %v", p.From, err)
+		return
+	}
+	insertUnknownHops(p, route, true)
+	route.SnrTowards = append(route.SnrTowards, UnknownSnr)
+
+	payload, err := proto.Marshal(route)
+	if err != nil {
+		c.log.Errorf("failed to serialize traceroute response: %v", err)
+		return
+	}
+	data := &meshtastic.Data{
+		Portnum:   meshtastic.PortNum_TRACEROUTE_APP,
+		Payload:   payload,
+		RequestId: p.Id,
+	}
+
+	// Always on the channel like the firmware, even for a PKI request, so the nodes on the way back can add themselves
+	ch := p.Channel
+	if ch == nil {
+		ch = c.primary
+	}
+	o, err := c.prepareEncrypted(ch, c.nodeNum, p.From, c.GatewayTopic(ch.Name), data, false)
+	if err == nil {
+		err = c.publish(o)
+	}
+	if err != nil {
+		c.log.Warnf("failed to answer traceroute from !%08x: %v", p.From, err)
+		return
+	}
+	c.log.Debugf(`{'traceroute': 'response', 'to': '!%08x', 'requestId': %d, 'hops': %d}`, p.From, p.Id, len(route.GetRoute()))
+}
+
+// insertUnknownHops adds a broadcast address for every hop the packet took that didn't add itself
+// to the route, eg. a node running older firmware, so the SNRs still line up with the hops
+func insertUnknownHops(p *Packet, route *meshtastic.RouteDiscovery, towards bool) {
+	hops, snrs := &route.Route, &route.SnrTowards
+	if !towards {
+		hops, snrs = &route.RouteBack, &route.SnrBack
+	}
+	if p.HopStart != 0 && p.HopLimit <= p.HopStart {
+		for taken := min(int(p.HopStart-p.HopLimit), routeSize); len(*hops) < taken; {
+			*hops = append(*hops, BroadcastAddr)
+		}
+	}
+	for len(*snrs) < len(*hops) {
+		*snrs = append(*snrs, UnknownSnr)
+	}
+}
+
+// RouteSnr is a traceroute SNR in dB, false when it's unknown
+func RouteSnr(snr int32) (float32, bool) {
+	if snr == UnknownSnr {
+		return 0, false
+	}
+	return float32(snr) / 4, true
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/whereiskurt/meshtk/internal/mqtt/mqtttest"
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAnswerTracerouteOnChannel(t *testing.T) {
+	for _, pki := range []bool{false, true} {
+		c := mqtttest.Config()
+		nodes := make(NodeDB)
+		client := NewMqttClient(c, &nodes)
+		rec := new(mqtttest.Recorder)
+		client.SetClient(rec)
+
+		request, _ := proto.Marshal(&meshtastic.RouteDiscovery{Route: []uint32{0x11111111}, SnrTowards: []int32{24}})
+		client.answerTraceroute(&Packet{Id: 99, From: 0x12345678, To: mqtttest.Node, PortNum: meshtastic.PortNum_TRACEROUTE_APP,
+			Payload: request, WantResponse: true, PkiEncrypted: pki, HopStart: 3, HopLimit: 2})
+
+		envelopes := rec.Envelopes()
+		if len(envelopes) != 1 {
+			t.Fatalf("pki=%v: published %d responses, want 1", pki, len(envelopes))
+		}
+		packet := envelopes[0].GetPacket()
+		if envelopes[0].GetChannelId() != "LongFast" || packet.GetPkiEncrypted() || packet.GetChannel() != client.primary.Hash {
+			t.Errorf("pki=%v: response on %s pki=%v, want the LongFast channel", pki, envelopes[0].GetChannelId(), packet.GetPkiEncrypted())
+		}
+		data, err := mqtttest.Decrypt(DefaultPSK, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var route meshtastic.RouteDiscovery
+		if err := proto.Unmarshal(data.GetPayload(), &route); err != nil {
+			t.Fatal(err)
+		}
+		if data.GetRequestId() != 99 || len(route.GetSnrTowards()) != 2 || route.GetSnrTowards()[1] != UnknownSnr {
+			t.Errorf("pki=%v: response %v for request %d, want our unknown SNR appended", pki, &route, data.GetRequestId())
+		}
+	}
+}
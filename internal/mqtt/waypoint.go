@@ -0,0 +1,224 @@
+package mqtt
+
+/* Waypoints are WAYPOINT_APP broadcasts the apps draw on everyone's map:
+      https://github.com/meshtastic/protobufs/blob/master/meshtastic/mesh.proto
+
+	Sending the same id again replaces the waypoint, and the apps delete one by sending it with
+	expire set to 1. A waypoint with locked_to set can only be changed by that node.
+*/
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	meshtastic "github.com/whereiskurt/meshtk/protos/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// WaypointDeleted is the expire time the apps send to delete a waypoint
+const WaypointDeleted = 1
+
+var ErrWaypointLocked = errors.New("waypoint is locked to another node")
+
+type Waypoint struct {
+	Id          uint32 `json:"id"`
+	From        uint32 `json:"from"`
+	Latitude    int32  `json:"latitude"`
+	Longitude   int32  `json:"longitude"`
+	Expire      int64  `json:"expire,omitempty"` // epoch, 0 never expires
+	LockedTo    uint32 `json:"lockedTo,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"` // an emoji
+	Topic       string `json:"topic"`
+	Updated     int64  `json:"updated"`
+}
+
+func NewWaypoint(from uint32, topic string, w *meshtastic.Waypoint) *Waypoint {
+	waypoint := &Waypoint{
+		Id:          w.GetId(),
+		From:        from,
+		Latitude:    w.GetLatitudeI(),
+		Longitude:   w.GetLongitudeI(),
+		Expire:      int64(w.GetExpire()),
+		LockedTo:    w.GetLockedTo(),
+		Name:        w.GetName(),
+		Description: w.GetDescription(),
+		Topic:       topic,
+		Updated:     time.Now().Unix(),
+	}
+	if w.GetIcon() != 0 {
+		waypoint.Icon = string(rune(w.GetIcon()))
+	}
+	return waypoint
+}
+
+// Proto is the waypoint as it goes over the air
+func (w *Waypoint) Proto() *meshtastic.Waypoint {
+	latitude, longitude := w.Latitude, w.Longitude
+	waypoint := &meshtastic.Waypoint{
+		Id:          w.Id,
+		LatitudeI:   &latitude,
+		LongitudeI:  &longitude,
+		Expire:      uint32(w.Expire),
+		LockedTo:    w.LockedTo,
+		Name:        w.Name,
+		Description: w.Description,
+	}
+	if icon := []rune(w.Icon); len(icon) > 0 {
+		waypoint.Icon = uint32(icon[0])
+	}
+	return waypoint
+}
+
+func (w *Waypoint) Expired() bool {
+	return w.Expire != 0 && w.Expire <= time.Now().Unix()
+}
+
+// NewWaypointId is a random id, the same way the apps pick one
+func NewWaypointId() (uint32, error) {
+	return randomUint32()
+}
+
+// PublishWaypoint broadcasts the waypoint from us on the channel in 'slot'
+func (c *MqttClient) PublishWaypoint(slot string, w *Waypoint) error {
+	ch := c.keyring.BySlot(slot)
+	if ch == nil {
+		return fmt.Errorf("no channel configured for slot '%s'", slot)
+	}
+	payload, err := proto.Marshal(w.Proto())
+	if err != nil {
+		return fmt.Errorf("failed to serialize waypoint: %v", err)
+	}
+	w.From = c.nodeNum
+	w.Topic = ChannelTopic(c.topic, ch.Name)
+	return c.publishEncrypted(ch, c.nodeNum, BroadcastAddr, c.GatewayTopic(ch.Name), meshtastic.PortNum_WAYPOINT_APP, payload)
+}
+
+// WaypointTombstone is how long a deleted or expired waypoint is kept, so that every process
+// sharing the file merges the deletion instead of writing back its older copy
+const WaypointTombstone = time.Hour
+
+// WaypointDB is the waypoint store, several processes can share its file, see Merge
+type WaypointDB map[uint32]*Waypoint
+
+// Update adds or replaces a waypoint heard from a node, a deleted or expired one is kept as a tombstone
+func (db WaypointDB) Update(w *Waypoint) error {
+	if existing := db[w.Id]; existing != nil && !existing.Expired() && existing.LockedTo != 0 && existing.LockedTo != w.From {
+		return fmt.Errorf("%w: %d is locked to !%08x, not !%08x", ErrWaypointLocked, w.Id, existing.LockedTo, w.From)
+	}
+	db[w.Id] = w
+	return nil
+}
+
+// Merge takes the waypoints from 'other' (eg. the file another process wrote) that are newer than ours
+func (db WaypointDB) Merge(other WaypointDB) {
+	for id, w := range other {
+		if existing := db[id]; existing == nil || w.Updated > existing.Updated {
+			db[id] = w
+		}
+	}
+}
+
+// Prune drops tombstones once they're older than WaypointTombstone
+func (db WaypointDB) Prune() {
+	cutoff := time.Now().Add(-WaypointTombstone).Unix()
+	for id, w := range db {
+		if w.Expired() && w.Updated < cutoff {
+			delete(db, id)
+		}
+	}
+}
+
+// Sorted is the waypoints that haven't expired, most recently updated first
+func (db WaypointDB) Sorted() []*Waypoint {
+	var waypoints []*Waypoint
+	for _, w := range db {
+		if !w.Expired() {
+			waypoints = append(waypoints, w)
+		}
+	}
+	slices.SortFunc(waypoints, func(a, b *Waypoint) int {
+		return cmp.Or(cmp.Compare(b.Updated, a.Updated), cmp.Compare(a.Id, b.Id))
+	})
+	return waypoints
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// GeoJSON is a FeatureCollection with a Point for every waypoint that hasn't expired
+func (db WaypointDB) GeoJSON() ([]byte, error) {
+	collection := struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+
+	for _, w := range db.Sorted() {
+		feature := geoJSONFeature{Type: "Feature"}
+		feature.Geometry.Type = "Point"
+		// GeoJSON is longitude first
+		feature.Geometry.Coordinates = [2]float64{float64(w.Longitude) / 1e7, float64(w.Latitude) / 1e7}
+		feature.Properties = map[string]any{
+			"id":          w.Id,
+			"name":        w.Name,
+			"description": w.Description,
+			"icon":        w.Icon,
+			"from":        fmt.Sprintf("!%08x", w.From),
+			"updated":     time.Unix(w.Updated, 0).UTC().Format(time.RFC3339),
+		}
+		if w.Expire != 0 {
+			feature.Properties["expire"] = time.Unix(w.Expire, 0).UTC().Format(time.RFC3339)
+		}
+		if w.LockedTo != 0 {
+			feature.Properties["lockedTo"] = fmt.Sprintf("!%08x", w.LockedTo)
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	return json.MarshalIndent(collection, "", "  ")
+}
+
+func (db *WaypointDB) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(db)
+}
+
+func (db WaypointDB) WriteFile(path string) error {
+	dir, file := filepath.Split(path)
+	f, err := os.CreateTemp(dir, file)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(db)
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaypointDBMergeKeepsNewest(t *testing.T) {
+	now := time.Now().Unix()
+	ours := WaypointDB{
+		1: {Id: 1, Name: "stage", Updated: now - 60},
+		2: {Id: 2, Name: "first aid", Updated: now},
+	}
+	file := WaypointDB{
+		1: {Id: 1, Name: "main stage", Updated: now}, // changed by another process
+		2: {Id: 2, Name: "old first aid", Updated: now - 60},
+		3: {Id: 3, Name: "from a script", Updated: now}, // never heard by us
+	}
+	ours.Merge(file)
+	if ours[1].Name != "main stage" || ours[2].Name != "first aid" || ours[3] == nil {
+		t.Errorf("merged %v %v %v, want the newest of each", ours[1], ours[2], ours[3])
+	}
+}
+
+func TestWaypointDBDeletionSurvivesMerge(t *testing.T) {
+	now := time.Now().Unix()
+	db := WaypointDB{1: {Id: 1, From: 0x1234, Name: "stage", Updated: now - 60}}
+	stale := WaypointDB{1: {Id: 1, From: 0x1234, Name: "stage", Updated: now - 60}}
+
+	if err := db.Update(&Waypoint{Id: 1, From: 0x1234, Expire: WaypointDeleted, Updated: now}); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge(stale)
+	db.Prune()
+	if len(db.Sorted()) != 0 {
+		t.Errorf("deleted waypoint came back from an older copy: %v", db.Sorted())
+	}
+	if db[1] == nil {
+		t.Error("tombstone pruned before WaypointTombstone")
+	}
+
+	db[1].Updated = now - int64(2*WaypointTombstone/time.Second)
+	db.Prune()
+	if db[1] != nil {
+		t.Error("tombstone kept after WaypointTombstone")
+	}
+}
+
+func TestWaypointDBLocked(t *testing.T) {
+	db := WaypointDB{1: {Id: 1, From: 0x1234, LockedTo: 0x1234, Updated: time.Now().Unix()}}
+	if err := db.Update(&Waypoint{Id: 1, From: 0x5678}); !errors.Is(err, ErrWaypointLocked) {
+		t.Errorf("Update from another node = %v, want ErrWaypointLocked", err)
+	}
+	if err := db.Update(&Waypoint{Id: 1, From: 0x1234, Name: "moved"}); err != nil || db[1].Name != "moved" {
+		t.Errorf("Update from the owner = %v", err)
+	}
+}
+
+func TestWaypointDBFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waypoints.json")
+	db := WaypointDB{7: {Id: 7, Name: "camp", Latitude: 436532000, Longitude: -793832000, Updated: time.Now().Unix()}}
+	if err := db.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := make(WaypointDB)
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if w := loaded[7]; w == nil || *w != *db[7] {
+		t.Errorf("loaded %v, want %v", w, db[7])
+	}
+}
@@ -0,0 +1,144 @@
+package otp
+
+/* Time-based one-time passwords (RFC 6238) compatible with the usual authenticator apps:
+HMAC-SHA1, base32 secrets, 6 digits and a 30 second step by default.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDigits = 6
+	DefaultStep   = 30 * time.Second
+	DefaultSkew   = 1 // steps either side of now that are still accepted
+)
+
+var (
+	ErrInvalidCode  = errors.New("invalid one-time password")
+	ErrReplayedCode = errors.New("one-time password was already used")
+	ErrNoSecret     = errors.New("no one-time password secret")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// DecodeSecret reads a base32 secret, ignoring case, spaces and padding
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("secret is not base32: %v", err)
+	}
+	return key, nil
+}
+
+// NewSecret creates a random 160 bit base32 secret
+func NewSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(key), nil
+}
+
+// Code is the TOTP for the step containing 't'
+func Code(key []byte, t time.Time, step time.Duration, digits int) string {
+	return hotp(key, uint64(t.Unix()/int64(step/time.Second)), digits)
+}
+
+func hotp(key []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Verifier checks codes and remembers the ones already used, so a code overheard on
+// a public channel can't be replayed while it is still inside the validity window.
+type Verifier struct {
+	Step   time.Duration
+	Skew   int
+	Digits int
+	used   map[string]int64 // identity/counter -> expires
+	mutex  sync.Mutex
+}
+
+func NewVerifier(step time.Duration, skew int) *Verifier {
+	if step <= 0 {
+		step = DefaultStep
+	}
+	if skew < 0 {
+		skew = DefaultSkew
+	}
+	return &Verifier{
+		Step:   step,
+		Skew:   skew,
+		Digits: DefaultDigits,
+		used:   make(map[string]int64),
+	}
+}
+
+// Verify checks 'code' against 'key' for 'identity' (eg. the operator or command the secret belongs to)
+func (v *Verifier) Verify(identity string, key []byte, code string, now time.Time) error {
+	if len(key) == 0 {
+		return ErrNoSecret
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != v.Digits {
+		return ErrInvalidCode
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.expire(now)
+
+	stepSec := int64(v.Step / time.Second)
+	current := now.Unix() / stepSec
+	for i := -v.Skew; i <= v.Skew; i++ {
+		counter := current + int64(i)
+		if counter < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(counter), v.Digits)), []byte(code)) != 1 {
+			continue
+		}
+		usedKey := fmt.Sprintf("%s/%d", identity, counter)
+		if _, used := v.used[usedKey]; used {
+			return ErrReplayedCode
+		}
+		// Remember it until it can no longer validate
+		v.used[usedKey] = (counter + int64(v.Skew) + 1) * stepSec
+		return nil
+	}
+	return ErrInvalidCode
+}
+
+func (v *Verifier) expire(now time.Time) {
+	for k, expires := range v.used {
+		if expires < now.Unix() {
+			delete(v.used, k)
+		}
+	}
+}
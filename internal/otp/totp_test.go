@@ -0,0 +1,74 @@
+package otp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA-1 seed from RFC 6238 Appendix B
+var rfcKey = []byte("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		if code := Code(rfcKey, time.Unix(tt.unix, 0), DefaultStep, 8); code != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, code, tt.want)
+		}
+	}
+}
+
+func TestDecodeSecret(t *testing.T) {
+	key, err := DecodeSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil || string(key) != string(rfcKey) {
+		t.Errorf("DecodeSecret = %q, %v", key, err)
+	}
+	if _, err := DecodeSecret(""); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("empty secret: %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	v := NewVerifier(DefaultStep, DefaultSkew)
+	now := time.Unix(1111111111, 0)
+	code := Code(rfcKey, now, DefaultStep, DefaultDigits)
+
+	if err := v.Verify("operator:!33664ae0", rfcKey, code, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := v.Verify("operator:!33664ae0", rfcKey, code, now.Add(5*time.Second)); !errors.Is(err, ErrReplayedCode) {
+		t.Errorf("replay: %v, want %v", err, ErrReplayedCode)
+	}
+	// the counter is per identity, another operator with the same secret isn't affected
+	if err := v.Verify("operator:!12345678", rfcKey, code, now); err != nil {
+		t.Errorf("other identity: %v", err)
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	v := NewVerifier(DefaultStep, 1)
+	now := time.Unix(1234567890, 0)
+
+	if err := v.Verify("a", rfcKey, Code(rfcKey, now.Add(-DefaultStep), DefaultStep, DefaultDigits), now); err != nil {
+		t.Errorf("previous step: %v", err)
+	}
+	if err := v.Verify("a", rfcKey, Code(rfcKey, now.Add(-3*DefaultStep), DefaultStep, DefaultDigits), now); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("outside the skew: %v, want %v", err, ErrInvalidCode)
+	}
+	if err := v.Verify("a", rfcKey, "12345", now); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("short code: %v, want %v", err, ErrInvalidCode)
+	}
+	if err := v.Verify("a", nil, "123456", now); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("no key: %v, want %v", err, ErrNoSecret)
+	}
+}
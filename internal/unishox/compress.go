@@ -0,0 +1,320 @@
+package unishox
+
+import "unicode/utf8"
+
+type writer struct {
+	out  []byte
+	bits int
+}
+
+func (w *writer) append(c code) {
+	for i := c.len - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.out = append(w.out, 0)
+		}
+		if c.bits>>i&1 == 1 {
+			w.out[w.bits/8] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+// step writes a step code, 1 bits ended by a 0 bit unless the limit is reached
+func (w *writer) step(idx, limit int) {
+	bits := uint32(1)<<idx - 1
+	if idx < limit {
+		w.append(code{bits << 1, idx + 1})
+		return
+	}
+	w.append(code{bits, idx})
+}
+
+func (w *writer) count(n int) {
+	for i := len(countBits) - 1; i >= 0; i-- {
+		if int32(n) >= countAdder[i] {
+			w.step(i, 4)
+			w.append(code{uint32(int32(n) - countAdder[i]), countBits[i]})
+			return
+		}
+	}
+}
+
+func (w *writer) unicode(delta int32) {
+	var sign uint32
+	if delta < 0 {
+		sign, delta = 1, -delta
+	}
+	for i := len(uniBits) - 1; i >= 0; i-- {
+		if delta >= uniAdder[i] {
+			w.step(i, 5)
+			w.append(code{sign, 1})
+			w.append(code{uint32(delta - uniAdder[i]), uniBits[i]})
+			return
+		}
+	}
+}
+
+func (w *writer) special(idx int) {
+	w.step(5, 5)
+	w.step(idx, 4)
+}
+
+type encoder struct {
+	w     writer
+	state int
+}
+
+// switchTo writes the switch code for the current state followed by the set's horizontal code
+func (e *encoder) switchTo(set int) {
+	if e.state == setDelta {
+		e.w.special(uniSwitch)
+	} else {
+		e.w.append(vcodes[0])
+	}
+	e.w.append(hcodes[set])
+}
+
+// code writes a set<<5 + position code, switching sets as needed
+func (e *encoder) code(c byte) {
+	set, pos := int(c>>5), int(c&0x1f)
+	switch set {
+	case setAlpha:
+		if e.state != setAlpha {
+			e.switchTo(setAlpha)
+			e.state = setAlpha
+		}
+	case setSym:
+		e.switchTo(setSym)
+	case setNum:
+		if e.state != setNum {
+			e.switchTo(setNum)
+			if ch := sets[set][pos]; ch >= '0' && ch <= '9' {
+				e.state = setNum
+			}
+		}
+	}
+	e.w.append(vcodes[pos])
+}
+
+// Compress encodes text with Unishox2 (default preset). Back references, runs, hex and the
+// frequent sequences are used, the date and phone templates are only decoded.
+func Compress(in []byte) []byte {
+	e := &encoder{state: setAlpha}
+	e.w.append(code{1, 1}) // magic bit
+	allUpper := false
+	var prevUni int32
+
+	for l := 0; l < len(in); l++ {
+		if l < len(in)-niceLen+1 {
+			if n, dist := longestMatch(in, l); n > 0 {
+				e.switchTo(setDict)
+				e.w.count(n - niceLen)
+				e.w.count(dist - niceLen + 1)
+				l += n - 1
+				continue
+			}
+		}
+
+		c := in[l]
+		if l > 0 && l < len(in)-4 && c == in[l-1] && c == in[l+1] && c == in[l+2] && c == in[l+3] {
+			n := 4
+			for l+n < len(in) && in[l+n] == c {
+				n++
+			}
+			e.code(rptCode)
+			e.w.count(n - 4)
+			l += n - 1
+			continue
+		}
+
+		if n, upper := hexRun(in[l:]); n > 0 {
+			e.switchTo(setNum)
+			e.w.append(vcodes[0])
+			if upper {
+				e.w.step(3, 5)
+			} else {
+				e.w.step(1, 5)
+			}
+			e.w.count(n)
+			for _, h := range in[l : l+n] {
+				e.w.append(code{uint32(nibble(h)), 4})
+			}
+			l += n - 1
+			continue
+		}
+
+		if i := freqSeq(in[l:]); i >= 0 {
+			e.code(freqCodes[i])
+			l += len(freqSeqs[i]) - 1
+			continue
+		}
+
+		isUpper := c >= 'A' && c <= 'Z'
+		if !isUpper && allUpper {
+			allUpper = false
+			e.switchTo(setAlpha)
+			e.state = setAlpha
+		}
+		if isUpper && !allUpper {
+			if e.state == setNum {
+				e.switchTo(setAlpha)
+				e.state = setAlpha
+			}
+			e.switchTo(setAlpha)
+			if e.state == setDelta {
+				e.state = setAlpha
+				e.switchTo(setAlpha)
+			}
+			if l+5 < len(in) && upperRun(in[l:l+6]) {
+				e.switchTo(setAlpha)
+				allUpper = true
+			}
+		}
+
+		switch {
+		case e.state == setDelta && (c == ' ' || c == ',' || c == '.' || c == '\n'):
+			e.w.special(map[byte]int{' ': uniSpace, ',': uniComma, '.': uniPeriod, '\n': uniNewline}[c])
+		case c == ' ':
+			if e.state == setNum {
+				e.w.append(vcodes[numSpcCode&0x1f])
+			} else {
+				e.w.append(vcodes[1])
+			}
+		case c > ' ' && c < 0x7f:
+			e.code(codes94[c-'!'])
+		case c == '\r' && l+1 < len(in) && in[l+1] == '\n':
+			e.code(crlfCode)
+			l++
+		case c == '\n':
+			e.code(lfCode)
+		case c == '\r':
+			e.code(crCode)
+		case c == '\t':
+			e.code(tabCode)
+		default:
+			r, size := utf8.DecodeRune(in[l:])
+			if r == utf8.RuneError || size < 2 {
+				n := binaryRun(in[l:])
+				e.switchTo(setNum)
+				e.w.append(vcodes[0])
+				e.w.step(5, 5)
+				e.w.count(n)
+				for _, b := range in[l : l+n] {
+					e.w.append(code{uint32(b), 8})
+				}
+				l += n - 1
+				continue
+			}
+			if e.state != setDelta {
+				if next, n := utf8.DecodeRune(in[l+size:]); next != utf8.RuneError && n > 1 {
+					// several in a row, stay in the delta state
+					if e.state != setAlpha {
+						e.switchTo(setAlpha)
+					}
+					e.switchTo(setAlpha)
+					e.w.append(vcodes[1])
+					e.state = setDelta
+				} else {
+					e.switchTo(setDelta)
+				}
+			}
+			e.w.unicode(int32(r) - prevUni)
+			prevUni = int32(r)
+			l += size - 1
+		}
+	}
+
+	// Terminate with whatever fits in the last byte
+	end := len(e.w.out)
+	if e.state != setNum {
+		e.switchTo(setNum)
+	}
+	e.w.append(vcodes[termCode&0x1f])
+	return e.w.out[:end]
+}
+
+// longestMatch finds the longest earlier copy (over niceLen bytes) of the text at l
+func longestMatch(in []byte, l int) (n, dist int) {
+	for j := l - niceLen; j >= 0; j-- {
+		k := l
+		for k < len(in) && j+k-l < l && in[k] == in[j+k-l] {
+			k++
+		}
+		for k > l && k < len(in) && in[k]>>6 == 2 {
+			k-- // don't split a UTF-8 sequence
+		}
+		if k-l > niceLen && k-l > n {
+			n, dist = k-l, l-j
+		}
+	}
+	return n, dist
+}
+
+func nibble(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0xff
+}
+
+// hexRun is the length of hex digits worth coding as nibbles, all one case
+func hexRun(in []byte) (n int, upper bool) {
+	if len(in) < 6 {
+		return 0, false
+	}
+	lower, hasUpper := false, false
+	for ; n < len(in) && nibble(in[n]) != 0xff; n++ {
+		if in[n] >= 'a' {
+			if hasUpper {
+				break
+			}
+			lower = true
+		} else if in[n] >= 'A' {
+			if lower {
+				break
+			}
+			hasUpper = true
+		}
+	}
+	if !lower && !hasUpper && n <= 10 {
+		return 0, false
+	}
+	if n <= 3 {
+		return 0, false
+	}
+	return n, hasUpper
+}
+
+func freqSeq(in []byte) int {
+	for i, seq := range freqSeqs {
+		if len(in) >= len(seq) && string(in[:len(seq)]) == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+func upperRun(in []byte) bool {
+	for _, c := range in {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// binaryRun is how many bytes to copy raw, up to the next UTF-8 character or run
+func binaryRun(in []byte) int {
+	n := 1
+	for ; n < len(in); n++ {
+		if r, size := utf8.DecodeRune(in[n:]); r != utf8.RuneError && (size > 1 || in[n] >= ' ' && in[n] < 0x7f || in[n] == '\n' || in[n] == '\r' || in[n] == '\t') {
+			break
+		}
+	}
+	return n
+}
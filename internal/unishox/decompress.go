@@ -0,0 +1,365 @@
+package unishox
+
+import "unicode/utf8"
+
+type reader struct {
+	in  []byte
+	pos int
+	len int
+}
+
+func (r *reader) bit() (int, bool) {
+	if r.pos >= r.len {
+		return 0, false
+	}
+	b := int(r.in[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return b, true
+}
+
+// num reads n bits as a number, or -1 when the input runs out
+func (r *reader) num(n int) int32 {
+	if r.pos+n > r.len {
+		return -1
+	}
+	var v int32
+	for range n {
+		b, _ := r.bit()
+		v = v<<1 | int32(b)
+	}
+	return v
+}
+
+// prefix reads one of the prefix free codes, returning its index or done
+func (r *reader) prefix(codes []code) int {
+	var bits uint32
+	for n := 1; n <= 8; n++ {
+		b, ok := r.bit()
+		if !ok {
+			return done
+		}
+		bits = bits<<1 | uint32(b)
+		for i, c := range codes {
+			if c.len == n && c.bits == bits {
+				return i
+			}
+		}
+	}
+	return done
+}
+
+// step counts 1 bits up to limit, consuming the terminating 0 bit when there is one
+func (r *reader) step(limit int) int {
+	idx := 0
+	for {
+		b, ok := r.bit()
+		if !ok {
+			return done
+		}
+		if b == 0 {
+			return idx
+		}
+		idx++
+		if idx == limit {
+			return idx
+		}
+	}
+}
+
+func (r *reader) count() int32 {
+	idx := r.step(4)
+	if idx == done {
+		return -1
+	}
+	n := r.num(countBits[idx])
+	if n < 0 {
+		return -1
+	}
+	return n + countAdder[idx]
+}
+
+// unicode reads a code point delta, or special+code for the delta state's special codes
+func (r *reader) unicode() int32 {
+	idx := r.step(5)
+	if idx == done {
+		return special + done
+	}
+	if idx == 5 {
+		return special + int32(r.step(4))
+	}
+	sign, ok := r.bit()
+	if !ok {
+		return special + done
+	}
+	n := r.num(uniBits[idx])
+	if n < 0 {
+		return special + done
+	}
+	n += uniAdder[idx]
+	if sign == 1 {
+		return -n
+	}
+	return n
+}
+
+// Decompress decodes a Unishox2 (default preset) payload, like a TEXT_MESSAGE_COMPRESSED_APP packet
+func Decompress(in []byte) ([]byte, error) {
+	r := &reader{in: in, pos: 1, len: len(in) * 8} // skip the magic bit
+	var out []byte
+
+	dstate, h := setAlpha, setAlpha
+	allUpper := false
+	var prevUni int32
+
+	for r.pos < r.len {
+		if dstate == setDelta || h == setDelta {
+			if dstate != setDelta {
+				h = dstate
+			}
+			delta := r.unicode()
+			if delta>>8 == special>>8 {
+				switch delta - special {
+				case uniSpace:
+					out = append(out, ' ')
+					continue
+				case uniSwitch:
+					h = r.prefix(hcodes)
+					if h == done {
+						return out, nil
+					}
+					if h == setDelta || h == setAlpha {
+						dstate = h
+						continue
+					}
+					if h == setDict {
+						var err error
+						if out, err = r.repeat(out); err != nil {
+							return out, err
+						}
+						h = dstate
+						continue
+					}
+				case uniComma:
+					out = append(out, ',')
+					continue
+				case uniPeriod:
+					out = append(out, '.')
+					continue
+				case uniNewline:
+					out = append(out, '\n')
+					continue
+				default:
+					return out, nil
+				}
+			} else {
+				prevUni += delta
+				if prevUni < 0 || !utf8.ValidRune(rune(prevUni)) {
+					return out, ErrCorrupt
+				}
+				out = utf8.AppendRune(out, rune(prevUni))
+				if dstate == setDelta && h == setDelta {
+					continue
+				}
+			}
+		} else {
+			h = dstate
+		}
+
+		upper := allUpper
+		v := r.prefix(vcodes)
+		if v == done {
+			break
+		}
+		if v == 0 && h != setSym {
+			if r.pos >= r.len {
+				break
+			}
+			if h != setNum || dstate != setDelta {
+				if h = r.prefix(hcodes); h == done {
+					break
+				}
+			}
+			switch h {
+			case setAlpha:
+				if dstate != setAlpha {
+					dstate = setAlpha
+					continue
+				}
+				if allUpper {
+					allUpper = false
+					continue
+				}
+				if v = r.prefix(vcodes); v == done {
+					return out, nil
+				}
+				if v == 0 {
+					if v = r.prefix(vcodes); v == done {
+						return out, nil
+					}
+					if v == 0 {
+						allUpper = true
+						continue
+					}
+				}
+				upper = true
+			case setDict:
+				var err error
+				if out, err = r.repeat(out); err != nil {
+					return out, err
+				}
+				h = dstate
+				continue
+			case setDelta:
+				continue
+			default:
+				if h != setNum || dstate != setDelta {
+					if v = r.prefix(vcodes); v == done {
+						return out, nil
+					}
+				}
+				if h == setNum && v == 0 {
+					var err error
+					if out, err = r.nibbles(out); err != nil {
+						return out, err
+					}
+					if dstate == setDelta {
+						h = setDelta
+					}
+					continue
+				}
+			}
+		}
+
+		if upper && v == 1 {
+			h, dstate = setDelta, setDelta // continuous delta coding
+			continue
+		}
+		c := sets[h][v]
+		if c >= 'a' && c <= 'z' {
+			if upper {
+				c -= 'a' - 'A'
+			}
+		} else if c == 0 {
+			switch code := byte(h<<5 + v); {
+			case code == crlfCode:
+				out = append(out, '\r', '\n')
+			case code == rptCode:
+				n := r.count()
+				if n < 0 {
+					return out, nil
+				}
+				if len(out) == 0 {
+					return out, ErrCorrupt
+				}
+				last := out[len(out)-1]
+				for range n + 4 {
+					out = append(out, last)
+				}
+			case code == termCode:
+				return out, nil
+			default:
+				for i, fc := range freqCodes {
+					if fc == code {
+						out = append(out, freqSeqs[i]...)
+					}
+				}
+			}
+			if dstate == setDelta {
+				h = setDelta
+			}
+			continue
+		}
+		if h == setNum && dstate != setNum && c >= '0' && c <= '9' {
+			dstate = setNum
+		}
+		if dstate == setDelta {
+			h = setDelta
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// repeat copies earlier output, coded as a length and distance back
+func (r *reader) repeat(out []byte) ([]byte, error) {
+	n := r.count()
+	dist := r.count()
+	if n < 0 || dist < 0 {
+		return out, nil
+	}
+	n += niceLen
+	dist += niceLen - 1
+	if int(dist) > len(out) {
+		return out, ErrCorrupt
+	}
+	start := len(out) - int(dist)
+	for i := range int(n) {
+		out = append(out, out[start+i])
+	}
+	return out, nil
+}
+
+// nibbles decodes the escapes after a NUM set switch code: templates, hex, GUIDs and raw bytes
+func (r *reader) nibbles(out []byte) ([]byte, error) {
+	idx := r.step(5)
+	switch idx {
+	case done:
+		return out, nil
+	case 0:
+		t := r.step(4)
+		if t >= len(templates) {
+			return out, ErrCorrupt
+		}
+		rem := r.count()
+		if rem < 0 {
+			return out, nil
+		}
+		tmpl := templates[t]
+		if int(rem) > len(tmpl) {
+			return out, ErrCorrupt
+		}
+		for _, c := range []byte(tmpl[:len(tmpl)-int(rem)]) {
+			bits := map[byte]int{'f': 4, 'F': 4, 'r': 3, 't': 2, 'o': 1}[c]
+			if bits == 0 {
+				out = append(out, c)
+				continue
+			}
+			nibble := r.num(bits)
+			if nibble < 0 {
+				return out, nil
+			}
+			out = append(out, hexChar(nibble, c == 'F'))
+		}
+	case 5:
+		n := r.count()
+		if n <= 0 {
+			return out, nil
+		}
+		for range n {
+			b := r.num(8)
+			if b < 0 {
+				return out, nil
+			}
+			out = append(out, byte(b))
+		}
+	default:
+		guid := idx == 2 || idx == 4
+		n := int32(32)
+		if !guid {
+			if n = r.count(); n <= 0 {
+				return out, nil
+			}
+		}
+		for i := range n {
+			nibble := r.num(4)
+			if nibble < 0 {
+				return out, nil
+			}
+			out = append(out, hexChar(nibble, idx > 2))
+			if guid && (i == 7 || i == 11 || i == 15 || i == 19) {
+				out = append(out, '-')
+			}
+		}
+	}
+	return out, nil
+}
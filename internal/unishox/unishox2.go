@@ -0,0 +1,109 @@
+package unishox
+
+/* Unishox2 with the default preset, the compression meshtastic uses for TEXT_MESSAGE_COMPRESSED_APP:
+      https://github.com/siara-cc/Unishox2
+
+	Text is coded a character at a time with variable length codes. Each character belongs to a
+	set (alpha, symbols or numbers) picked by a 'horizontal' code, and its position in the set is a
+	'vertical' code. Other characters are coded as the difference from the previous code point
+	(delta), and repeated text as a back reference (dict). The stream starts with a magic 1 bit and
+	ends at the byte boundary, with as much of a terminator as fits in the last byte.
+*/
+
+import "errors"
+
+var ErrCorrupt = errors.New("unishox2: corrupt input")
+
+const (
+	setAlpha = iota
+	setSym
+	setNum
+	setDict
+	setDelta
+
+	niceLen = 5  // back references are at least this long
+	done    = 99 // out of bits
+	special = 0x7FFFFF00
+)
+
+type code struct {
+	bits uint32
+	len  int
+}
+
+var hcodes = []code{{0b00, 2}, {0b01, 2}, {0b10, 2}, {0b110, 3}, {0b111, 3}}
+
+var vcodes = []code{
+	{0b00, 2}, {0b010, 3}, {0b011, 3}, {0b1000, 4}, {0b1001, 4}, {0b1010, 4}, {0b1011, 4},
+	{0b1100, 4}, {0b11010, 5}, {0b11011, 5}, {0b111000, 6}, {0b111001, 6}, {0b111010, 6}, {0b1110110, 7},
+	{0b1110111, 7}, {0b1111000, 7}, {0b1111001, 7}, {0b1111010, 7}, {0b11110110, 8}, {0b11110111, 8}, {0b11111000, 8},
+	{0b11111001, 8}, {0b11111010, 8}, {0b11111011, 8}, {0b11111100, 8}, {0b11111101, 8}, {0b11111110, 8}, {0b11111111, 8},
+}
+
+var sets = [3][28]byte{
+	{0, ' ', 'e', 't', 'a', 'o', 'i', 'n', 's', 'r', 'l', 'c', 'd', 'h', 'u', 'p', 'm', 'b',
+		'g', 'w', 'f', 'y', 'v', 'k', 'q', 'j', 'x', 'z'},
+	{'"', '{', '}', '_', '<', '>', ':', '\n', 0, '[', ']', '\\', ';', '\'', '\t', '@', '*', '&',
+		'?', '!', '^', '|', '\r', '~', '`', 0, 0, 0},
+	{0, ',', '.', '0', '1', '9', '2', '5', '-', '/', '3', '4', '6', '7', '8', '(', ')', ' ',
+		'=', '+', '$', '%', '#', 0, 0, 0, 0, 0},
+}
+
+// Codes in the sets that aren't a single printable character, as set<<5 + position
+const (
+	lfCode     = setSym<<5 + 7
+	crlfCode   = setSym<<5 + 8
+	tabCode    = setSym<<5 + 14
+	crCode     = setSym<<5 + 22
+	numSpcCode = setNum<<5 + 17
+	rptCode    = setNum<<5 + 26
+	termCode   = setNum<<5 + 27
+)
+
+var freqSeqs = []string{"\": \"", "\": ", "</", "=\"", "\":\"", "://"}
+var freqCodes = []byte{setSym<<5 + 25, setSym<<5 + 26, setSym<<5 + 27, setNum<<5 + 23, setNum<<5 + 24, setNum<<5 + 25}
+
+var templates = []string{"tfff-of-tfTtf:rf:rf.fffZ", "tfff-of-tf", "(fff) fff-ffff", "tf:rf:rf"}
+
+// Counts and unicode deltas start with a step code (0, 10, 110, ...) picking how many bits follow
+var (
+	countBits  = []int{2, 4, 7, 11, 16}
+	countAdder = []int32{0, 4, 20, 148, 2196}
+	uniBits    = []int{6, 12, 14, 16, 21}
+	uniAdder   = []int32{0, 64, 4160, 20544, 86080}
+)
+
+// Special codes in the delta state, after a step code of five 1s
+const (
+	uniSpace = iota
+	uniSwitch
+	uniComma
+	uniPeriod
+	uniNewline
+)
+
+// codes94 maps printable ASCII (from '!') to set<<5 + position, upper case shares the lower case code
+var codes94 [94]byte
+
+func init() {
+	for set := range sets {
+		for pos, c := range sets[set] {
+			if c > ' ' {
+				codes94[c-'!'] = byte(set<<5 + pos)
+				if c >= 'a' && c <= 'z' {
+					codes94[c-'!'-('a'-'A')] = byte(set<<5 + pos)
+				}
+			}
+		}
+	}
+}
+
+func hexChar(nibble int32, upper bool) byte {
+	switch {
+	case nibble < 10:
+		return '0' + byte(nibble)
+	case upper:
+		return 'A' + byte(nibble-10)
+	}
+	return 'a' + byte(nibble-10)
+}
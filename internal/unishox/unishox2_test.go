@@ -0,0 +1,99 @@
+package unishox
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var roundTrips = []string{
+	"",
+	"a",
+	"Hello World",
+	"Meshtastic is awesome!",
+	"ALL CAPS RUN and back to lower",
+	"Call me at 555-1234 :) or +1 (416) 555-0199",
+	"line one\nline two\r\n\ttabbed",
+	"repeat repeat repeat repeat repeat repeat",
+	"https://meshtastic.org/e/#CgMSAQESCAgBOAFAA0gB",
+	"🙂 ok, ça va? 日本語 テキスト",
+	"~`!@#$%^&*()_+-={}[]|\\:;\"'<>,.?/",
+	strings.Repeat("0123456789", 20),
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, text := range roundTrips {
+		compressed := Compress([]byte(text))
+		plain, err := Decompress(compressed)
+		if err != nil {
+			t.Errorf("Decompress(Compress(%q)): %v", text, err)
+			continue
+		}
+		if string(plain) != text {
+			t.Errorf("round trip %q came back %q", text, plain)
+		}
+	}
+}
+
+// vectors are pinned compressed bytes. 'hi' was worked by hand from the Unishox2 code tables
+// (magic bit, 'h' 1110110, 'i' 1011, then the terminator); the rest pin this encoder's output.
+var vectors = []struct {
+	text, compressed string
+}{
+	{"hi", "f6b2"},
+	{"Hello World", "8767c71483deb7c745"},
+	{"Meshtastic is awesome!", "8797aed13a8be55e94fbbd57963ee5"},
+	{"Call me at 555-1234 :)", "8733c70bcb5308b333537c73e86fcf"},
+	{"🙂 ok", "9fc053012afb"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		compressed, _ := hex.DecodeString(v.compressed)
+		if got := Compress([]byte(v.text)); !bytes.Equal(got, compressed) {
+			t.Errorf("Compress(%q) = %x, want %s", v.text, got, v.compressed)
+		}
+		plain, err := Decompress(compressed)
+		if err != nil || string(plain) != v.text {
+			t.Errorf("Decompress(%s) = %q, %v, want %q", v.compressed, plain, err, v.text)
+		}
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	// a back reference before the start of the text
+	for _, in := range [][]byte{{0xff, 0xff, 0xff, 0xff}, {0xfe, 0xfe, 0xfe}, {0x80, 0x00, 0xff, 0xff, 0xff}} {
+		Decompress(in) // must not panic, an error or partial text are both fine
+	}
+}
+
+// FuzzDecompress feeds arbitrary bytes, as heard over the air, to the decoder
+func FuzzDecompress(f *testing.F) {
+	for _, v := range vectors {
+		compressed, _ := hex.DecodeString(v.compressed)
+		f.Add(compressed)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		Decompress(in)
+	})
+}
+
+// FuzzRoundTrip checks that any valid UTF-8 text comes back the same
+func FuzzRoundTrip(f *testing.F) {
+	for _, text := range roundTrips {
+		f.Add(text)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		if !utf8.ValidString(text) {
+			t.Skip()
+		}
+		plain, err := Decompress(Compress([]byte(text)))
+		if err != nil || string(plain) != text {
+			t.Errorf("round trip %q came back %q, %v", text, plain, err)
+		}
+	})
+}
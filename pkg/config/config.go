@@ -40,6 +40,17 @@ type Config struct {
 	Meshtastic  Meshtastic
 	NodeInfo    NodeInfo
 	TextMessage TextMessage
+	Admin       Admin
+	Bot         Bot
+	Chat        Chat
+	Ack         Ack
+
+	StoreForward StoreForward
+	Bbs          Bbs
+	Traceroute   Traceroute
+	Waypoint     Waypoint
+	Atak         Atak
+	Telemetry    Telemetry
 
 	NodeDbPath string `default:"./meshtk.db"`
 
@@ -51,16 +62,35 @@ type Mqtt struct {
 	Username  string `default:"meshdev"`
 	Password  string `json:"-" default:"larg4cats"`
 	ClientId  string `default:"meshtk-abcd1234"`
+
+	DedupWindowSec int `default:"600"` // copies of a packet from other gateways are dropped for this long, 0 disables
 }
 
 type Meshtastic struct {
-	Channels []struct {
-		Slot        string `default:"primary"`
-		Name        string `default:"LongFast"`
-		EncryptKey  string `json:"-" default:"AQ=="`
-		IsEncrypted bool   `default:"true" `
-		IsPrimary   bool   `default:"true"`
-	}
+	Channels []Channel
+	LoRa     LoRa
+}
+
+type Channel struct {
+	Slot        string `yaml:"Slot" default:"primary"`
+	Name        string `yaml:"Name" default:"LongFast"`
+	EncryptKey  string `yaml:"EncryptKey" json:"-" default:"AQ=="`
+	IsEncrypted bool   `yaml:"IsEncrypted" default:"true" `
+	IsPrimary   bool   `yaml:"IsPrimary" default:"true"`
+}
+
+type LoRa struct {
+	Region         string `yaml:"Region" default:"US"`
+	ModemPreset    string `yaml:"ModemPreset" default:"LONG_FAST"`
+	UsePreset      bool   `yaml:"UsePreset" default:"true"`
+	Bandwidth      uint32 `yaml:"Bandwidth,omitempty"`
+	SpreadFactor   uint32 `yaml:"SpreadFactor,omitempty"`
+	CodingRate     uint32 `yaml:"CodingRate,omitempty"`
+	HopLimit       uint32 `yaml:"HopLimit" default:"3"`
+	ChannelNum     uint32 `yaml:"ChannelNum,omitempty"`
+	TxPower        int32  `yaml:"TxPower,omitempty"`
+	TxEnabled      bool   `yaml:"TxEnabled" default:"true"`
+	ConfigOkToMqtt bool   `yaml:"ConfigOkToMqtt" default:"true"`
 }
 
 type NodeInfo struct {
@@ -79,8 +109,9 @@ type NodeInfo struct {
 	BroadcastOnLoad      bool     `default:"false"`
 	BroadcastIntervalSec int      `default:"300"`
 	PKI                  struct {
-		PrivateKey string `default:""`
-		PublicKey  string `default:""`
+		PrivateKey      string `default:""`
+		PublicKey       string `default:""`
+		KeyChangePolicy string `default:"warn"` // accept, warn or reject a node's changed public key
 	}
 	Latitude    float64 `default:"0"`
 	Longitude   float64 `default:"0"`
@@ -91,9 +122,145 @@ type NodeInfo struct {
 	ModemPreset string  `default:"LONG_FAST"`
 }
 
+type Admin struct {
+	TimeoutSec int `default:"30"`
+}
+
+// Ack is how long direct messages wait for a ROUTING_APP acknowledgement
+type Ack struct {
+	TimeoutSec int `default:"10"` // doubled after every retry
+	Retries    int `default:"2"`
+}
+
+type Chat struct {
+	Scrollback int `default:"20"` // ledger messages shown when chat starts
+}
+
+// StoreForward is the virtual Store & Forward router, the defaults match the firmware module,
+// and how we ask other routers for history
+type StoreForward struct {
+	ChannelSlot       string `default:"primary"`
+	Records           int    `default:"300"` // text messages kept for replay
+	HeartbeatSec      int    `default:"900"` // 0 disables the heartbeat
+	ReturnMax         int    `default:"25"`  // messages replayed for one request
+	ReturnWindowMin   int    `default:"240"` // how far back a request can reach
+	PacketIntervalSec int    `default:"5"`   // wait between replayed messages
+
+	// Asking a router for history
+	Router            string // eg. '!33664ae0', empty asks the router with the latest heartbeat
+	HistoryWindowMin  int    `default:"0"`     // 0 asks for everything since the newest ledger message
+	HistoryTimeoutSec int    `default:"30"`    // wait for the router's answer and between replayed messages
+	DiscoverSec       int    `default:"900"`   // wait for a heartbeat when no router is known
+	Backfill          bool   `default:"false"` // 'bot run' and 'chat' ask for what they missed on start
+}
+
+// Bbs is the menu driven bulletin board reached by direct message
+type Bbs struct {
+	Name           string   `default:"meshtk BBS"`
+	DbPath         string   `default:"./bbs.json"`
+	ChannelSlot    string   `default:"primary"` // for direct messages to nodes without a public key
+	Boards         []string `default:"['General']"`
+	BoardLimit     int      `default:"50"` // bulletins kept per board, the oldest are dropped
+	SessionMin     int      `default:"15"` // idle sessions start again at the main menu
+	MailRetryMin   int      `default:"30"` // wait before trying undelivered mail again
+	DirectoryHours int      `default:"24"` // nodes heard within this long are in the directory
+}
+
+// Traceroute is where requests are sent and how long to wait for the response
+type Traceroute struct {
+	ChannelSlot string `default:"primary"`
+	TimeoutSec  int    `default:"60"`
+}
+
+// Waypoint is where waypoints are kept and what 'waypoint create' sends unless it's told otherwise
+type Waypoint struct {
+	DbPath      string `default:"./waypoints.json"`
+	ChannelSlot string `default:"primary"`
+	Name        string
+	Description string
+	Icon        string `default:"📍"`
+	ExpireHours int    `default:"24"`    // 0 never expires
+	Locked      bool   `default:"false"` // only we can change or delete it
+}
+
+// Atak bridges ATAK plugin packets to Cursor-on-Target (CoT) XML over UDP and CoT chat/PLI back to the mesh
+type Atak struct {
+	ChannelSlot    string `default:"primary"`
+	SendAddress    string `default:"239.2.3.1:6969"` // ATAK's SA multicast group
+	ListenAddress  string `default:"0.0.0.0:4242"`   // empty only sends CoT
+	StaleSec       int    `default:"600"`            // how long ATAK shows a mesh user after their last report
+	PliIntervalSec int    `default:"60"`             // fewest seconds between PLIs from one ATAK user sent to the mesh
+}
+
+// Telemetry is what 'telemetry run' sends for the virtual node, each kind on its own interval (0 doesn't send it).
+// Metrics are named like the protobuf fields, eg. 'battery_level' or 'temperature'.
+type Telemetry struct {
+	ChannelSlot            string `default:"primary"`
+	DeviceIntervalSec      int    `default:"1800"`
+	EnvironmentIntervalSec int    `default:"1800"`
+	PowerIntervalSec       int    `default:"0"`
+
+	Device      map[string]float64 // constants, overridden by File and then Sources
+	Environment map[string]float64
+	Power       map[string]float64
+
+	File    string            // JSON like {"environment": {"temperature": 21.5}}, read before every send
+	Sources []TelemetrySource // files read before every send, eg. /proc/uptime
+}
+
+// TelemetrySource is a metric read from the first number in a file, times Scale (0 is 1)
+type TelemetrySource struct {
+	Metric string // kind and metric, eg. 'environment.temperature'
+	Path   string // eg. '/sys/class/thermal/thermal_zone0/temp'
+	Scale  float64
+}
+
+type Bot struct {
+	Prefix     string `default:"!"`
+	RequireOTP bool   `default:"true"` // for commands not listed in Commands
+	OTPStepSec int    `default:"30"`
+	OTPSkew    int    `default:"1"`
+	Operators  []BotOperator
+	Commands   []BotCommand
+
+	Hooks           []BotHook
+	HookTimeoutSec  int `default:"10"`
+	HookConcurrency int `default:"4"` // hook processes running at once
+}
+
+// BotHook runs an executable for a bot command or for every packet on a port
+type BotHook struct {
+	Command    string // bot command name, eg. 'tide'
+	PortNum    string // or a port, eg. 'TELEMETRY_APP'
+	Exec       string
+	Args       []string
+	Usage      string // shown by the 'help' command
+	Help       string
+	TimeoutSec int // 0 uses HookTimeoutSec
+}
+
+// BotOperator is a node allowed to run OTP protected commands with its own secret
+type BotOperator struct {
+	Node   string
+	Secret string `json:"-"` // base32 TOTP secret
+}
+
+type BotCommand struct {
+	Name       string
+	RequireOTP *bool  // unset keeps Bot.RequireOTP
+	Secret     string `json:"-"` // base32 TOTP secret for this command, otherwise the operator's secret
+	Scope      string // any, dm or channel, empty keeps the command's default
+}
+
 type TextMessage struct {
 	Topic       string `default:"msh/US/2/e/LongFast"`
 	ChannelSlot string `default:"primary"`
+	To          string `default:""`  // eg. '!33664ae0', empty sends to everyone on the channel
+	ReplyId     int    `default:"0"` // packet id to thread the message under
+
+	Reassemble           bool `default:"true"` // stitch '(1/3) ' numbered parts back together for chat and bot
+	ReassembleTimeoutSec int  `default:"60"`
+	Compress             bool `default:"false"` // send as TEXT_MESSAGE_COMPRESSED_APP (Unishox2) when it's smaller
 }
 
 func NewConfig() (c *Config) {
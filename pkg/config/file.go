@@ -0,0 +1,93 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpdateFile sets values in a yaml config file, keeping the rest of the file (and comments) intact.
+// Keys are dotted paths like 'NodeInfo.PKI.PublicKey' and are matched case-insensitively like viper does.
+func UpdateFile(filename string, values map[string]any, order ...string) error {
+	var doc yaml.Node
+	raw, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", filename, err)
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	// Apply in the given order so new keys are appended predictably
+	if len(order) == 0 {
+		for key := range values {
+			order = append(order, key)
+		}
+	}
+	for _, key := range order {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(key, ".")
+		m := doc.Content[0]
+		for _, part := range parts[:len(parts)-1] {
+			m = mappingValue(m, part)
+		}
+		var v yaml.Node
+		if err := v.Encode(value); err != nil {
+			return fmt.Errorf("failed to encode %s: %v", key, err)
+		}
+		if v.Kind == yaml.ScalarNode && v.Tag == "!!str" {
+			v.Style = yaml.DoubleQuotedStyle
+		}
+		setValue(m, parts[len(parts)-1], &v)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	encoder.Close()
+
+	// Config files hold keys and passwords
+	return os.WriteFile(filename, out.Bytes(), 0600)
+}
+
+// mappingValue finds (or adds) the mapping under 'key'
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if strings.EqualFold(m.Content[i].Value, key) {
+			v := m.Content[i+1]
+			if v.Kind != yaml.MappingNode {
+				*v = yaml.Node{Kind: yaml.MappingNode}
+			}
+			return v
+		}
+	}
+	v := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, v)
+	return v
+}
+
+func setValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if strings.EqualFold(m.Content[i].Value, key) {
+			value.HeadComment = m.Content[i+1].HeadComment
+			value.LineComment = m.Content[i+1].LineComment
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}